@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-hysteria/internal/app"
+	"github.com/xflash-panda/server-hysteria/internal/app/service"
+)
+
+func TestUniqueInts(t *testing.T) {
+	tests := []struct {
+		values []int
+		want   []int
+	}{
+		{nil, nil},
+		{[]int{1}, []int{1}},
+		{[]int{3, 1, 3, 2, 1}, []int{3, 1, 2}},
+	}
+	for _, tt := range tests {
+		values := append([]int(nil), tt.values...)
+		if got := uniqueInts(values); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("uniqueInts(%v) = %v, want %v", tt.values, got, tt.want)
+		}
+		if !reflect.DeepEqual(values, tt.values) {
+			t.Errorf("uniqueInts changed its input to %v", values)
+		}
+	}
+}
+
+func TestNodeServerConfig(t *testing.T) {
+	shared := app.ServerConfig{Listen: ":443", CertFile: "/etc/cert.pem", UpMbps: 10, HopPorts: "20000-30000"}
+	nodes := []struct {
+		config *service.NodeConfig
+		listen string
+		up     int
+		hop    string
+	}{
+		{&service.NodeConfig{HysteriaConfig: api.HysteriaConfig{ServerPort: 8443, UpMbps: 100}, HopPorts: "40000-50000"},
+			":8443", 100, "40000-50000"},
+		{&service.NodeConfig{HysteriaConfig: api.HysteriaConfig{ServerPort: 9443, UpMbps: 200}},
+			":9443", 200, "20000-30000"},
+	}
+	var configs []*app.ServerConfig
+	for _, node := range nodes {
+		config := nodeServerConfig(shared, node.config)
+		config.Fill()
+		configs = append(configs, config)
+	}
+	// Each node has its own settings, on top of the shared ones, which stay as they were
+	for i, node := range nodes {
+		c := configs[i]
+		if c.Listen != node.listen || c.UpMbps != node.up || c.HopPorts != node.hop || c.CertFile != "/etc/cert.pem" {
+			t.Errorf("node %d: listen %s, up %d, hop ports %s, cert %s", i, c.Listen, c.UpMbps, c.HopPorts, c.CertFile)
+		}
+	}
+	if shared.Listen != ":443" || shared.UpMbps != 10 || shared.HopPorts != "20000-30000" || shared.ALPN != "" {
+		t.Errorf("shared config changed: %+v", shared)
+	}
+}
@@ -0,0 +1,217 @@
+// Package admin serves a small HTTP API on a local address for inspecting and
+// managing the live sessions of a node.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/core"
+)
+
+// socketMode lets only the user running the node connect to the unix socket.
+const socketMode = 0o600
+
+// Node is what the admin API manages.
+type Node interface {
+	Sessions() []core.SessionInfo
+	KickSession(id uint64) bool
+	// KickUser closes the connections of a panel user, the users of other authenticators are kicked by session.
+	KickUser(userId int) int
+	RefreshUsers() error
+	ReportTraffic() error
+}
+
+type Config struct {
+	// Listen is a loopback TCP address like 127.0.0.1:9200, or unix:/path/to/admin.sock.
+	// The API can kick anyone, so it's never served on other addresses.
+	Listen string
+	// Token must be presented as "Authorization: Bearer <token>". It is required on TCP, where any local user
+	// can connect. A unix socket may go without, it is only accessible to the user running the node.
+	Token string
+}
+
+func (c *Config) Check() error {
+	if c.unixPath() != "" {
+		return nil
+	}
+	if err := checkLoopback(c.Listen); err != nil {
+		return err
+	}
+	if c.Token == "" {
+		return errors.New("admin api on TCP needs a token")
+	}
+	return nil
+}
+
+// unixPath returns the path of the socket, empty if the API listens on TCP.
+func (c *Config) unixPath() string {
+	if path := strings.TrimPrefix(c.Listen, "unix:"); path != c.Listen {
+		return path
+	}
+	return ""
+}
+
+type Server struct {
+	config *Config
+	node   Node
+}
+
+func NewServer(config *Config, node Node) *Server {
+	return &Server{config: config, node: node}
+}
+
+// ListenAndServe blocks serving the API until the listener fails.
+func (s *Server) ListenAndServe() error {
+	if err := s.config.Check(); err != nil {
+		return err
+	}
+	var ln net.Listener
+	var err error
+	if path := s.config.unixPath(); path != "" {
+		_ = os.Remove(path)
+		ln, err = net.Listen("unix", path)
+		if err == nil {
+			if err = os.Chmod(path, socketMode); err != nil {
+				_ = ln.Close()
+			}
+		}
+	} else {
+		ln, err = net.Listen("tcp", s.config.Listen)
+	}
+	if err != nil {
+		return err
+	}
+	log.WithField("addr", s.config.Listen).Info("Admin API up and running")
+	return http.Serve(ln, s.Handler())
+}
+
+// checkLoopback refuses TCP addresses that are reachable from other hosts.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("admin api listen %s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// Handler returns the API routes:
+//
+//	GET    /sessions               list live sessions
+//	DELETE /sessions/{id}          close a session
+//	DELETE /users/{id}/sessions    close every session of a user
+//	POST   /users/refresh          fetch users from the panel now
+//	POST   /traffic/report         report traffic to the panel now
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", s.handleSessions)
+	mux.HandleFunc("/sessions/", s.handleSession)
+	mux.HandleFunc("/users/refresh", s.handleRefreshUsers)
+	mux.HandleFunc("/users/", s.handleUserSessions)
+	mux.HandleFunc("/traffic/report", s.handleReportTraffic)
+	return s.auth(mux)
+}
+
+func (s *Server) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.Token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.node.Sessions())
+}
+
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid session id"))
+		return
+	}
+	if !s.node.KickSession(id) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("session %d not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"kicked": 1})
+}
+
+func (s *Server) handleUserSessions(w http.ResponseWriter, r *http.Request) {
+	idStr, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/users/"), "/sessions")
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	userId, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid user id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"kicked": s.node.KickUser(userId)})
+}
+
+func (s *Server) handleRefreshUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if err := s.node.RefreshUsers(); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func (s *Server) handleReportTraffic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if err := s.node.ReportTraffic(); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
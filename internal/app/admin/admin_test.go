@@ -0,0 +1,62 @@
+package admin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckLoopback(t *testing.T) {
+	tests := []struct {
+		listen string
+		ok     bool
+	}{
+		{"127.0.0.1:9200", true},
+		{"[::1]:9200", true},
+		{"localhost:9200", true},
+		{"0.0.0.0:9200", false},
+		{":9200", false},
+		{"192.0.2.1:9200", false},
+		{"admin.example.com:9200", false},
+	}
+	for _, tt := range tests {
+		if err := checkLoopback(tt.listen); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok=%v", tt.listen, err, tt.ok)
+		}
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	tests := []struct {
+		config Config
+		ok     bool
+	}{
+		{Config{Listen: "127.0.0.1:9200", Token: "secret"}, true},
+		{Config{Listen: "127.0.0.1:9200"}, false},
+		{Config{Listen: "0.0.0.0:9200", Token: "secret"}, false},
+		{Config{Listen: "unix:/run/hysteria-node.sock"}, true},
+		{Config{Listen: "unix:/run/hysteria-node.sock", Token: "secret"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Check(); (err == nil) != tt.ok {
+			t.Errorf("%+v: got %v, want ok=%v", tt.config, err, tt.ok)
+		}
+	}
+}
+
+func TestListenAndServeUnixSocketMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	go func() { _ = NewServer(&Config{Listen: "unix:" + path}, nil).ListenAndServe() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fi, err := os.Stat(path)
+		if err == nil && fi.Mode().Perm() == socketMode {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("socket %v: %v", fi, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
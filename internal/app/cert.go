@@ -0,0 +1,57 @@
+package app
+
+import (
+	"crypto/tls"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/acme"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/utils"
+)
+
+var (
+	acmeManagersMutex sync.Mutex
+	// acmeManagers are shared by the nodes getting the same certificate, by dir and domains.
+	acmeManagers = make(map[string]*acme.Manager)
+)
+
+// newGetCertificateFunc returns where the certificate of the node comes from: the ACME CA if there are
+// ACME domains, the cert and key files and the cert dir otherwise.
+func newGetCertificateFunc(config *ServerConfig) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	if !config.ACME.Enabled() {
+		kpl, err := utils.NewKeypairLoader(config.CertFile, config.KeyFile, config.CertDir)
+		if err != nil {
+			return nil, err
+		}
+		return kpl.GetCertificateFunc(), nil
+	}
+	acmeManagersMutex.Lock()
+	defer acmeManagersMutex.Unlock()
+	key := config.ACME.Dir + "|" + strings.Join(config.ACME.Domains, ",")
+	if m, ok := acmeManagers[key]; ok {
+		return m.GetCertificate, nil
+	}
+	m, err := acme.NewManager(config.ACME)
+	if err != nil {
+		return nil, err
+	}
+	m.Start()
+	acmeManagers[key] = m
+	return m.GetCertificate, nil
+}
+
+// closeACMEManagers stops the renewal of every certificate, nodes created afterwards start new managers.
+func closeACMEManagers() {
+	acmeManagersMutex.Lock()
+	defer acmeManagersMutex.Unlock()
+	for key, m := range acmeManagers {
+		if err := m.Close(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"acme":  key,
+			}).Error("Failed to close the ACME manager")
+		}
+		delete(acmeManagers, key)
+	}
+}
@@ -3,8 +3,21 @@ package app
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xflash-panda/server-hysteria/internal/pkg/acme"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/auth"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/core"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/masquerade"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/porthop"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/resolver"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/transport"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/transport/pktconns/obfs"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/utils"
 )
 
 const (
@@ -14,19 +27,36 @@ const (
 	DefaultStreamReceiveWindow     = 15728640 // 15 MB/s
 	DefaultConnectionReceiveWindow = 67108864 // 64 MB/s
 	DefaultMaxIncomingStreams      = 1024
+	DefaultMaxIdleTimeout          = ServerMaxIdleTimeoutSec * time.Second
+	DefaultKeepAlivePeriod         = 10 * time.Second // Keep alive should solely be client's responsibility
+
+	minReceiveWindow    = 65536
+	minIdleTimeout      = 4 * time.Second
+	maxIdleTimeout      = 10 * time.Minute
+	minHandshakeTimeout = time.Second
 
 	DefaultALPN = "h3"
 
+	// ProtocolHysteria2 is the protocol value of Hysteria 2 nodes, which run over plain UDP.
+	ProtocolHysteria2 = "hysteria2"
+
 	ServerMaxIdleTimeoutSec = 60
 )
 
+// redactedValue replaces the secrets of the config in the logs.
+const redactedValue = "xxxxx"
+
 var rateStringRegexp = regexp.MustCompile(`^(\d+)\s*([KMGT]?)([Bb])ps$`)
 
 type ServerConfig struct {
+	// Listen is host:port, or host:ports with a port spec like 20000-50000 for port hopping.
 	Listen   string `json:"listen"`
 	Protocol string `json:"protocol"`
 	CertFile string `json:"cert"`
 	KeyFile  string `json:"key"`
+	// CertDir holds more keypairs, <name>.crt or <name>.pem each with <name>.key, served by SNI.
+	// Keypairs added to it go live without a restart.
+	CertDir string `json:"cert_dir"`
 	// Optional below
 	UpMbps              int    `json:"up_mbps"`
 	DownMbps            int    `json:"down_mbps"`
@@ -36,7 +66,37 @@ type ServerConfig struct {
 	ReceiveWindowConn   uint64 `json:"recv_window_conn"`
 	ReceiveWindowClient uint64 `json:"recv_window_client"`
 	MaxConnClient       int    `json:"max_conn_client"`
-	DisableMTUDiscovery bool   `json:"disable_mtu_discovery"`
+	// MaxUniStreamsClient is how many unidirectional streams a client may open, 0 leaves it to QUIC.
+	// Hysteria 2 needs a few for HTTP/3.
+	MaxUniStreamsClient int `json:"max_uni_streams_client"`
+	// IdleTimeout closes connections nothing has been received on for that long.
+	IdleTimeout utils.Duration `json:"idle_timeout"`
+	// KeepAlivePeriod is how often the server pings idle connections, it must be below IdleTimeout.
+	KeepAlivePeriod utils.Duration `json:"keep_alive_period"`
+	// HandshakeTimeout is how long a handshake may stall, 0 leaves it to QUIC.
+	HandshakeTimeout    utils.Duration `json:"handshake_timeout"`
+	DisableMTUDiscovery bool           `json:"disable_mtu_discovery"`
+	ACL                 string         `json:"acl"`
+	BlockCIDRs          []string       `json:"block_cidrs"`
+	AllowCIDRs          []string       `json:"allow_cidrs"`
+	// Outbounds are named outbound URLs, see transport.ParseOutbound, "direct" is always there.
+	Outbounds       map[string]string `json:"outbounds"`
+	DefaultOutbound string            `json:"default_outbound"`
+	DNS             resolver.Config   `json:"dns"`
+	// Masquerade is what clients that fail the handshake are served over HTTP/3, see masquerade.NewHandler.
+	// Empty closes them with an error.
+	Masquerade string `json:"masquerade"`
+	// ResolvePreference is one of "4", "6", "46" and "64", see transport.ResolvePreferenceFromString.
+	ResolvePreference string `json:"resolve_preference"`
+	// HopPorts are more ports clients may hop across, like 20000-50000, redirected to the listen port.
+	HopPorts string `json:"hop_ports"`
+	// Auth are the authenticators of clients tried in order, "panel", "file:<path>" or an HTTP callback URL,
+	// see auth.New. Empty is the panel.
+	Auth []string `json:"auth"`
+	// UDPBuffer is the receive and send buffer size of the UDP socket in bytes, 0 leaves it to QUIC.
+	UDPBuffer int `json:"udp_buffer"`
+	// ACME gets the certificate from an ACME CA instead of CertFile and KeyFile if it has domains.
+	ACME acme.Config `json:"acme"`
 }
 
 func (c *ServerConfig) Speed() (uint64, uint64, error) {
@@ -46,20 +106,115 @@ func (c *ServerConfig) Speed() (uint64, uint64, error) {
 	return up, down, nil
 }
 
+// coreProtocol returns the protocol spoken to clients, Protocol also picks the packet conn for the original one.
+func (c *ServerConfig) coreProtocol() core.Protocol {
+	if c.Protocol == ProtocolHysteria2 {
+		return core.ProtocolHysteria2
+	}
+	return core.ProtocolHysteria
+}
+
+// obfs returns the obfs config of the packet conn. Hysteria 2 only knows Salamander, so a bare password is one.
+func (c *ServerConfig) obfs() string {
+	if c.Protocol == ProtocolHysteria2 && len(c.Obfs) > 0 && !strings.HasPrefix(c.Obfs, obfs.NameSalamander+":") {
+		return obfs.NameSalamander + ":" + c.Obfs
+	}
+	return c.Obfs
+}
+
+// listenAddr returns the address of the socket and the ports to redirect to it.
+func (c *ServerConfig) listenAddr() (string, porthop.PortRanges, error) {
+	addr, ports, err := porthop.SplitListen(c.Listen)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(c.HopPorts) > 0 {
+		hopPorts, err := porthop.ParsePortRanges(c.HopPorts)
+		if err != nil {
+			return "", nil, err
+		}
+		ports = append(ports, hopPorts...)
+	}
+	return addr, ports, nil
+}
+
+func (c *ServerConfig) resolvePreference() (transport.ResolvePreference, error) {
+	if len(c.ResolvePreference) == 0 {
+		return transport.ResolvePreferenceDefault, nil
+	}
+	return transport.ResolvePreferenceFromString(c.ResolvePreference)
+}
+
 func (c *ServerConfig) Check() error {
 	if len(c.Listen) == 0 {
 		return errors.New("missing listen address")
 	}
+	if _, _, err := c.listenAddr(); err != nil {
+		return fmt.Errorf("invalid listen address: %s", err)
+	}
 	if up, down, err := c.Speed(); err != nil || (up != 0 && up < minSpeedBPS) || (down != 0 && down < minSpeedBPS) {
 		return errors.New("invalid speed")
 	}
-	if (c.ReceiveWindowConn != 0 && c.ReceiveWindowConn < 65536) ||
-		(c.ReceiveWindowClient != 0 && c.ReceiveWindowClient < 65536) {
+	if (c.ReceiveWindowConn != 0 && c.ReceiveWindowConn < minReceiveWindow) ||
+		(c.ReceiveWindowClient != 0 && c.ReceiveWindowClient < minReceiveWindow) {
 		return errors.New("invalid receive window size")
 	}
+	if c.ReceiveWindowConn != 0 && c.ReceiveWindowClient != 0 && c.ReceiveWindowConn > c.ReceiveWindowClient {
+		return errors.New("stream receive window larger than the connection receive window")
+	}
 	if c.MaxConnClient < 0 {
 		return errors.New("invalid max connections per client")
 	}
+	if c.MaxUniStreamsClient < 0 {
+		return errors.New("invalid max unidirectional streams per client")
+	}
+	idleTimeout, keepAlivePeriod := time.Duration(c.IdleTimeout), time.Duration(c.KeepAlivePeriod)
+	if idleTimeout != 0 && (idleTimeout < minIdleTimeout || idleTimeout > maxIdleTimeout) {
+		return fmt.Errorf("idle timeout must be between %s and %s", minIdleTimeout, maxIdleTimeout)
+	}
+	if idleTimeout == 0 {
+		idleTimeout = DefaultMaxIdleTimeout
+	}
+	if keepAlivePeriod < 0 || (keepAlivePeriod != 0 && keepAlivePeriod >= idleTimeout) {
+		return errors.New("keep alive period must be below the idle timeout")
+	}
+	if c.HandshakeTimeout != 0 && time.Duration(c.HandshakeTimeout) < minHandshakeTimeout {
+		return fmt.Errorf("handshake timeout must be at least %s", minHandshakeTimeout)
+	}
+	if c.Protocol == ProtocolHysteria2 && c.ALPN != "" && c.ALPN != DefaultALPN {
+		return errors.New("hysteria2 only runs on the h3 ALPN")
+	}
+	if c.UDPBuffer < 0 {
+		return errors.New("invalid UDP buffer size")
+	}
+	if _, err := transport.NewGuard(c.BlockCIDRs, c.AllowCIDRs); err != nil {
+		return err
+	}
+	if _, err := c.resolvePreference(); err != nil {
+		return err
+	}
+	if _, err := resolver.New(&c.DNS); err != nil {
+		return err
+	}
+	if err := c.ACME.Check(); err != nil {
+		return fmt.Errorf("invalid acme: %s", err)
+	}
+	if err := auth.Check(c.Auth); err != nil {
+		return fmt.Errorf("invalid auth: %s", err)
+	}
+	if len(c.Obfs) > 0 {
+		if _, err := obfs.NewObfuscator(c.obfs()); err != nil {
+			return fmt.Errorf("invalid obfs: %s", err)
+		}
+	}
+	if len(c.Masquerade) > 0 {
+		if _, err := masquerade.NewHandler(c.Masquerade); err != nil {
+			return fmt.Errorf("invalid masquerade: %s", err)
+		}
+	}
+	if _, ok := c.Outbounds[c.DefaultOutbound]; !ok && c.DefaultOutbound != "" && c.DefaultOutbound != transport.OutboundDirect {
+		return fmt.Errorf("unknown default outbound %s", c.DefaultOutbound)
+	}
 	return nil
 }
 
@@ -76,10 +231,38 @@ func (c *ServerConfig) Fill() {
 	if c.MaxConnClient == 0 {
 		c.MaxConnClient = DefaultMaxIncomingStreams
 	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = utils.Duration(DefaultMaxIdleTimeout)
+	}
+	if c.KeepAlivePeriod == 0 {
+		c.KeepAlivePeriod = utils.Duration(DefaultKeepAlivePeriod)
+	}
+	if len(c.Auth) == 0 {
+		c.Auth = []string{auth.SpecPanel}
+	}
 }
 
+// String is the config as logged, the values of the ACME DNS config are API tokens and such, they are left out
+// along with the passwords of the outbounds.
 func (c *ServerConfig) String() string {
-	return fmt.Sprintf("%+v", *c)
+	redacted := *c
+	if len(c.Outbounds) > 0 {
+		redacted.Outbounds = make(map[string]string, len(c.Outbounds))
+		for name, s := range c.Outbounds {
+			if u, err := url.Parse(s); err == nil {
+				redacted.Outbounds[name] = u.Redacted()
+			} else {
+				redacted.Outbounds[name] = redactedValue
+			}
+		}
+	}
+	if len(c.ACME.DNSConfig) > 0 {
+		redacted.ACME.DNSConfig = make(map[string]string, len(c.ACME.DNSConfig))
+		for k := range c.ACME.DNSConfig {
+			redacted.ACME.DNSConfig[k] = redactedValue
+		}
+	}
+	return fmt.Sprintf("%+v", redacted)
 }
 
 func stringToBps(s string) uint64 {
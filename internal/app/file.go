@@ -0,0 +1,64 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xflash-panda/server-hysteria/internal/app/service"
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is the config file of standalone mode, a node without a panel: the server config,
+// the users and the file their traffic adds up in. It's YAML or JSON, with the keys of the json tags.
+type FileConfig struct {
+	ServerConfig
+	Users []service.User `json:"users"`
+	// TrafficFile keeps the traffic totals of the users, see service.LocalBackend, empty drops the traffic.
+	TrafficFile string `json:"traffic_file"`
+}
+
+// LoadFileConfig reads the config file over config, what the file leaves out keeps its value.
+func LoadFileConfig(path string, config *FileConfig) error {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("parse config file %s: %s", path, err)
+	}
+	return nil
+}
+
+// LoadFileUsers reads just the users of the config file, so that they can change while running.
+func LoadFileUsers(path string) (*[]service.User, error) {
+	var config FileConfig
+	if err := LoadFileConfig(path, &config); err != nil {
+		return nil, err
+	}
+	for _, user := range config.Users {
+		if len(user.UUID) == 0 {
+			return nil, fmt.Errorf("user %d of %s has no uuid", user.ID, path)
+		}
+	}
+	return &config.Users, nil
+}
+
+// readConfigFile returns the file as JSON. Anything but a .json file is taken as YAML,
+// which is turned into JSON so that the json tags are all there is to the format.
+func readConfigFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return data, nil
+	}
+	var v any
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %s", path, err)
+	}
+	return json.Marshal(v)
+}
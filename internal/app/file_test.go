@@ -0,0 +1,85 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFileConfig(t *testing.T) {
+	files := map[string]string{
+		"node.yaml": `
+listen: ":443"
+protocol: hysteria2
+up_mbps: 100
+dns:
+  upstream: 1.1.1.1
+traffic_file: /var/lib/traffic.json
+users:
+  - id: 1
+    uuid: alice
+    speed_limit: 10
+`,
+		"node.json": `{"listen": ":443", "protocol": "hysteria2", "up_mbps": 100, "dns": {"upstream": "1.1.1.1"},
+"traffic_file": "/var/lib/traffic.json", "users": [{"id": 1, "uuid": "alice", "speed_limit": 10}]}`,
+	}
+	for name, content := range files {
+		path := writeConfigFile(t, name, content)
+		// What the file leaves out keeps the value of the flags
+		config := FileConfig{ServerConfig: ServerConfig{CertFile: "/etc/cert.pem", DownMbps: 50}}
+		if err := LoadFileConfig(path, &config); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if config.Listen != ":443" || config.Protocol != ProtocolHysteria2 || config.UpMbps != 100 ||
+			config.DownMbps != 50 || config.CertFile != "/etc/cert.pem" || config.DNS.Upstream != "1.1.1.1" {
+			t.Errorf("%s: server config %+v", name, config.ServerConfig)
+		}
+		if config.TrafficFile != "/var/lib/traffic.json" || len(config.Users) != 1 ||
+			config.Users[0].UUID != "alice" || config.Users[0].SpeedLimit != 10 {
+			t.Errorf("%s: traffic file %s, users %+v", name, config.TrafficFile, config.Users)
+		}
+	}
+}
+
+func TestLoadFileConfigDurations(t *testing.T) {
+	files := map[string]string{
+		"node.yaml": "idle_timeout: 30\nkeep_alive_period: 10s\nhandshake_timeout: 1m\ndns:\n  negative_ttl: 5\n",
+		"node.json": `{"idle_timeout": 30, "keep_alive_period": "10s", "handshake_timeout": "1m", "dns": {"negative_ttl": 5}}`,
+	}
+	for name, content := range files {
+		var config FileConfig
+		if err := LoadFileConfig(writeConfigFile(t, name, content), &config); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		// Numbers are seconds like the panel's, strings are Go durations
+		if config.IdleTimeout != seconds(30) || config.KeepAlivePeriod != seconds(10) ||
+			config.HandshakeTimeout != seconds(60) || config.DNS.NegativeTTL != seconds(5) {
+			t.Errorf("%s: idle %s, keep alive %s, handshake %s, negative ttl %s", name,
+				time.Duration(config.IdleTimeout), time.Duration(config.KeepAlivePeriod),
+				time.Duration(config.HandshakeTimeout), time.Duration(config.DNS.NegativeTTL))
+		}
+	}
+	if err := LoadFileConfig(writeConfigFile(t, "node.yaml", "idle_timeout: soon\n"), &FileConfig{}); err == nil {
+		t.Error("invalid duration loaded")
+	}
+}
+
+func TestLoadFileUsers(t *testing.T) {
+	path := writeConfigFile(t, "node.yaml", "users:\n  - id: 1\n    uuid: alice\n  - id: 2\n")
+	if _, err := LoadFileUsers(path); err == nil {
+		t.Error("user without uuid loaded")
+	}
+	path = writeConfigFile(t, "node.yaml", "listen: [\n")
+	if _, err := LoadFileUsers(path); err == nil {
+		t.Error("broken file loaded")
+	}
+}
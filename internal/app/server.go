@@ -2,16 +2,26 @@ package app
 
 import (
 	"crypto/tls"
+	"fmt"
 	"github.com/quic-go/quic-go"
 	"github.com/sirupsen/logrus"
 	"github.com/xflash-panda/server-hysteria/internal/app/service"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/acl"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/auth"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/core"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/masquerade"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/metrics"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/pmtud"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/porthop"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/resolver"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/sockopt"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/transport"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/transport/pktconns"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/utils"
 	"io"
 	"net"
+	"net/http"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,103 +33,417 @@ var serverPacketConnFuncFactoryMap = map[string]pktconns.ServerPacketConnFuncFac
 	"wechat":       pktconns.NewServerWeChatConnFunc,
 	"wechat-video": pktconns.NewServerWeChatConnFunc,
 	"faketcp":      pktconns.NewServerFakeTCPConnFunc,
+	// Hysteria 2
+	ProtocolHysteria2: pktconns.NewServerUDPConnFunc,
 }
 
-func Run(config *ServerConfig, usersService *service.UsersService) {
-	logrus.WithField("config", config.String()).Info("Server configuration loaded")
+// Server is a node serving clients, fed by the users service.
+type Server struct {
+	config       *ServerConfig
+	node         string
+	usersService *service.UsersService
+	server       *core.Server
+	transport    *transport.ServerTransport
+	hop          *porthop.Redirect
+	alpn         *atomic.Value // []string
+}
+
+// NewServer loads everything the node needs and starts listening, it exits the process on failure.
+func NewServer(config *ServerConfig, usersService *service.UsersService, nodeMetrics *metrics.NodeMetrics) *Server {
+	logrus.WithFields(logrus.Fields{
+		"node":   nodeMetrics.Node,
+		"config": config.String(),
+	}).Info("Server configuration loaded")
 	config.Fill()
 
 	if err := usersService.Init(); err != nil {
 		logrus.Fatalf("User service initialization error：%s", err)
 	}
 
-	// Load TLS config
+	// Load TLS config, local cert files or ACME
 	var tlsConfig *tls.Config
-	// Local cert mode
-	kpl, loaderErr := utils.NewKeypairLoader(config.CertFile, config.KeyFile)
-	if loaderErr != nil {
+	getCertificate, err := newGetCertificateFunc(config)
+	if err != nil {
 		logrus.WithFields(logrus.Fields{
-			"error": loaderErr,
+			"error": err,
 			"cert":  config.CertFile,
 			"key":   config.KeyFile,
+			"dir":   config.CertDir,
+			"acme":  config.ACME.Domains,
 		}).Fatal("Failed to load the certificate")
 	}
 	tlsConfig = &tls.Config{
-		GetCertificate: kpl.GetCertificateFunc(),
-		NextProtos:     []string{config.ALPN},
+		GetCertificate: getCertificate,
+		NextProtos:     nextProtos(config),
 		MinVersion:     tls.VersionTLS13,
 	}
+	// The ALPNs are looked up for every handshake, so that a reload can change them on the same listener
+	alpn := &atomic.Value{}
+	alpn.Store(tlsConfig.NextProtos)
+	baseTLSConfig := tlsConfig.Clone()
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		conf := baseTLSConfig.Clone()
+		conf.NextProtos = alpn.Load().([]string)
+		return conf, nil
+	}
 
 	// QUIC config
-	quicConfig := &quic.Config{
-		InitialStreamReceiveWindow:     config.ReceiveWindowConn,
-		MaxStreamReceiveWindow:         config.ReceiveWindowConn,
-		InitialConnectionReceiveWindow: config.ReceiveWindowClient,
-		MaxConnectionReceiveWindow:     config.ReceiveWindowClient,
-		MaxIncomingStreams:             int64(config.MaxConnClient),
-		MaxIdleTimeout:                 ServerMaxIdleTimeoutSec * time.Second,
-		KeepAlivePeriod:                10 * time.Second, // Keep alive should solely be client's responsibility
-		DisablePathMTUDiscovery:        config.DisableMTUDiscovery,
-		EnableDatagrams:                true,
-	}
+	quicConfig := newQUICConfig(config)
 
 	if !quicConfig.DisablePathMTUDiscovery && pmtud.DisablePathMTUDiscovery {
 		logrus.Info("Path MTU Discovery is not yet supported on this platform")
 	}
 	// Auth
-	var authFunc core.ConnectFunc
-	var err error
-	// Auth func
-	authFunc = func(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, int) {
-		userId, ok := usersService.Auth(string(auth))
-		return ok, userId
+	authenticator, err := auth.New(config.Auth, usersService)
+	if err != nil {
+		logrus.WithField("error", err).Fatal("Failed to set up authentication")
 	}
 
-	connectFunc := func(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, int) {
-		ok, userId := authFunc(addr, auth, sSend, sRecv)
-		if !ok {
-			logrus.WithFields(logrus.Fields{
-				"src": defaultIPMasker.Mask(addr.String()),
-				"msg": userId,
-			}).Info("Authentication failed, client rejected")
-		} else {
+	// Transport, the process wide parts are set up by SetupTransport
+	st := transport.DefaultServerTransport.Fork()
+	pref, _ := config.resolvePreference()
+	st.SetResolvePreference(pref)
+
+	// ACL
+	aclEngine := acl.NewEngine(st.ResolveIPAddrs, st.HasOutbound)
+	if len(config.ACL) > 0 {
+		if err := aclEngine.LoadFile(config.ACL); err != nil {
 			logrus.WithFields(logrus.Fields{
-				"src": defaultIPMasker.Mask(addr.String()),
-			}).Info("Client connected")
+				"error": err,
+				"file":  config.ACL,
+			}).Fatal("Failed to parse ACL")
+		}
+		if err := aclEngine.Watch(); err != nil {
+			logrus.WithField("error", err).Warn("Failed to watch ACL file, changes need a restart")
 		}
-		return ok, userId
 	}
 
 	// Packet conn
-	pktConnFuncFactory := serverPacketConnFuncFactoryMap[config.Protocol]
-	if pktConnFuncFactory == nil {
-		logrus.WithField("protocol", config.Protocol).Fatal("Unsupported protocol")
-	}
-	pktConnFunc := pktConnFuncFactory(config.Obfs)
-	pktConn, err := pktConnFunc(config.Listen)
+	pktConn, err := newPacketConn(config)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
 			"addr":  config.Listen,
 		}).Fatal("Failed to listen on the UDP address")
 	}
+	logUDPOffload(pktConn)
+	hop, err := newPortHopping(config)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"addr":  config.Listen,
+		}).Fatal("Failed to set up port hopping")
+	}
 	// Server
 	up, down, _ := config.Speed()
-	server, err := core.NewServer(tlsConfig, quicConfig, pktConn,
-		transport.DefaultServerTransport, up, down, config.DisableUDP, usersService,
-		connectFunc, disconnectFunc, tcpRequestFunc, tcpErrorFunc, udpRequestFunc, udpErrorFunc)
+	server, err := core.NewServer(tlsConfig, quicConfig, config.coreProtocol(), pktConn,
+		st, aclEngine, up, down, config.DisableUDP, usersService, nodeMetrics,
+		authenticator, connectFunc, disconnectFunc, tcpRequestFunc, tcpErrorFunc, udpRequestFunc, udpErrorFunc)
 	if err != nil {
 		logrus.WithField("error", err).Fatal("Failed to initialize server")
 	}
-	defer usersService.Close()
-	defer server.Close()
-	logrus.WithField("addr", config.Listen).Info("Server up and running")
+	if len(config.Masquerade) > 0 {
+		masq, err := masquerade.NewHandler(config.Masquerade)
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Failed to set up masquerade")
+		}
+		server.SetMasquerade(masq)
+	}
+	nodeMetrics.Register(usersService.Collector())
+	return &Server{
+		config:       config,
+		node:         nodeMetrics.Node,
+		usersService: usersService,
+		server:       server,
+		transport:    st,
+		hop:          hop,
+		alpn:         alpn,
+	}
+}
 
-	if err := usersService.Start(); err != nil {
+// nextProtos returns the ALPNs of the config, plus h3 for browsers if there is a masquerade.
+func nextProtos(config *ServerConfig) []string {
+	protos := []string{config.ALPN}
+	if len(config.Masquerade) > 0 && config.ALPN != DefaultALPN {
+		// Browsers only speak h3
+		protos = append(protos, DefaultALPN)
+	}
+	return protos
+}
+
+// SetupTransport sets up the resolver, destination guard and outbounds, which all the nodes
+// of the process share. It exits the process on failure.
+func SetupTransport(config *ServerConfig) {
+	// DNS
+	dnsResolver, err := resolver.New(&config.DNS)
+	if err != nil {
+		logrus.WithField("error", err).Fatal("Failed to set up DNS")
+	}
+	transport.DefaultServerTransport.Resolver = dnsResolver
+
+	// Destination guard
+	guard, err := transport.NewGuard(config.BlockCIDRs, config.AllowCIDRs)
+	if err != nil {
+		logrus.WithField("error", err).Fatal("Failed to parse the destination CIDRs")
+	}
+	transport.DefaultServerTransport.Guard = guard
+
+	// Outbounds
+	for name, u := range config.Outbounds {
+		ob, err := transport.ParseOutbound(u)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"outbound": name,
+			}).Fatal("Failed to parse outbound")
+		}
+		transport.DefaultServerTransport.Outbounds[name] = ob
+	}
+	if len(config.DefaultOutbound) > 0 {
+		transport.DefaultServerTransport.DefaultOutbound = config.DefaultOutbound
+	}
+}
+
+func newQUICConfig(config *ServerConfig) *quic.Config {
+	return &quic.Config{
+		InitialStreamReceiveWindow:     config.ReceiveWindowConn,
+		MaxStreamReceiveWindow:         config.ReceiveWindowConn,
+		InitialConnectionReceiveWindow: config.ReceiveWindowClient,
+		MaxConnectionReceiveWindow:     config.ReceiveWindowClient,
+		MaxIncomingStreams:             int64(config.MaxConnClient),
+		MaxIncomingUniStreams:          int64(config.MaxUniStreamsClient),
+		HandshakeIdleTimeout:           time.Duration(config.HandshakeTimeout),
+		MaxIdleTimeout:                 time.Duration(config.IdleTimeout),
+		KeepAlivePeriod:                time.Duration(config.KeepAlivePeriod),
+		DisablePathMTUDiscovery:        config.DisableMTUDiscovery,
+		EnableDatagrams:                true,
+	}
+}
+
+// quicConfigChanged tells whether the QUIC parameters differ, they only apply to a new listener.
+func quicConfigChanged(a, b *ServerConfig) bool {
+	return a.ReceiveWindowConn != b.ReceiveWindowConn || a.ReceiveWindowClient != b.ReceiveWindowClient ||
+		a.MaxConnClient != b.MaxConnClient || a.MaxUniStreamsClient != b.MaxUniStreamsClient ||
+		a.IdleTimeout != b.IdleTimeout || a.KeepAlivePeriod != b.KeepAlivePeriod ||
+		a.HandshakeTimeout != b.HandshakeTimeout || a.DisableMTUDiscovery != b.DisableMTUDiscovery
+}
+
+func newPacketConn(config *ServerConfig) (net.PacketConn, error) {
+	pktConnFuncFactory := serverPacketConnFuncFactoryMap[config.Protocol]
+	if pktConnFuncFactory == nil {
+		return nil, fmt.Errorf("unsupported protocol %s", config.Protocol)
+	}
+	addr, _, err := config.listenAddr()
+	if err != nil {
+		return nil, err
+	}
+	return pktConnFuncFactory(config.obfs(), config.UDPBuffer)(addr)
+}
+
+// newPortHopping redirects the hop ports of the config to the listen port, nil if there are none.
+func newPortHopping(config *ServerConfig) (*porthop.Redirect, error) {
+	addr, ports, err := config.listenAddr()
+	if err != nil || len(ports) == 0 {
+		return nil, err
+	}
+	hop, err := porthop.NewRedirect(addr, ports)
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"addr":  addr,
+		"ports": ports.String(),
+	}).Info("Port hopping enabled")
+	return hop, nil
+}
+
+// logUDPOffload reports the offloads the UDP socket of the listener has on.
+func logUDPOffload(pktConn net.PacketConn) {
+	conn, ok := pktConn.(interface{ Offload() sockopt.UDPOffload })
+	if !ok {
+		logrus.WithField("conn", fmt.Sprintf("%T", pktConn)).Info("Not a UDP socket with offloads, UDP offloads not used")
+		return
+	}
+	o := conn.Offload()
+	logrus.WithFields(logrus.Fields{
+		"gso":         o.GSO,
+		"gro":         o.GRO,
+		"readBuffer":  o.ReadBuffer,
+		"writeBuffer": o.WriteBuffer,
+	}).Info("UDP offloads")
+}
+
+// Reload applies a changed node configuration to the running server.
+// Rates, UDP, masquerade and ALPNs are switched in place and take effect for new connections. A change of listen address,
+// protocol, obfs or QUIC parameters moves the server to a new packet conn, which drops the connections on the old one,
+// but users, traffic and everything else stay as they are.
+func (s *Server) Reload(config *ServerConfig) error {
+	if err := config.Check(); err != nil {
+		return err
+	}
+	config.Fill()
+	old := s.config
+	// The parts that can fail go first, so that a failed reload leaves the server on the old config
+	addr, ports, _ := config.listenAddr()
+	oldAddr, oldPorts, _ := old.listenAddr()
+	hopChanged := addr != oldAddr || ports.String() != oldPorts.String()
+	if hopChanged {
+		// The old rules go first, the new ones may be the same
+		s.closePortHopping()
+		hop, err := newPortHopping(config)
+		if err != nil {
+			s.hop, _ = newPortHopping(old)
+			return err
+		}
+		s.hop = hop
+	}
+	if addr != oldAddr || config.Protocol != old.Protocol || config.Obfs != old.Obfs ||
+		quicConfigChanged(config, old) {
+		err := s.server.Rebind(func() (net.PacketConn, error) {
+			return newPacketConn(config)
+		}, newQUICConfig(config), addr == oldAddr, func() (net.PacketConn, error) {
+			return newPacketConn(old)
+		})
+		if err != nil {
+			if hopChanged {
+				s.closePortHopping()
+				s.hop, _ = newPortHopping(old)
+			}
+			return err
+		}
+		s.server.SetProtocol(config.coreProtocol())
+		logrus.WithFields(logrus.Fields{
+			"node":     s.node,
+			"addr":     addr,
+			"protocol": config.Protocol,
+		}).Info("Listener rebound")
+	}
+	if config.UpMbps != old.UpMbps || config.DownMbps != old.DownMbps {
+		up, down, _ := config.Speed()
+		s.server.SetSpeed(up, down)
+		logrus.WithFields(logrus.Fields{
+			"node": s.node,
+			"up":   config.UpMbps,
+			"down": config.DownMbps,
+		}).Info("Speed changed")
+	}
+	if config.ResolvePreference != old.ResolvePreference {
+		pref, _ := config.resolvePreference()
+		s.transport.SetResolvePreference(pref)
+		logrus.WithFields(logrus.Fields{
+			"node":       s.node,
+			"preference": config.ResolvePreference,
+		}).Info("Resolve preference changed")
+	}
+	if config.Masquerade != old.Masquerade {
+		var masq http.Handler
+		if len(config.Masquerade) > 0 {
+			masq, _ = masquerade.NewHandler(config.Masquerade)
+		}
+		s.server.SetMasquerade(masq)
+		logrus.WithFields(logrus.Fields{
+			"node":       s.node,
+			"masquerade": config.Masquerade,
+		}).Info("Masquerade changed")
+	}
+	if protos := nextProtos(config); fmt.Sprint(protos) != fmt.Sprint(nextProtos(old)) {
+		s.alpn.Store(protos)
+		logrus.WithFields(logrus.Fields{
+			"node": s.node,
+			"alpn": protos,
+		}).Info("ALPN changed")
+	}
+	if config.DisableUDP != old.DisableUDP {
+		s.server.SetDisableUDP(config.DisableUDP)
+		logrus.WithFields(logrus.Fields{
+			"node":       s.node,
+			"disableUDP": config.DisableUDP,
+		}).Info("UDP setting changed")
+	}
+	s.config = config
+	return nil
+}
+
+// Run starts the users service and serves clients until Shutdown is called.
+func (s *Server) Run() {
+	if err := s.usersService.Start(); err != nil {
 		logrus.Fatalf("User service start error：%s", err)
 	}
-	err = server.Serve()
-	logrus.WithField("error", err).Fatal("Server shutdown")
+	logrus.WithFields(logrus.Fields{
+		"node": s.node,
+		"addr": s.config.Listen,
+	}).Info("Server up and running")
+	if err := s.server.Serve(); err != nil {
+		logrus.WithField("error", err).Fatal("Server shutdown")
+	}
+}
+
+// Shutdown drains the clients, then stops the users service, which reports the last of the traffic.
+func (s *Server) Shutdown(drainTimeout time.Duration) {
+	logrus.WithFields(logrus.Fields{
+		"node":    s.node,
+		"timeout": drainTimeout,
+	}).Info("Draining clients")
+	if err := s.server.Shutdown(drainTimeout); err != nil {
+		logrus.WithField("error", err).Warn("Failed to close server")
+	}
+	if err := s.usersService.Close(); err != nil {
+		logrus.WithField("error", err).Warn("Failed to close user service")
+	}
+	s.closePortHopping()
+	logrus.WithField("node", s.node).Info("Server shutdown")
+}
+
+func (s *Server) closePortHopping() {
+	if s.hop == nil {
+		return
+	}
+	if err := s.hop.Close(); err != nil {
+		logrus.WithField("error", err).Warn("Failed to remove port hopping rules")
+	}
+	s.hop = nil
+}
+
+// Sessions returns the live connections of the node.
+func (s *Server) Sessions() []core.SessionInfo {
+	sessions := s.server.Sessions()
+	for i := range sessions {
+		sessions[i].Node = s.node
+	}
+	return sessions
+}
+
+// KickSession closes a single connection.
+func (s *Server) KickSession(id uint64) bool {
+	return s.server.KickSession(id)
+}
+
+// KickUser closes every connection of the user.
+func (s *Server) KickUser(userId int) int {
+	return s.server.KickUser(userId)
+}
+
+// RefreshUsers fetches the users from the panel right away.
+func (s *Server) RefreshUsers() error {
+	return s.usersService.FetchUsersTask()
+}
+
+// ReportTraffic reports the traffic to the panel right away.
+func (s *Server) ReportTraffic() error {
+	return s.usersService.ReportTrafficsTask()
+}
+
+func connectFunc(addr net.Addr, ok bool, userId int) {
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"src": defaultIPMasker.Mask(addr.String()),
+		}).Info("Authentication failed, client rejected")
+	} else {
+		logrus.WithFields(logrus.Fields{
+			"src":    defaultIPMasker.Mask(addr.String()),
+			"userId": userId,
+		}).Info("Client connected")
+	}
 }
 
 func disconnectFunc(addr net.Addr, userId int, err error) {
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/xflash-panda/server-hysteria/internal/app/admin"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/core"
+)
+
+// Node is a node of the process as Servers see it, Server is one.
+type Node interface {
+	admin.Node
+	Run()
+	Shutdown(drainTimeout time.Duration)
+}
+
+// Servers are the nodes of a process, they are managed as one by the admin API.
+type Servers []Node
+
+// Sessions returns the live connections of every node.
+func (ss Servers) Sessions() []core.SessionInfo {
+	sessions := make([]core.SessionInfo, 0)
+	for _, s := range ss {
+		sessions = append(sessions, s.Sessions()...)
+	}
+	return sessions
+}
+
+// KickSession closes a single connection, session IDs are unique across the nodes.
+func (ss Servers) KickSession(id uint64) bool {
+	for _, s := range ss {
+		if s.KickSession(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// KickUser closes every connection of the user on every node.
+func (ss Servers) KickUser(userId int) int {
+	var n int
+	for _, s := range ss {
+		n += s.KickUser(userId)
+	}
+	return n
+}
+
+// RefreshUsers fetches the users of every node from the panel right away.
+func (ss Servers) RefreshUsers() error {
+	var errs []error
+	for _, s := range ss {
+		errs = append(errs, s.RefreshUsers())
+	}
+	return errors.Join(errs...)
+}
+
+// ReportTraffic reports the traffic of every node to the panel right away.
+func (ss Servers) ReportTraffic() error {
+	var errs []error
+	for _, s := range ss {
+		errs = append(errs, s.ReportTraffic())
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown shuts the nodes down side by side, so that they all drain within drainTimeout,
+// then stops renewing their ACME certificates.
+func (ss Servers) Shutdown(drainTimeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, s := range ss {
+		wg.Add(1)
+		go func(s Node) {
+			defer wg.Done()
+			s.Shutdown(drainTimeout)
+		}(s)
+	}
+	wg.Wait()
+	closeACMEManagers()
+}
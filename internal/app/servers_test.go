@@ -0,0 +1,95 @@
+package app
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xflash-panda/server-hysteria/internal/pkg/core"
+)
+
+// fakeNode has a few sessions, a session belongs to the user with the same id.
+type fakeNode struct {
+	name       string
+	sessions   []uint64
+	refreshErr error
+	reportErr  error
+	shutdown   int32
+}
+
+func (n *fakeNode) Sessions() []core.SessionInfo {
+	var infos []core.SessionInfo
+	for _, id := range n.sessions {
+		infos = append(infos, core.SessionInfo{ID: id, Node: n.name, UserId: int(id)})
+	}
+	return infos
+}
+
+func (n *fakeNode) KickSession(id uint64) bool {
+	for _, s := range n.sessions {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *fakeNode) KickUser(userId int) int {
+	if n.KickSession(uint64(userId)) {
+		return 1
+	}
+	return 0
+}
+
+func (n *fakeNode) RefreshUsers() error  { return n.refreshErr }
+func (n *fakeNode) ReportTraffic() error { return n.reportErr }
+func (n *fakeNode) Run()                 {}
+
+func (n *fakeNode) Shutdown(time.Duration) { atomic.AddInt32(&n.shutdown, 1) }
+
+func TestServers(t *testing.T) {
+	errRefresh, errReport := errors.New("refresh failed"), errors.New("report failed")
+	a := &fakeNode{name: "1", sessions: []uint64{1, 2}, refreshErr: errRefresh}
+	b := &fakeNode{name: "2", sessions: []uint64{2, 3}, reportErr: errReport}
+	ss := Servers{a, b}
+
+	if sessions := ss.Sessions(); len(sessions) != 4 || sessions[3].Node != "2" {
+		t.Errorf("sessions = %+v", sessions)
+	}
+	tests := []struct {
+		id      uint64
+		session bool
+		users   int
+	}{
+		{1, true, 1},
+		{2, true, 2}, // on both nodes
+		{3, true, 1},
+		{4, false, 0},
+	}
+	for _, tt := range tests {
+		if got := ss.KickSession(tt.id); got != tt.session {
+			t.Errorf("KickSession(%d) = %v, want %v", tt.id, got, tt.session)
+		}
+		if got := ss.KickUser(int(tt.id)); got != tt.users {
+			t.Errorf("KickUser(%d) = %d, want %d", tt.id, got, tt.users)
+		}
+	}
+
+	// The errors of every node come back joined
+	if err := ss.RefreshUsers(); !errors.Is(err, errRefresh) || errors.Is(err, errReport) {
+		t.Errorf("RefreshUsers() = %v", err)
+	}
+	if err := ss.ReportTraffic(); !errors.Is(err, errReport) || errors.Is(err, errRefresh) {
+		t.Errorf("ReportTraffic() = %v", err)
+	}
+	a.refreshErr = nil
+	if err := ss.RefreshUsers(); err != nil {
+		t.Errorf("RefreshUsers() = %v, want nil", err)
+	}
+
+	ss.Shutdown(time.Second)
+	if a.shutdown != 1 || b.shutdown != 1 {
+		t.Errorf("shut down %d and %d times", a.shutdown, b.shutdown)
+	}
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/metrics"
+)
+
+// Backend is where the users come from and where their traffic goes, the panel unless running standalone.
+type Backend interface {
+	FetchUsers() (*[]User, error)
+	SubmitTraffic(userTraffics []*api.UserTraffic) error
+}
+
+// apiBackend is the panel of a node.
+type apiBackend struct {
+	client  *api.Client
+	nodeID  int
+	metrics *metrics.NodeMetrics
+}
+
+// FetchUsers is like api.Client.Users, but keeps the optional per-user limits the panel sends along.
+func (b *apiBackend) FetchUsers() (*[]User, error) {
+	start := time.Now()
+	rawData, err := b.client.RawUsers(api.NodeId(b.nodeID), api.Hysteria)
+	b.metrics.ObserveAPICall("users", start, err)
+	if err != nil {
+		return nil, err
+	}
+	var resp respUsers
+	if err := json.Unmarshal(rawData, &resp); err != nil {
+		return nil, fmt.Errorf("parse response failed: %s", err)
+	}
+	if len(resp.Message) > 0 {
+		return nil, fmt.Errorf("api error, message: %s", resp.Message)
+	}
+	if resp.Data == nil {
+		return &[]User{}, nil
+	}
+	return resp.Data, nil
+}
+
+func (b *apiBackend) SubmitTraffic(userTraffics []*api.UserTraffic) error {
+	start := time.Now()
+	err := b.client.Submit(api.NodeId(b.nodeID), api.Hysteria, userTraffics)
+	b.metrics.ObserveAPICall("submit", start, err)
+	return err
+}
+
+// LocalBackend runs a node without a panel. The users come from a function, usually reading them from
+// a config file so that they can be edited while running, and the traffic adds up in a JSON file.
+type LocalBackend struct {
+	loadUsers   func() (*[]User, error)
+	trafficPath string
+	mutex       sync.Mutex
+}
+
+// NewLocalBackend creates a LocalBackend, with an empty trafficPath the traffic is dropped.
+func NewLocalBackend(loadUsers func() (*[]User, error), trafficPath string) *LocalBackend {
+	return &LocalBackend{loadUsers: loadUsers, trafficPath: trafficPath}
+}
+
+func (b *LocalBackend) FetchUsers() (*[]User, error) {
+	return b.loadUsers()
+}
+
+// SubmitTraffic adds the traffic to the totals of the traffic file, a JSON list of api.UserTraffic.
+func (b *LocalBackend) SubmitTraffic(userTraffics []*api.UserTraffic) error {
+	if b.trafficPath == "" {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	totals, err := ReadTrafficFile(b.trafficPath)
+	if err != nil {
+		return err
+	}
+	byUser := make(map[int]*api.UserTraffic, len(totals)+len(userTraffics))
+	for _, t := range totals {
+		byUser[t.UID] = t
+	}
+	for _, t := range userTraffics {
+		total, ok := byUser[t.UID]
+		if !ok {
+			total = &api.UserTraffic{UID: t.UID}
+			byUser[t.UID] = total
+		}
+		total.Upload += t.Upload
+		total.Download += t.Download
+		total.Count += t.Count
+	}
+	totals = totals[:0]
+	for _, t := range byUser {
+		totals = append(totals, t)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].UID < totals[j].UID })
+	return writeFileAtomic(b.trafficPath, totals)
+}
+
+// ReadTrafficFile reads the totals of a traffic file, a missing file has none.
+func ReadTrafficFile(path string) ([]*api.UserTraffic, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var totals []*api.UserTraffic
+	if err := json.Unmarshal(data, &totals); err != nil {
+		return nil, fmt.Errorf("parse traffic file %s: %s", path, err)
+	}
+	return totals, nil
+}
+
+// writeFileAtomic writes v as JSON to a temporary file and moves it over path,
+// so that a crash leaves either the old or the new file.
+func writeFileAtomic(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	api "github.com/xflash-panda/server-client/pkg"
+)
+
+func TestLocalBackend_SubmitTraffic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "traffic.json")
+	b := NewLocalBackend(nil, path)
+	if err := b.SubmitTraffic([]*api.UserTraffic{
+		{UID: 2, Upload: 10, Download: 20, Count: 1},
+		{UID: 1, Upload: 1, Download: 2, Count: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SubmitTraffic([]*api.UserTraffic{{UID: 2, Upload: 5, Download: 5, Count: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	totals, err := ReadTrafficFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*api.UserTraffic{
+		{UID: 1, Upload: 1, Download: 2, Count: 1},
+		{UID: 2, Upload: 15, Download: 25, Count: 3},
+	}
+	if !reflect.DeepEqual(totals, want) {
+		t.Errorf("totals = %+v, want %+v", totals, want)
+	}
+
+	// Without a file the traffic is dropped
+	if err := NewLocalBackend(nil, "").SubmitTraffic(want); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,304 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	api "github.com/xflash-panda/server-client/pkg"
+)
+
+// maxSubmitAttempts is how many times a batch is submitted before it's given up on. The panel doesn't tell
+// a rejected batch from an outage, so after that the batch is moved to the rejected file for a look by hand.
+const maxSubmitAttempts = 10
+
+// trafficBatch is traffic sealed for a submission, it's submitted as is until the panel accepts it.
+type trafficBatch struct {
+	id       uint64
+	traffic  []*api.UserTraffic
+	attempts int
+}
+
+// journalRecord is a line of the journal: pending traffic, a sealed batch, a failed attempt to submit it
+// or the end of it, accepted or rejected.
+type journalRecord struct {
+	*api.UserTraffic
+	Batch   uint64             `json:"batch,omitempty"`
+	Traffic []*api.UserTraffic `json:"traffic,omitempty"`
+	Failed  uint64             `json:"failed,omitempty"`
+	Done    uint64             `json:"done,omitempty"`
+}
+
+// trafficJournal holds the user traffic that has been taken out of the counters but not yet accepted by the panel.
+// Traffic is appended as it's flushed from the counters and sealed into a batch when it's reported. A batch is
+// marked done once the panel accepts it, so that a restart resubmits only the batches that weren't. A crash right
+// between the panel accepting a batch and the journal recording it still submits it twice, the panel API has
+// nothing to tell it's a retry. With an empty path it only keeps the unreported traffic in memory.
+type trafficJournal struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	pending map[int]*api.UserTraffic
+	batch   *trafficBatch
+	lastID  uint64
+}
+
+func openTrafficJournal(path string) (*trafficJournal, error) {
+	j := &trafficJournal{path: path, pending: make(map[int]*api.UserTraffic)}
+	if path == "" {
+		return j, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	torn := false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Most likely a torn write from a crash, everything before it is still good
+			log.Warnf("journal %s line %d is corrupted, ignoring the rest: %s", path, line, err)
+			torn = true
+			break
+		}
+		j.replay(&record)
+	}
+	if err := scanner.Err(); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("read journal %s: %s", path, err)
+	}
+	j.file = f
+	if torn {
+		// Rewrite the journal without the garbage so that appends stay parseable
+		if err := j.rewrite(); err != nil {
+			_ = j.file.Close()
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+func (j *trafficJournal) replay(record *journalRecord) {
+	switch {
+	case record.Batch != 0:
+		j.batch = &trafficBatch{id: record.Batch, traffic: record.Traffic}
+		j.pending = make(map[int]*api.UserTraffic)
+		if record.Batch > j.lastID {
+			j.lastID = record.Batch
+		}
+	case record.Failed != 0:
+		if j.batch != nil && j.batch.id == record.Failed {
+			j.batch.attempts++
+		}
+	case record.Done != 0:
+		if j.batch != nil && j.batch.id == record.Done {
+			j.batch = nil
+		}
+	case record.UserTraffic != nil:
+		j.merge(record.UserTraffic)
+	}
+}
+
+func (j *trafficJournal) merge(traffic *api.UserTraffic) {
+	if p, ok := j.pending[traffic.UID]; ok {
+		p.Upload += traffic.Upload
+		p.Download += traffic.Download
+		p.Count += traffic.Count
+	} else {
+		t := *traffic
+		j.pending[traffic.UID] = &t
+	}
+}
+
+// write appends the records to the file and makes them durable, the caller holds the mutex.
+func (j *trafficJournal) write(records ...any) error {
+	if j.file == nil {
+		return nil
+	}
+	w := bufio.NewWriter(j.file)
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// rewrite replaces the file with just the open batch and the pending traffic, the caller holds the mutex.
+// The new file is moved over the old one, so that a crash leaves either.
+func (j *trafficJournal) rewrite() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	old := j.file
+	j.file = f
+	err = j.write(j.records()...)
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		j.file = old
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	_ = old.Close()
+	return nil
+}
+
+// records returns the records of the open batch and the pending traffic.
+func (j *trafficJournal) records() []any {
+	var records []any
+	if j.batch != nil {
+		records = append(records, &journalRecord{Batch: j.batch.id, Traffic: j.batch.traffic})
+		for i := 0; i < j.batch.attempts; i++ {
+			records = append(records, &journalRecord{Failed: j.batch.id})
+		}
+	}
+	for _, traffic := range j.pending {
+		records = append(records, traffic)
+	}
+	return records
+}
+
+// append records the traffic as pending and makes it durable.
+// The traffic is kept in memory even if writing the file fails.
+func (j *trafficJournal) append(userTraffics []*api.UserTraffic) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	records := make([]any, 0, len(userTraffics))
+	for _, traffic := range userTraffics {
+		j.merge(traffic)
+		records = append(records, traffic)
+	}
+	return j.write(records...)
+}
+
+// seal returns the batch to submit next: the batch that hasn't been accepted yet, carried over from an earlier
+// report, or the pending traffic sealed into a new one. It's nil if there is nothing to report.
+// The batch is returned even if writing the file fails.
+func (j *trafficJournal) seal() (batch *trafficBatch, carried bool, err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.batch != nil {
+		return j.batch, true, nil
+	}
+	if len(j.pending) == 0 {
+		return nil, false, nil
+	}
+	j.lastID++
+	j.batch = &trafficBatch{id: j.lastID, traffic: make([]*api.UserTraffic, 0, len(j.pending))}
+	for _, traffic := range j.pending {
+		j.batch.traffic = append(j.batch.traffic, traffic)
+	}
+	j.pending = make(map[int]*api.UserTraffic)
+	return j.batch, false, j.write(&journalRecord{Batch: j.batch.id, Traffic: j.batch.traffic})
+}
+
+// fail records a failed attempt to submit the batch. After maxSubmitAttempts the batch is given up on:
+// it's moved to the rejected file, or dropped with an empty path, and rejected is true.
+func (j *trafficJournal) fail(batch *trafficBatch) (rejected bool, err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	batch.attempts++
+	if batch.attempts < maxSubmitAttempts {
+		return false, j.write(&journalRecord{Failed: batch.id})
+	}
+	if j.path != "" {
+		if err := appendRejected(j.path+".rejected", batch); err != nil {
+			// Keep it around rather than lose it, it's tried again next time
+			return false, err
+		}
+	}
+	return true, j.finish(batch)
+}
+
+// done records that the panel accepted the batch.
+func (j *trafficJournal) done(batch *trafficBatch) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.finish(batch)
+}
+
+// finish drops the batch and compacts the file, the caller holds the mutex.
+func (j *trafficJournal) finish(batch *trafficBatch) error {
+	if j.batch == batch {
+		j.batch = nil
+	}
+	if err := j.write(&journalRecord{Done: batch.id}); err != nil {
+		return err
+	}
+	if j.file == nil {
+		return nil
+	}
+	return j.rewrite()
+}
+
+// appendRejected adds the batch to the rejected file, a line of JSON per batch.
+func appendRejected(path string, batch *trafficBatch) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(&journalRecord{Batch: batch.id, Traffic: batch.traffic}); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// load returns all unreported traffic, the open batch and the pending traffic merged by user.
+func (j *trafficJournal) load() []*api.UserTraffic {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	merged := make(map[int]*api.UserTraffic, len(j.pending))
+	add := func(traffic *api.UserTraffic) {
+		if m, ok := merged[traffic.UID]; ok {
+			m.Upload += traffic.Upload
+			m.Download += traffic.Download
+			m.Count += traffic.Count
+		} else {
+			t := *traffic
+			merged[traffic.UID] = &t
+		}
+	}
+	if j.batch != nil {
+		for _, traffic := range j.batch.traffic {
+			add(traffic)
+		}
+	}
+	for _, traffic := range j.pending {
+		add(traffic)
+	}
+	userTraffics := make([]*api.UserTraffic, 0, len(merged))
+	for _, traffic := range merged {
+		userTraffics = append(userTraffics, traffic)
+	}
+	return userTraffics
+}
+
+func (j *trafficJournal) close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
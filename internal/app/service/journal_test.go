@@ -0,0 +1,139 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api "github.com/xflash-panda/server-client/pkg"
+)
+
+func TestTrafficJournal_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.journal")
+	journal, err := openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = journal.append([]*api.UserTraffic{{UID: 1, Upload: 10, Download: 20, Count: 1}})
+	_ = journal.append([]*api.UserTraffic{{UID: 1, Upload: 5, Download: 5, Count: 1}, {UID: 2, Upload: 1}})
+	_ = journal.close()
+
+	journal, err = openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := make(map[int]*api.UserTraffic)
+	for _, traffic := range journal.load() {
+		pending[traffic.UID] = traffic
+	}
+	if len(pending) != 2 {
+		t.Fatalf("pending users: got %d, want 2", len(pending))
+	}
+	if pending[1].Upload != 15 || pending[1].Download != 25 || pending[1].Count != 2 {
+		t.Errorf("user 1 traffic error: %+v", *pending[1])
+	}
+
+	batch, _, _ := journal.seal()
+	_ = journal.done(batch)
+	_ = journal.close()
+	journal, err = openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(journal.load()); n != 0 {
+		t.Errorf("pending after done: got %d, want 0", n)
+	}
+}
+
+func TestTrafficJournal_TornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.journal")
+	content := "{\"user_id\":1,\"u\":10,\"d\":10,\"n\":1}\n{\"user_id\":2,\"u\""
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = journal.append([]*api.UserTraffic{{UID: 3, Upload: 1}})
+	_ = journal.close()
+
+	journal, err = openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(journal.load()); n != 2 {
+		t.Errorf("pending users: got %d, want 2", n)
+	}
+}
+
+func TestTrafficJournal_Batches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.journal")
+	journal, err := openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = journal.append([]*api.UserTraffic{{UID: 1, Upload: 10}})
+	batch, carried, err := journal.seal()
+	if err != nil || batch == nil || carried {
+		t.Fatalf("seal: %+v %v %v", batch, carried, err)
+	}
+	_, _ = journal.fail(batch)
+	_ = journal.append([]*api.UserTraffic{{UID: 2, Upload: 20}})
+	_ = journal.close()
+
+	// After a crash the sealed batch is submitted again as is, with its attempts, before the traffic since
+	journal, err = openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, carried, _ = journal.seal()
+	if batch == nil || !carried || batch.attempts != 1 || len(batch.traffic) != 1 || batch.traffic[0].UID != 1 {
+		t.Fatalf("replayed batch: %+v carried %v", batch, carried)
+	}
+	_ = journal.done(batch)
+	_ = journal.close()
+
+	// A batch recorded as done is not submitted again
+	journal, err = openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, carried, _ = journal.seal()
+	if batch == nil || carried || len(batch.traffic) != 1 || batch.traffic[0].UID != 2 {
+		t.Fatalf("batch after done: %+v carried %v", batch, carried)
+	}
+	_ = journal.close()
+}
+
+func TestTrafficJournal_Reject(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.journal")
+	journal, err := openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = journal.append([]*api.UserTraffic{{UID: 1, Upload: 10}})
+	batch, _, _ := journal.seal()
+	for i := 1; i <= maxSubmitAttempts; i++ {
+		rejected, err := journal.fail(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rejected != (i == maxSubmitAttempts) {
+			t.Fatalf("attempt %d: rejected %v", i, rejected)
+		}
+	}
+	if n := len(journal.load()); n != 0 {
+		t.Errorf("unreported after rejection: got %d, want 0", n)
+	}
+	_ = journal.close()
+
+	data, err := os.ReadFile(path + ".rejected")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"user_id":1,"u":10`) {
+		t.Errorf("rejected file: %s", data)
+	}
+}
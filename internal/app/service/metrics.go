@@ -0,0 +1,36 @@
+package service
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// trafficCollector exposes the running traffic totals of every user seen since startup.
+type trafficCollector struct {
+	trafficManager *TrafficManager
+	desc           *prometheus.Desc
+}
+
+// Collector returns the metrics collector of the per-user traffic.
+func (s *UsersService) Collector() prometheus.Collector {
+	return &trafficCollector{
+		trafficManager: s.trafficManager,
+		desc: prometheus.NewDesc("hysteria_user_bytes_total", "Bytes relayed per user.",
+			[]string{"user", "direction"}, prometheus.Labels{"node": s.metrics.Node}),
+	}
+}
+
+func (c *trafficCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *trafficCollector) Collect(ch chan<- prometheus.Metric) {
+	c.trafficManager.forRange(func(key, value any) bool {
+		user := strconv.Itoa(key.(int))
+		item := value.(*TrafficItem)
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(item.totalUp.Value()), user, "up")
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(item.totalDown.Value()), user, "down")
+		return true
+	})
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/metrics"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/task"
+)
+
+// NodeConfig is api.HysteriaConfig plus the optional settings the panel may send along.
+type NodeConfig struct {
+	api.HysteriaConfig
+	// ResolvePreference is one of "4", "6", "46" and "64", empty leaves it to the node.
+	ResolvePreference string `json:"resolve_preference"`
+	// HopPorts are the ports clients may hop across, like 20000-50000, empty leaves it to the node.
+	HopPorts string `json:"hop_ports"`
+	// QUIC parameters, zero leaves them to the node. Timeouts are in seconds.
+	ReceiveWindowConn   uint64 `json:"recv_window_conn"`
+	ReceiveWindowClient uint64 `json:"recv_window_client"`
+	MaxConnClient       int    `json:"max_conn_client"`
+	MaxUniStreamsClient int    `json:"max_uni_streams_client"`
+	IdleTimeout         int    `json:"idle_timeout"`
+	KeepAlivePeriod     int    `json:"keep_alive_period"`
+	HandshakeTimeout    int    `json:"handshake_timeout"`
+}
+
+type respNodeConfig struct {
+	Data    *NodeConfig `json:"data"`
+	Message string      `json:"message"`
+}
+
+// FetchNodeConfig is like api.Client.Config, but keeps the optional settings.
+func FetchNodeConfig(client *api.Client, nodeID int) (*NodeConfig, error) {
+	rawData, err := client.RawConfig(api.NodeId(nodeID), api.Hysteria)
+	if err != nil {
+		return nil, err
+	}
+	var resp respNodeConfig
+	if err := json.Unmarshal(rawData, &resp); err != nil {
+		return nil, fmt.Errorf("parse response failed: %s", err)
+	}
+	if len(resp.Message) > 0 {
+		return nil, fmt.Errorf("api error, message: %s", resp.Message)
+	}
+	if resp.Data == nil {
+		return nil, fmt.Errorf("api error, no node config")
+	}
+	return resp.Data, nil
+}
+
+// NodeService polls the panel for the node configuration and hands it to the apply function when it changes.
+type NodeService struct {
+	client         *api.Client
+	config         *Config
+	current        NodeConfig
+	applyFunc      func(nodeConfig *NodeConfig) error
+	metrics        *metrics.NodeMetrics
+	fcPeriodicTask *task.Periodic
+}
+
+// NewNodeService creates the service for a node running with current.
+// If applyFunc returns an error the change is not taken over and will be tried again next time.
+func NewNodeService(config *Config, client *api.Client, current *NodeConfig,
+	applyFunc func(nodeConfig *NodeConfig) error,
+) *NodeService {
+	return &NodeService{client: client, config: config, current: *current, applyFunc: applyFunc,
+		metrics: metrics.ForNode(config.NodeID)}
+}
+
+func (s *NodeService) Start() error {
+	s.fcPeriodicTask = &task.Periodic{
+		Interval: s.config.FetchConfigInterval,
+		Execute:  s.FetchConfigTask,
+	}
+	log.Infoln("Start fetch node config task")
+	if err := s.fcPeriodicTask.Start(); err != nil {
+		return fmt.Errorf("start fetch node config erorr:%s", err)
+	}
+	return nil
+}
+
+func (s *NodeService) Close() error {
+	if s.fcPeriodicTask != nil {
+		if err := s.fcPeriodicTask.Close(); err != nil {
+			log.Warn("fetch node config task close error: ", err)
+		}
+	}
+	return nil
+}
+
+func (s *NodeService) FetchConfigTask() error {
+	start := time.Now()
+	nodeConfig, err := FetchNodeConfig(s.client, s.config.NodeID)
+	s.metrics.ObserveAPICall("config", start, err)
+	if err != nil {
+		log.Errorln(err)
+		return nil
+	}
+	if *nodeConfig == s.current {
+		return nil
+	}
+	log.Infof("Node config changed: %+v", *nodeConfig)
+	if err := s.applyFunc(nodeConfig); err != nil {
+		log.Errorf("apply node config error: %s", err)
+		return nil
+	}
+	s.current = *nodeConfig
+	return nil
+}
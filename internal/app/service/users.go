@@ -5,33 +5,93 @@ import (
 	log "github.com/sirupsen/logrus"
 	api "github.com/xflash-panda/server-client/pkg"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/counter"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/metrics"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/task"
+	"path/filepath"
 	"sync"
 	"time"
 )
 
+const (
+	mbpsToBps = 125000
+
+	DefaultJournalFlushInterval = 5 * time.Second
+)
+
 type Config struct {
 	NodeID                int
 	FetchUserInterval     time.Duration
 	ReportTrafficInterval time.Duration
+	FetchConfigInterval   time.Duration
+	// StateDir keeps the traffic journal, empty keeps unreported traffic in memory only
+	StateDir string
+	// JournalFlushInterval is how often the counted traffic is written to the journal between reports,
+	// it's what a crash loses at most. Zero means DefaultJournalFlushInterval.
+	JournalFlushInterval time.Duration
+	// DeviceLimit applies to users without a device limit of their own, zero means unlimited
+	DeviceLimit int
+}
+
+// User is the user record pulled from the panel, SpeedLimit is in Mbps.
+// Zero means unlimited for both limits.
+type User struct {
+	ID          int    `json:"id"`
+	UUID        string `json:"uuid"`
+	SpeedLimit  int    `json:"speed_limit"`
+	DeviceLimit int    `json:"device_limit"`
+}
+
+type respUsers struct {
+	Data    *[]User `json:"data"`
+	Message string  `json:"message"`
 }
 
 type UsersService struct {
-	client         *api.Client
+	backend        Backend
 	config         *Config
 	userManager    *UserManager
 	trafficManager *TrafficManager
-	userList       *[]api.User
+	journal        *trafficJournal
+	fetchMutex     sync.Mutex
+	reportMutex    sync.Mutex
+	userList       *[]User
 	fuPeriodicTask *task.Periodic
 	rtPeriodicTask *task.Periodic
+	jfPeriodicTask *task.Periodic
+	metrics        *metrics.NodeMetrics
+	onlineFunc     func() map[int]int
+	kickFunc       func(userId int) int
 }
 
 func NewUsersService(config *Config, client *api.Client) *UsersService {
-	return &UsersService{client: client, config: config, userManager: newUserManager(), trafficManager: newTrafficManager()}
+	return NewUsersServiceWithBackend(config,
+		&apiBackend{client: client, nodeID: config.NodeID, metrics: metrics.ForNode(config.NodeID)})
+}
+
+// NewUsersServiceWithBackend creates a users service that gets the users from backend and reports the traffic to it.
+func NewUsersServiceWithBackend(config *Config, backend Backend) *UsersService {
+	return &UsersService{backend: backend, config: config, userManager: newUserManager(), trafficManager: newTrafficManager(),
+		metrics: metrics.ForNode(config.NodeID)}
+}
+
+func (s *UsersService) journalPath() string {
+	if s.config.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(s.config.StateDir, fmt.Sprintf("traffic-%d.journal", s.config.NodeID))
 }
 
 func (s *UsersService) Init() error {
-	userList, err := s.client.Users(api.NodeId(s.config.NodeID), api.Hysteria)
+	journal, err := openTrafficJournal(s.journalPath())
+	if err != nil {
+		return fmt.Errorf("open traffic journal error:%s", err)
+	}
+	s.journal = journal
+	if pending := journal.load(); len(pending) > 0 {
+		log.Infof("Replayed %d unreported user traffic from the journal", len(pending))
+	}
+
+	userList, err := s.backend.FetchUsers()
 	if err != nil {
 		return err
 	}
@@ -44,12 +104,23 @@ func (s *UsersService) Init() error {
 func (s *UsersService) Start() error {
 	s.fuPeriodicTask = &task.Periodic{
 		Interval: s.config.FetchUserInterval,
-		Execute:  s.FetchUsersTask,
+		Execute:  logTaskError(s.FetchUsersTask),
 	}
 
 	s.rtPeriodicTask = &task.Periodic{
 		Interval: s.config.ReportTrafficInterval,
-		Execute:  s.ReportTrafficsTask,
+		Execute:  logTaskError(s.ReportTrafficsTask),
+	}
+
+	if s.journal.path != "" {
+		flushInterval := s.config.JournalFlushInterval
+		if flushInterval == 0 {
+			flushInterval = DefaultJournalFlushInterval
+		}
+		s.jfPeriodicTask = &task.Periodic{
+			Interval: flushInterval,
+			Execute:  logTaskError(s.FlushTrafficTask),
+		}
 	}
 
 	log.Infoln("Start fetch users task")
@@ -62,34 +133,77 @@ func (s *UsersService) Start() error {
 	if err != nil {
 		return fmt.Errorf("start report traffic erorr:%s", err)
 	}
+	if s.jfPeriodicTask != nil {
+		log.Infoln("Start flush traffic task")
+		if err := s.jfPeriodicTask.Start(); err != nil {
+			return fmt.Errorf("start flush traffic erorr:%s", err)
+		}
+	}
 	return nil
 }
 
+// Close stops the periodic tasks and reports the traffic collected since the last report.
 func (s *UsersService) Close() error {
-	if err := s.fuPeriodicTask.Close(); err != nil {
-		log.Warn("fetch task close error: ", err)
+	if s.fuPeriodicTask != nil {
+		if err := s.fuPeriodicTask.Close(); err != nil {
+			log.Warn("fetch task close error: ", err)
+		}
+	}
+	if s.rtPeriodicTask != nil {
+		if err := s.rtPeriodicTask.Close(); err != nil {
+			log.Warn("report task close error: ", err)
+		}
+	}
+	if s.jfPeriodicTask != nil {
+		if err := s.jfPeriodicTask.Close(); err != nil {
+			log.Warn("flush task close error: ", err)
+		}
 	}
-	if err := s.rtPeriodicTask.Close(); err != nil {
-		log.Warn("report task close error: ", err)
+	if s.journal != nil {
+		log.Infoln("Report final traffic")
+		if err := s.ReportTrafficsTask(); err != nil {
+			log.Warn("final traffic report error: ", err)
+		}
+		if err := s.journal.close(); err != nil {
+			log.Warn("traffic journal close error: ", err)
+		}
 	}
 	return nil
 }
 
+// logTaskError logs the errors of a periodic task instead of returning them, an error would stop the task.
+func logTaskError(f func() error) func() error {
+	return func() error {
+		if err := f(); err != nil {
+			log.Errorln(err)
+		}
+		return nil
+	}
+}
+
+// FetchUsersTask updates the users from the backend and kicks the revoked ones.
 func (s *UsersService) FetchUsersTask() error {
-	// Update User
-	newUserList, err := s.client.Users(api.NodeId(s.config.NodeID), api.Hysteria)
+	s.fetchMutex.Lock()
+	defer s.fetchMutex.Unlock()
+	newUserList, err := s.backend.FetchUsers()
 	if err != nil {
-		log.Errorln(err)
-		return nil
+		return err
 	}
 
+	// A user whose limits changed shows up in both lists, so delete before adding.
 	deleted, added := s.compareUserList(newUserList)
+	if len(deleted) > 0 {
+		s.userManager.deleteUsers(deleted)
+	}
+
 	if len(added) > 0 {
 		s.userManager.addUsers(added)
 	}
 
-	if len(deleted) > 0 {
-		s.userManager.deleteUsers(deleted)
+	for _, user := range revokedUsers(deleted, added) {
+		if n := s.KickUser(user.ID); n > 0 {
+			log.Infof("kicked %d connections of user %d", n, user.ID)
+		}
 	}
 	log.Infof("%d user deleted, %d user added", len(deleted), len(added))
 	log.Infof("current users: %d", s.userManager.countUsers())
@@ -97,33 +211,118 @@ func (s *UsersService) FetchUsersTask() error {
 	return nil
 }
 
-func (s *UsersService) toUserTraffics() []*api.UserTraffic {
-	return s.trafficManager.toUserTraffics()
+// FlushTrafficTask moves the traffic counted so far into the journal, so that a crash loses only
+// what was counted since the last flush.
+func (s *UsersService) FlushTrafficTask() error {
+	if taken := s.trafficManager.take(); len(taken) > 0 {
+		if err := s.journal.append(taken); err != nil {
+			return fmt.Errorf("write traffic journal error: %s", err)
+		}
+	}
+	return nil
 }
 
+// ReportTrafficsTask flushes the counted traffic into the journal and submits it a batch at a time.
+// A batch stays in the journal until the backend accepts it, so failed reports are retried next time,
+// until it has failed maxSubmitAttempts times and is set aside in the rejected file.
 func (s *UsersService) ReportTrafficsTask() error {
-	userTraffics := s.toUserTraffics()
-	log.Infof("%d user traffic needs to be reported", len(userTraffics))
-	if len(userTraffics) > 0 {
-		err := s.client.Submit(api.NodeId(s.config.NodeID), api.Hysteria, userTraffics)
+	s.reportMutex.Lock()
+	defer s.reportMutex.Unlock()
+	if err := s.FlushTrafficTask(); err != nil {
+		log.Errorln(err)
+	}
+	// The panel API takes traffic only, api.UserTraffic has no field for devices and nothing else
+	// takes user stats from the node, so the device counts are logged and listed by the admin API.
+	if online := s.Online(); len(online) > 0 {
+		devices := 0
+		for _, n := range online {
+			devices += n
+		}
+		log.Infof("%d users online with %d devices", len(online), devices)
+	}
+	for {
+		batch, carried, err := s.journal.seal()
 		if err != nil {
-			log.Errorln(err)
+			log.Errorf("write traffic journal error: %s", err)
+		}
+		if batch == nil {
+			return nil
+		}
+		log.Infof("%d user traffic needs to be reported", len(batch.traffic))
+		if err := s.backend.SubmitTraffic(batch.traffic); err != nil {
+			rejected, jerr := s.journal.fail(batch)
+			if jerr != nil {
+				log.Errorf("write traffic journal error: %s", jerr)
+			}
+			if rejected {
+				fields := log.Fields{"error": err, "batch": batch.id, "attempts": batch.attempts}
+				if s.journal.path != "" {
+					fields["rejected"] = s.journal.path + ".rejected"
+				} else {
+					fields["traffic"] = batch.traffic
+				}
+				log.WithFields(fields).Error("Gave up on reporting a traffic batch")
+			}
+			return err
+		}
+		if err := s.journal.done(batch); err != nil {
+			log.Errorf("write traffic journal error: %s", err)
+		}
+		// The batch was left over from an earlier report, what's pending since goes out now as well
+		if !carried {
 			return nil
 		}
-		s.trafficManager.clear()
 	}
-	return nil
 }
 
 func (s *UsersService) Auth(uuid string) (int, bool) {
 	return s.userManager.auth(uuid)
 }
 
-func (s *UsersService) compareUserList(newUsers *[]api.User) (deleted, added []api.User) {
-	msrc := make(map[api.User]byte) //按源数组建索引
-	mall := make(map[api.User]byte) //源+目所有元素建索引
+// SpeedLimit returns the speed limit of the user in bytes per second, zero means unlimited.
+func (s *UsersService) SpeedLimit(userId int) uint64 {
+	return s.userManager.speedLimit(userId)
+}
+
+// DeviceLimit returns the maximum number of devices the user may be online with, zero means unlimited.
+func (s *UsersService) DeviceLimit(userId int) int {
+	if limit := s.userManager.deviceLimit(userId); limit > 0 {
+		return limit
+	}
+	return s.config.DeviceLimit
+}
+
+// SetOnlineFunc sets the source of live device counts, it is provided by the server.
+func (s *UsersService) SetOnlineFunc(f func() map[int]int) {
+	s.onlineFunc = f
+}
+
+// SetKickFunc sets the function that closes all live connections of a user, it is provided by the server.
+func (s *UsersService) SetKickFunc(f func(userId int) int) {
+	s.kickFunc = f
+}
 
-	var set []api.User //交集
+// KickUser closes all live connections of the user and returns how many were closed.
+func (s *UsersService) KickUser(userId int) int {
+	if s.kickFunc == nil {
+		return 0
+	}
+	return s.kickFunc(userId)
+}
+
+// Online returns the number of distinct devices of every online user.
+func (s *UsersService) Online() map[int]int {
+	if s.onlineFunc == nil {
+		return nil
+	}
+	return s.onlineFunc()
+}
+
+func (s *UsersService) compareUserList(newUsers *[]User) (deleted, added []User) {
+	msrc := make(map[User]byte) //按源数组建索引
+	mall := make(map[User]byte) //源+目所有元素建索引
+
+	var set []User //交集
 
 	//1.源数组建立map
 	for _, v := range *s.userList {
@@ -157,6 +356,22 @@ func (s *UsersService) compareUserList(newUsers *[]api.User) (deleted, added []a
 	return deleted, added
 }
 
+// revokedUsers returns the deleted users whose credentials are gone,
+// as opposed to users that were re-added only because their limits changed.
+func revokedUsers(deleted, added []User) []User {
+	kept := make(map[int]string, len(added))
+	for _, user := range added {
+		kept[user.ID] = user.UUID
+	}
+	var revoked []User
+	for _, user := range deleted {
+		if uuid, ok := kept[user.ID]; !ok || uuid != user.UUID {
+			revoked = append(revoked, user)
+		}
+	}
+	return revoked
+}
+
 func (s *UsersService) GetTrafficItem(userId int) *TrafficItem {
 	item := s.trafficManager.load(userId)
 	if item == nil {
@@ -168,26 +383,45 @@ func (s *UsersService) GetTrafficItem(userId int) *TrafficItem {
 }
 
 type UserManager struct {
-	store sync.Map
+	store sync.Map // uuid -> user id
+	users sync.Map // user id -> User
 }
 
 func newUserManager() *UserManager {
-	return &UserManager{store: sync.Map{}}
+	return &UserManager{store: sync.Map{}, users: sync.Map{}}
 }
 
-func (um *UserManager) addUsers(users []api.User) {
+func (um *UserManager) addUsers(users []User) {
 	for _, user := range users {
 		um.store.Store(user.UUID, user.ID)
+		um.users.Store(user.ID, user)
 	}
 }
 
-func (um *UserManager) deleteUsers(users []api.User) {
+func (um *UserManager) deleteUsers(users []User) {
 	for _, user := range users {
 		log.Infoln("--DELETE", user.UUID)
 		um.store.Delete(user.UUID)
+		um.users.Delete(user.ID)
 	}
 }
 
+func (um *UserManager) speedLimit(userId int) uint64 {
+	user, ok := um.users.Load(userId)
+	if !ok || user.(User).SpeedLimit <= 0 {
+		return 0
+	}
+	return uint64(user.(User).SpeedLimit) * mbpsToBps
+}
+
+func (um *UserManager) deviceLimit(userId int) int {
+	user, ok := um.users.Load(userId)
+	if !ok {
+		return 0
+	}
+	return user.(User).DeviceLimit
+}
+
 func (um *UserManager) countUsers() int {
 	length := 0
 	um.store.Range(func(_, _ interface{}) bool {
@@ -227,6 +461,25 @@ func (tm *TrafficManager) toUserTraffics() []*api.UserTraffic {
 	return userTraffics
 }
 
+// take is like toUserTraffics, but resets every counter it reads so no traffic is counted twice.
+func (tm *TrafficManager) take() []*api.UserTraffic {
+	userTraffics := make([]*api.UserTraffic, 0)
+	tm.store.Range(func(key, value any) bool {
+		trafficItem := value.(*TrafficItem)
+		traffic := &api.UserTraffic{
+			UID:      key.(int),
+			Upload:   trafficItem.Up.Take(),
+			Download: trafficItem.Down.Take(),
+			Count:    trafficItem.Count.Take(),
+		}
+		if traffic.Upload > 0 || traffic.Download > 0 || traffic.Count > 0 {
+			userTraffics = append(userTraffics, traffic)
+		}
+		return true
+	})
+	return userTraffics
+}
+
 func (tm *TrafficManager) load(userId int) *TrafficItem {
 	if item, ok := tm.store.Load(userId); !ok {
 		return nil
@@ -262,6 +515,22 @@ type TrafficItem struct {
 	Up    *counter.Counter
 	Down  *counter.Counter
 	Count *counter.Counter
+
+	// Running totals for metrics, they are never reset
+	totalUp   *counter.Counter
+	totalDown *counter.Counter
+}
+
+// AddUp counts bytes sent by the user.
+func (t *TrafficItem) AddUp(n uint64) {
+	t.Up.Add(n)
+	t.totalUp.Add(n)
+}
+
+// AddDown counts bytes received by the user.
+func (t *TrafficItem) AddDown(n uint64) {
+	t.Down.Add(n)
+	t.totalDown.Add(n)
 }
 
 func (t *TrafficItem) delete() {
@@ -271,5 +540,6 @@ func (t *TrafficItem) delete() {
 }
 
 func newTrafficItem() *TrafficItem {
-	return &TrafficItem{counter.NewCounter(0), counter.NewCounter(0), counter.NewCounter(0)}
+	return &TrafficItem{counter.NewCounter(0), counter.NewCounter(0), counter.NewCounter(0),
+		counter.NewCounter(0), counter.NewCounter(0)}
 }
@@ -1,10 +1,71 @@
 package service
 
 import (
+	"errors"
 	"testing"
 	"time"
+
+	api "github.com/xflash-panda/server-client/pkg"
 )
 
+// fakeBackend serves a fixed user list and fails when err is set.
+type fakeBackend struct {
+	users     []User
+	submitted []*api.UserTraffic
+	err       error
+}
+
+func (b *fakeBackend) FetchUsers() (*[]User, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	users := append([]User(nil), b.users...)
+	return &users, nil
+}
+
+func (b *fakeBackend) SubmitTraffic(traffics []*api.UserTraffic) error {
+	if b.err != nil {
+		return b.err
+	}
+	b.submitted = append(b.submitted, traffics...)
+	return nil
+}
+
+func newTestUsersService(t *testing.T, backend *fakeBackend) *UsersService {
+	s := NewUsersServiceWithBackend(&Config{NodeID: 1}, backend)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestUsersService_TaskErrors(t *testing.T) {
+	backend := &fakeBackend{users: []User{{ID: 1, UUID: "a"}}}
+	s := newTestUsersService(t, backend)
+	item := s.GetTrafficItem(1)
+	item.Up.Add(10)
+
+	backend.err = errors.New("panel down")
+	if err := s.FetchUsersTask(); !errors.Is(err, backend.err) {
+		t.Errorf("fetch got %v, want %v", err, backend.err)
+	}
+	if err := s.ReportTrafficsTask(); !errors.Is(err, backend.err) {
+		t.Errorf("report got %v, want %v", err, backend.err)
+	}
+	if _, ok := s.Auth("a"); !ok {
+		t.Error("users dropped after a failed fetch")
+	}
+
+	// The traffic of the failed report goes out with the next one
+	backend.err = nil
+	if err := s.ReportTrafficsTask(); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.submitted) != 1 || backend.submitted[0].Upload != 10 {
+		t.Errorf("submitted %+v, want the upload of 10", backend.submitted)
+	}
+}
+
 func TestTrafficManager_N1(t *testing.T) {
 	trafficManager := newTrafficManager()
 	trafficItem := newTrafficItem()
@@ -138,3 +199,84 @@ func TestTrafficManager_N4(t *testing.T) {
 		t.Error("Count value error")
 	}
 }
+
+func TestUsersService_FetchUsersRevokes(t *testing.T) {
+	backend := &fakeBackend{users: []User{
+		{ID: 1, UUID: "dropped"},
+		{ID: 2, UUID: "limited", SpeedLimit: 10},
+		{ID: 3, UUID: "rotated"},
+		{ID: 4, UUID: "unchanged"},
+	}}
+	s := newTestUsersService(t, backend)
+	kicked := make(map[int]int)
+	s.SetKickFunc(func(userId int) int {
+		kicked[userId]++
+		return 1
+	})
+
+	backend.users = []User{
+		{ID: 2, UUID: "limited", SpeedLimit: 20, DeviceLimit: 2},
+		{ID: 3, UUID: "rotated-new"},
+		{ID: 4, UUID: "unchanged"},
+	}
+	if err := s.FetchUsersTask(); err != nil {
+		t.Fatal(err)
+	}
+	// Dropped users and changed credentials are kicked, changed limits are not
+	if len(kicked) != 2 || kicked[1] != 1 || kicked[3] != 1 {
+		t.Errorf("kicked %v, want users 1 and 3", kicked)
+	}
+	if _, ok := s.Auth("dropped"); ok {
+		t.Error("dropped user still authenticates")
+	}
+	if _, ok := s.Auth("rotated"); ok {
+		t.Error("old uuid still authenticates")
+	}
+	if id, ok := s.Auth("limited"); !ok || s.SpeedLimit(id) != 20*mbpsToBps || s.DeviceLimit(id) != 2 {
+		t.Errorf("changed limits not applied: %d %v", id, ok)
+	}
+}
+
+func TestUsersService_FlushTraffic(t *testing.T) {
+	config := &Config{NodeID: 1, StateDir: t.TempDir()}
+	backend := &fakeBackend{users: []User{{ID: 1, UUID: "a"}}}
+	s := NewUsersServiceWithBackend(config, backend)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s.GetTrafficItem(1).Up.Add(10)
+	if err := s.FlushTrafficTask(); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.journal.close()
+
+	// A crash after the flush doesn't lose the traffic, it's reported after the restart
+	s = NewUsersServiceWithBackend(config, backend)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReportTrafficsTask(); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.submitted) != 1 || backend.submitted[0].Upload != 10 {
+		t.Errorf("submitted %+v, want the upload of 10", backend.submitted)
+	}
+}
+
+func TestUsersService_ReportCarriedBatch(t *testing.T) {
+	backend := &fakeBackend{users: []User{{ID: 1, UUID: "a"}, {ID: 2, UUID: "b"}}}
+	s := newTestUsersService(t, backend)
+	s.GetTrafficItem(1).Up.Add(10)
+	backend.err = errors.New("panel down")
+	_ = s.ReportTrafficsTask()
+
+	// The failed batch goes out first, then the traffic counted since
+	s.GetTrafficItem(2).Up.Add(20)
+	backend.err = nil
+	if err := s.ReportTrafficsTask(); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.submitted) != 2 || backend.submitted[0].UID != 1 || backend.submitted[1].UID != 2 {
+		t.Errorf("submitted %+v, want users 1 and 2 in turn", backend.submitted)
+	}
+}
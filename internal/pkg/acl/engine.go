@@ -0,0 +1,208 @@
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// ResolveFunc resolves a host to its addresses in the order to try them, the way the transport does,
+// see ServerTransport.ResolveIPAddrs.
+type ResolveFunc func(host string) ([]net.IPAddr, bool, error)
+
+// Engine routes outbound requests by the first matching rule, a request matching no rule goes direct.
+type Engine struct {
+	resolve     ResolveFunc
+	hasOutbound func(name string) bool
+	path        string
+	entries     atomic.Pointer[[]Entry]
+}
+
+// Result is where a request should go.
+type Result struct {
+	Action Action
+	// Host and Port are the destination to dial, rewritten by a hijack rule.
+	Host   string
+	Port   uint16
+	IPAddr *net.IPAddr
+	// IPAddrs are the addresses of the host the result holds for, IPAddr is the first.
+	// Only they should be dialed, the others may match another rule.
+	IPAddrs  []net.IPAddr
+	IsDomain bool
+	// Outbound is the name of the outbound picked by a proxy rule, empty means the default one.
+	Outbound string
+}
+
+// NewEngine returns an engine without rules, everything goes direct until rules are loaded.
+// hasOutbound tells the outbounds proxy rules may refer to, nil allows any.
+func NewEngine(resolve ResolveFunc, hasOutbound func(name string) bool) *Engine {
+	e := &Engine{resolve: resolve, hasOutbound: hasOutbound}
+	e.entries.Store(&[]Entry{})
+	return e
+}
+
+// LoadFile loads the rules from a file, one rule per line, '#' starts a comment.
+// The rules in use are left untouched if the file has any error.
+func (e *Engine) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		entry, err := ParseEntry(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineNum, err)
+		}
+		if entry.Action == ActionProxy && e.hasOutbound != nil && !e.hasOutbound(entry.ActionArg) {
+			return fmt.Errorf("%s:%d: unknown outbound %s", path, lineNum, entry.ActionArg)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	e.path = path
+	e.entries.Store(&entries)
+	return nil
+}
+
+// Watch reloads the rule file whenever it changes.
+func (e *Engine) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				switch event.Op {
+				case fsnotify.Create, fsnotify.Write, fsnotify.Rename, fsnotify.Chmod:
+					logrus.WithField("file", event.Name).Info("ACL change detected, reloading...")
+					if err := e.LoadFile(e.path); err != nil {
+						logrus.WithField("error", err).Error("Failed to reload ACL")
+					} else {
+						logrus.WithField("rules", len(*e.entries.Load())).Info("ACL successfully reloaded")
+					}
+				case fsnotify.Remove:
+					_ = watcher.Add(event.Name) // Workaround for vim
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.WithField("error", err).Error("Failed to watch ACL file for changes")
+			}
+		}
+	}()
+	if err := watcher.Add(e.path); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	return nil
+}
+
+// Match finds where the request should go. The host is only resolved when a CIDR rule needs it
+// or the request goes out. The rules are matched against the first address of the host, the addresses
+// that would match another rule are left out of the result. A resolution error is returned along with
+// the result, so that the caller can still hand the domain to a proxy.
+func (e *Engine) Match(host string, port uint16, udp bool) (*Result, error) {
+	res := &Result{Action: ActionDirect, Host: host, Port: port}
+	var resolved bool
+	var resolveErr error
+	resolveOnce := func() {
+		if !resolved {
+			resolved = true
+			res.IPAddrs, res.IsDomain, resolveErr = e.resolve(res.Host)
+		}
+	}
+	firstIP := func() net.IP {
+		resolveOnce()
+		if len(res.IPAddrs) > 0 {
+			return res.IPAddrs[0].IP
+		}
+		return nil
+	}
+	entries := *e.entries.Load()
+	lowerHost := strings.ToLower(host)
+	i := firstMatch(entries, lowerHost, firstIP, port, udp)
+	if i < len(entries) {
+		entry := &entries[i]
+		res.Action = entry.Action
+		if entry.Action == ActionProxy {
+			res.Outbound = entry.ActionArg
+		}
+		if entry.Action == ActionHijack {
+			res.Host, res.Port = hijackAddr(entry.ActionArg, port)
+			res.IPAddrs, res.IsDomain, resolved = nil, false, false
+		}
+	}
+	if res.Action == ActionBlock || res.Action == ActionReject {
+		return res, nil
+	}
+	if res.Action != ActionHijack && len(res.IPAddrs) > 1 {
+		kept := res.IPAddrs[:1:1]
+		for _, ipAddr := range res.IPAddrs[1:] {
+			ip := ipAddr.IP
+			if firstMatch(entries, lowerHost, func() net.IP { return ip }, port, udp) == i {
+				kept = append(kept, ipAddr)
+			}
+		}
+		res.IPAddrs = kept
+	}
+	resolveOnce()
+	if len(res.IPAddrs) > 0 {
+		res.IPAddr = &res.IPAddrs[0]
+	}
+	return res, resolveErr
+}
+
+// firstMatch returns the index of the first entry matching the request, len(entries) if there is none.
+// ip is only called for the entries that need the address.
+func firstMatch(entries []Entry, host string, ip func() net.IP, port uint16, udp bool) int {
+	for i := range entries {
+		var addr net.IP
+		if entries[i].needIP() {
+			addr = ip()
+		}
+		if entries[i].match(host, addr, port, udp) {
+			return i
+		}
+	}
+	return len(entries)
+}
+
+// hijackAddr parses "host" or "host:port", keeping the original port if there is none.
+func hijackAddr(arg string, port uint16) (string, uint16) {
+	host, portStr, err := net.SplitHostPort(arg)
+	if err != nil {
+		return arg, port
+	}
+	p, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return host, port
+	}
+	return host, uint16(p)
+}
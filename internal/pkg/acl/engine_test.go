@@ -0,0 +1,165 @@
+package acl
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func testResolve(host string) ([]net.IPAddr, bool, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, false, nil
+	}
+	switch host {
+	case "internal.example.com":
+		return []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}}, true, nil
+	case "mixed.example.com":
+		return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("10.1.2.3")},
+			{IP: net.ParseIP("2606:2800:220:1::1")}}, true, nil
+	case "private-first.example.com":
+		return []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}, {IP: net.ParseIP("93.184.216.34")}}, true, nil
+	default:
+		return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, true, nil
+	}
+}
+
+func TestEngine_Match(t *testing.T) {
+	rules := `
+# comment
+block domain-suffix ads.example.com
+reject domain-keyword tracker
+direct domain-regex ^api[0-9]+\.example\.org$ tcp/443
+block domain-regex ^api[0-9]+\.example\.org$
+reject cidr 10.0.0.0/8
+block ip 169.254.169.254
+reject all tcp/22,3389
+hijack domain dns.google udp/53 1.1.1.1
+hijack domain old.example.com * new.example.com:8443
+proxy domain-suffix netflix.com * exit-us
+block all udp/1000-2000
+`
+	path := filepath.Join(t.TempDir(), "acl.txt")
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(testResolve, func(name string) bool { return name == "exit-us" })
+	if err := e.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host   string
+		port   uint16
+		udp    bool
+		action Action
+		dst    string
+	}{
+		{"ads.example.com", 443, false, ActionBlock, ""},
+		{"cdn.ads.example.com", 443, false, ActionBlock, ""},
+		{"notads.example.com", 443, false, ActionDirect, "93.184.216.34"},
+		{"www.tracker.net", 80, true, ActionReject, ""},
+		{"API12.example.org", 443, false, ActionDirect, "93.184.216.34"},
+		{"api12.example.org", 80, false, ActionBlock, ""},
+		{"internal.example.com", 80, false, ActionReject, ""},
+		{"10.0.0.1", 80, true, ActionReject, ""},
+		{"169.254.169.254", 80, false, ActionBlock, ""},
+		{"1.2.3.4", 22, false, ActionReject, ""},
+		{"1.2.3.4", 22, true, ActionDirect, "1.2.3.4"},
+		{"dns.google", 53, true, ActionHijack, "1.1.1.1:53"},
+		{"dns.google", 53, false, ActionDirect, "93.184.216.34"},
+		{"old.example.com", 80, false, ActionHijack, "93.184.216.34:8443"},
+		{"www.netflix.com", 443, false, ActionProxy, "exit-us"},
+		{"1.2.3.4", 1500, true, ActionBlock, ""},
+		{"1.2.3.4", 2001, true, ActionDirect, "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		res, err := e.Match(tt.host, tt.port, tt.udp)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.host, err)
+		}
+		if res.Action != tt.action {
+			t.Errorf("%s:%d udp=%v: got action %s, want %s", tt.host, tt.port, tt.udp, res.Action, tt.action)
+			continue
+		}
+		switch res.Action {
+		case ActionDirect:
+			if res.IPAddr.String() != tt.dst {
+				t.Errorf("%s: got %s, want %s", tt.host, res.IPAddr, tt.dst)
+			}
+		case ActionProxy:
+			if res.Outbound != tt.dst {
+				t.Errorf("%s: got outbound %s, want %s", tt.host, res.Outbound, tt.dst)
+			}
+		case ActionHijack:
+			if dst := net.JoinHostPort(res.IPAddr.String(), strconv.Itoa(int(res.Port))); dst != tt.dst {
+				t.Errorf("%s: got %s, want %s", tt.host, dst, tt.dst)
+			}
+		}
+	}
+}
+
+func TestEngine_MatchAllAddresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.txt")
+	_ = os.WriteFile(path, []byte("reject cidr 10.0.0.0/8\nproxy cidr 2606:2800::/32 * exit-us\n"), 0o644)
+	e := NewEngine(testResolve, nil)
+	if err := e.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	// Only the addresses matching the rule of the first one go along
+	res, err := e.Match("mixed.example.com", 443, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != ActionDirect || len(res.IPAddrs) != 1 || res.IPAddrs[0].String() != "93.184.216.34" ||
+		res.IPAddr != &res.IPAddrs[0] {
+		t.Errorf("got %s to %v", res.Action, res.IPAddrs)
+	}
+	if res, _ := e.Match("private-first.example.com", 443, false); res.Action != ActionReject {
+		t.Errorf("got %s, want reject", res.Action)
+	}
+	// Without address rules all of them go
+	_ = os.WriteFile(path, []byte("block domain ads.example.com\n"), 0o644)
+	if err := e.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := e.Match("mixed.example.com", 443, false); len(res.IPAddrs) != 3 {
+		t.Errorf("got %v, want all addresses", res.IPAddrs)
+	}
+}
+
+func TestParseEntry_Invalid(t *testing.T) {
+	for _, s := range []string{
+		"direct",
+		"allow all",
+		"block domain",
+		"block cidr 10.0.0.0/33",
+		"block all tcp/70000",
+		"block all tcp/90-80",
+		"block all icmp",
+		"hijack all",
+		"proxy all tcp",
+		"block domain-regex (",
+		"block all tcp 1.1.1.1 extra",
+	} {
+		if _, err := ParseEntry(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestEngine_BadReloadKeepsRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.txt")
+	_ = os.WriteFile(path, []byte("block all\n"), 0o644)
+	e := NewEngine(testResolve, nil)
+	if err := e.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(path, []byte("block everything\n"), 0o644)
+	if err := e.LoadFile(path); err == nil {
+		t.Fatal("expected error")
+	}
+	if res, _ := e.Match("example.com", 80, false); res.Action != ActionBlock {
+		t.Errorf("got %s, want block", res.Action)
+	}
+}
@@ -0,0 +1,251 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Action byte
+
+const (
+	ActionDirect = Action(iota)
+	ActionBlock
+	ActionReject
+	ActionHijack
+	ActionProxy
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionDirect:
+		return "direct"
+	case ActionBlock:
+		return "block"
+	case ActionReject:
+		return "reject"
+	case ActionHijack:
+		return "hijack"
+	case ActionProxy:
+		return "proxy"
+	default:
+		return "unknown"
+	}
+}
+
+type Protocol byte
+
+const (
+	ProtocolAll = Protocol(iota)
+	ProtocolTCP
+	ProtocolUDP
+)
+
+type matchType byte
+
+const (
+	matchAll = matchType(iota)
+	matchDomain
+	matchDomainSuffix
+	matchDomainKeyword
+	matchDomainRegex
+	matchCIDR
+)
+
+type portRange struct {
+	From, To uint16
+}
+
+// Entry is a single rule, written as
+//
+//	action type target [protocol/ports] [action_arg]
+//
+// e.g. "block domain-suffix example.com", "reject cidr 10.0.0.0/8 tcp/22,3389",
+// "hijack domain dns.google udp/53 1.1.1.1", "proxy domain-suffix netflix.com * exit-us".
+// The argument of proxy is the name of the outbound to go through.
+type Entry struct {
+	Action    Action
+	ActionArg string
+	Protocol  Protocol
+	Ports     []portRange // empty means any port
+
+	matchType matchType
+	domain    string
+	regexp    *regexp.Regexp
+	net       *net.IPNet
+}
+
+// needIP reports whether the entry can only be matched against the resolved address.
+func (e *Entry) needIP() bool {
+	return e.matchType == matchCIDR
+}
+
+// match checks the entry against the request, ip may be nil when the host is not resolved.
+func (e *Entry) match(host string, ip net.IP, port uint16, udp bool) bool {
+	switch e.Protocol {
+	case ProtocolTCP:
+		if udp {
+			return false
+		}
+	case ProtocolUDP:
+		if !udp {
+			return false
+		}
+	}
+	if len(e.Ports) > 0 {
+		in := false
+		for _, r := range e.Ports {
+			if port >= r.From && port <= r.To {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+	switch e.matchType {
+	case matchAll:
+		return true
+	case matchDomain:
+		return host == e.domain
+	case matchDomainSuffix:
+		return host == e.domain || strings.HasSuffix(host, "."+e.domain)
+	case matchDomainKeyword:
+		return strings.Contains(host, e.domain)
+	case matchDomainRegex:
+		return e.regexp.MatchString(host)
+	case matchCIDR:
+		return ip != nil && e.net.Contains(ip)
+	}
+	return false
+}
+
+// ParseEntry parses a rule line, see Entry for the format.
+func ParseEntry(s string) (Entry, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return Entry{}, fmt.Errorf("expecting at least 2 fields, got %d", len(fields))
+	}
+	var e Entry
+	switch strings.ToLower(fields[0]) {
+	case "direct":
+		e.Action = ActionDirect
+	case "block":
+		e.Action = ActionBlock
+	case "reject":
+		e.Action = ActionReject
+	case "hijack":
+		e.Action = ActionHijack
+	case "proxy":
+		e.Action = ActionProxy
+	default:
+		return Entry{}, fmt.Errorf("invalid action %s", fields[0])
+	}
+	args := fields[2:]
+	switch strings.ToLower(fields[1]) {
+	case "all":
+		e.matchType = matchAll
+	default:
+		if len(args) == 0 {
+			return Entry{}, fmt.Errorf("missing target of %s", fields[1])
+		}
+		if err := e.parseTarget(strings.ToLower(fields[1]), args[0]); err != nil {
+			return Entry{}, err
+		}
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		if err := e.parseProtocolPorts(args[0]); err != nil {
+			return Entry{}, err
+		}
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		e.ActionArg = args[0]
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		return Entry{}, fmt.Errorf("unexpected field %s", args[0])
+	}
+	if e.Action == ActionHijack && e.ActionArg == "" {
+		return Entry{}, errors.New("missing hijack address")
+	}
+	if e.Action == ActionProxy && e.ActionArg == "" {
+		return Entry{}, errors.New("missing outbound")
+	}
+	return e, nil
+}
+
+func (e *Entry) parseTarget(typ, target string) error {
+	switch typ {
+	case "domain":
+		e.matchType, e.domain = matchDomain, strings.ToLower(target)
+	case "domain-suffix":
+		e.matchType, e.domain = matchDomainSuffix, strings.ToLower(strings.TrimPrefix(target, "."))
+	case "domain-keyword":
+		e.matchType, e.domain = matchDomainKeyword, strings.ToLower(target)
+	case "domain-regex":
+		re, err := regexp.Compile(target)
+		if err != nil {
+			return fmt.Errorf("invalid regex %s: %s", target, err)
+		}
+		e.matchType, e.regexp = matchDomainRegex, re
+	case "ip":
+		ip := net.ParseIP(target)
+		if ip == nil {
+			return fmt.Errorf("invalid ip %s", target)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		e.matchType, e.net = matchCIDR, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case "cidr":
+		_, ipNet, err := net.ParseCIDR(target)
+		if err != nil {
+			return fmt.Errorf("invalid cidr %s", target)
+		}
+		e.matchType, e.net = matchCIDR, ipNet
+	default:
+		return fmt.Errorf("invalid type %s", typ)
+	}
+	return nil
+}
+
+// parseProtocolPorts parses "tcp", "udp/53", "*/80,443,8000-9000" and the like.
+func (e *Entry) parseProtocolPorts(s string) error {
+	proto, ports, _ := strings.Cut(s, "/")
+	switch strings.ToLower(proto) {
+	case "tcp":
+		e.Protocol = ProtocolTCP
+	case "udp":
+		e.Protocol = ProtocolUDP
+	case "*", "":
+		e.Protocol = ProtocolAll
+	default:
+		return fmt.Errorf("invalid protocol %s", proto)
+	}
+	if ports == "" || ports == "*" {
+		return nil
+	}
+	for _, p := range strings.Split(ports, ",") {
+		from, to, isRange := strings.Cut(p, "-")
+		if !isRange {
+			to = from
+		}
+		f, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %s", p)
+		}
+		t, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || t < f {
+			return fmt.Errorf("invalid port %s", p)
+		}
+		e.Ports = append(e.Ports, portRange{From: uint16(f), To: uint16(t)})
+	}
+	return nil
+}
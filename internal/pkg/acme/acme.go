@@ -0,0 +1,419 @@
+// Package acme obtains certificates from an ACME CA like Let's Encrypt and renews them before they
+// expire, keeping them in a storage dir and handing them to TLS through GetCertificate.
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/utils"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+	ChallengeDNS01     = "dns-01"
+
+	DefaultCA          = "https://acme-v02.api.letsencrypt.org/directory"
+	DefaultDir         = "/root/.cert/acme"
+	DefaultHTTPListen  = ":80"
+	DefaultTLSListen   = ":443"
+	DefaultRenewBefore = 30 * 24 * time.Hour
+
+	accountKeyFile = "account.key"
+	issueTimeout   = 5 * time.Minute
+	checkInterval  = 12 * time.Hour
+	retryInterval  = time.Hour
+)
+
+// Config is what certificate to get and how. ACME is off without domains.
+type Config struct {
+	Domains []string `json:"domains"`
+	Email   string   `json:"email"`
+	// CA is the directory URL of the CA, Let's Encrypt by default.
+	CA string `json:"ca"`
+	// Dir keeps the account key and the certificates.
+	Dir string `json:"dir"`
+	// Challenge is http-01, tls-alpn-01 or dns-01, only dns-01 gets wildcard certificates.
+	Challenge string `json:"challenge"`
+	// HTTPListen is the TCP address answering http-01 challenges while a certificate is issued.
+	HTTPListen string `json:"http_listen"`
+	// TLSListen is the TCP address answering tls-alpn-01 challenges while a certificate is issued.
+	TLSListen string `json:"tls_listen"`
+	// DNSProvider creates the TXT records of dns-01 challenges, see NewDNSProvider.
+	DNSProvider string            `json:"dns_provider"`
+	DNSConfig   map[string]string `json:"dns_config"`
+	// RenewBefore is how long before it expires a certificate is renewed.
+	RenewBefore utils.Duration `json:"renew_before"`
+}
+
+func (c *Config) Enabled() bool {
+	return len(c.Domains) > 0
+}
+
+func (c *Config) Check() error {
+	if !c.Enabled() {
+		return nil
+	}
+	for _, domain := range c.Domains {
+		if len(domain) == 0 || strings.ContainsAny(domain, " /:") {
+			return fmt.Errorf("invalid domain %q", domain)
+		}
+		if strings.Contains(domain, "*") && c.Challenge != ChallengeDNS01 {
+			return fmt.Errorf("wildcard domain %s needs the dns-01 challenge", domain)
+		}
+	}
+	if c.RenewBefore < 0 {
+		return errors.New("invalid renew before")
+	}
+	switch c.Challenge {
+	case "", ChallengeHTTP01, ChallengeTLSALPN01:
+	case ChallengeDNS01:
+		if _, err := NewDNSProvider(c.DNSProvider, c.DNSConfig); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown challenge %s", c.Challenge)
+	}
+	return nil
+}
+
+func (c *Config) Fill() {
+	if len(c.CA) == 0 {
+		c.CA = DefaultCA
+	}
+	if len(c.Dir) == 0 {
+		c.Dir = DefaultDir
+	}
+	if len(c.Challenge) == 0 {
+		c.Challenge = ChallengeHTTP01
+	}
+	if len(c.HTTPListen) == 0 {
+		c.HTTPListen = DefaultHTTPListen
+	}
+	if len(c.TLSListen) == 0 {
+		c.TLSListen = DefaultTLSListen
+	}
+	if c.RenewBefore == 0 {
+		c.RenewBefore = utils.Duration(DefaultRenewBefore)
+	}
+}
+
+// Manager holds the certificate of the domains, issuing it if there is no usable one in the storage dir
+// and renewing it in the background.
+type Manager struct {
+	config Config
+	cert   atomic.Pointer[tls.Certificate]
+	// alpnCerts are the tls-alpn-01 challenge certificates by domain, while they are being validated.
+	alpnCerts sync.Map
+
+	issueMutex sync.Mutex
+	client     *acme.Client
+	solver     solver
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewManager loads the certificate from the storage dir or issues it. Renewal starts with Start.
+func NewManager(config Config) (*Manager, error) {
+	config.Fill()
+	if err := config.Check(); err != nil {
+		return nil, err
+	}
+	if !config.Enabled() {
+		return nil, errors.New("no domains")
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateKey(filepath.Join(config.Dir, accountKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("account key: %w", err)
+	}
+	m := &Manager{
+		config: config,
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: config.CA,
+			HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+			UserAgent:    "hysteria-node",
+		},
+		done: make(chan struct{}),
+	}
+	m.solver, err = m.newSolver()
+	if err != nil {
+		return nil, err
+	}
+	if cert, err := m.loadCert(); err == nil {
+		m.cert.Store(cert)
+	}
+	if err := m.renewIfNeeded(); err != nil {
+		if m.cert.Load() == nil {
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"domains": m.config.Domains,
+		}).Error("Failed to renew the certificate, using the old one for now")
+	}
+	return m, nil
+}
+
+// GetCertificate returns the certificate, or the challenge certificate to acme-tls/1 handshakes.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		if cert, ok := m.alpnCerts.Load(strings.ToLower(hello.ServerName)); ok {
+			return cert.(*tls.Certificate), nil
+		}
+		return nil, fmt.Errorf("no challenge for %s", hello.ServerName)
+	}
+	cert := m.cert.Load()
+	if cert == nil {
+		return nil, errors.New("no certificate")
+	}
+	return cert, nil
+}
+
+// Start renews the certificate in the background until Close.
+func (m *Manager) Start() {
+	go func() {
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-ticker.C:
+			}
+			if err := m.renewIfNeeded(); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error":   err,
+					"domains": m.config.Domains,
+					"retry":   retryInterval,
+				}).Error("Failed to renew the certificate")
+				ticker.Reset(retryInterval)
+			} else {
+				ticker.Reset(checkInterval)
+			}
+		}
+	}()
+}
+
+func (m *Manager) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+	return nil
+}
+
+// renewIfNeeded issues the certificate if there is none, it is about to expire or misses domains.
+func (m *Manager) renewIfNeeded() error {
+	m.issueMutex.Lock()
+	defer m.issueMutex.Unlock()
+	if cert := m.cert.Load(); cert != nil && !m.needsRenewal(cert.Leaf) {
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"domains":   m.config.Domains,
+		"ca":        m.config.CA,
+		"challenge": m.config.Challenge,
+	}).Info("Obtaining the certificate")
+	ctx, cancel := context.WithTimeout(context.Background(), issueTimeout)
+	defer cancel()
+	cert, err := m.issue(ctx)
+	if err != nil {
+		return err
+	}
+	m.cert.Store(cert)
+	logrus.WithFields(logrus.Fields{
+		"domains":  m.config.Domains,
+		"notAfter": cert.Leaf.NotAfter,
+	}).Info("Certificate obtained")
+	return nil
+}
+
+func (m *Manager) needsRenewal(leaf *x509.Certificate) bool {
+	if time.Now().Add(time.Duration(m.config.RenewBefore)).After(leaf.NotAfter) {
+		return true
+	}
+	names := make(map[string]bool, len(leaf.DNSNames))
+	for _, name := range leaf.DNSNames {
+		names[strings.ToLower(name)] = true
+	}
+	for _, domain := range m.config.Domains {
+		if !names[strings.ToLower(domain)] {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) issue(ctx context.Context) (*tls.Certificate, error) {
+	var contact []string
+	if len(m.config.Email) > 0 {
+		contact = []string{"mailto:" + m.config.Email}
+	}
+	_, err := m.client.Register(ctx, &acme.Account{Contact: contact}, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("register: %w", err)
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.config.Domains...))
+	if err != nil {
+		return nil, fmt.Errorf("order: %w", err)
+	}
+	if err := m.solver.start(); err != nil {
+		return nil, err
+	}
+	defer m.solver.stop()
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, url); err != nil {
+			return nil, err
+		}
+	}
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: m.config.Domains,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("finalize: %w", err)
+	}
+	if err := m.storeCert(der, key); err != nil {
+		return nil, err
+	}
+	return m.loadCert()
+}
+
+// authorize solves a challenge of the authorization and waits for the CA to validate it.
+func (m *Manager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == m.config.Challenge {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("the CA offers no %s challenge for %s", m.config.Challenge, authz.Identifier.Value)
+	}
+	domain := authz.Identifier.Value
+	if err := m.solver.present(ctx, domain, chal); err != nil {
+		return fmt.Errorf("%s challenge for %s: %w", chal.Type, domain, err)
+	}
+	defer m.solver.cleanUp(domain, chal)
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accept: %w", err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("%s challenge for %s: %w", chal.Type, domain, err)
+	}
+	return nil
+}
+
+// certPaths returns where the certificate of the domains is kept, named after the first domain.
+func (m *Manager) certPaths() (string, string) {
+	name := strings.ReplaceAll(strings.ToLower(m.config.Domains[0]), "*", "_")
+	return filepath.Join(m.config.Dir, name+".crt"), filepath.Join(m.config.Dir, name+".key")
+}
+
+func (m *Manager) loadCert() (*tls.Certificate, error) {
+	certPath, keyPath := m.certPaths()
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (m *Manager) storeCert(der [][]byte, key crypto.Signer) error {
+	var certPEM []byte
+	for _, b := range der {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	certPath, keyPath := m.certPaths()
+	if err := writeFileAtomic(keyPath, keyPEM); err != nil {
+		return err
+	}
+	return writeFileAtomic(certPath, certPEM)
+}
+
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	b, err = encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeFileAtomic(path, b)
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// writeFileAtomic writes through a temporary file, so a crash never leaves half a file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
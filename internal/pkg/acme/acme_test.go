@@ -0,0 +1,550 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// testCA is a small stand-in for an ACME CA like Pebble. It doesn't check signatures, but validates
+// challenges for real, against httpAddr, tlsAddr and dnsRecords instead of the domains.
+type testCA struct {
+	t        *testing.T
+	server   *httptest.Server
+	key      *ecdsa.PrivateKey
+	cert     *x509.Certificate
+	validity time.Duration
+	httpAddr string
+	tlsAddr  string
+
+	mutex      sync.Mutex
+	thumbprint string
+	nextID     int
+	orders     map[string]*testOrder
+	authzs     map[string]*testAuthz
+	chals      map[string]*testChal
+	certs      map[string][]byte
+	orderCount int
+	dnsRecords map[string][]string
+}
+
+type testOrder struct {
+	Status         string              `json:"status"`
+	Identifiers    []map[string]string `json:"identifiers"`
+	Authorizations []string            `json:"authorizations"`
+	Finalize       string              `json:"finalize"`
+	Certificate    string              `json:"certificate,omitempty"`
+}
+
+type testAuthz struct {
+	Status     string            `json:"status"`
+	Identifier map[string]string `json:"identifier"`
+	Wildcard   bool              `json:"wildcard,omitempty"`
+	Challenges []*testChal       `json:"challenges"`
+}
+
+type testChal struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+
+	authz *testAuthz
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{
+		t:          t,
+		key:        key,
+		cert:       cert,
+		validity:   90 * 24 * time.Hour,
+		orders:     make(map[string]*testOrder),
+		authzs:     make(map[string]*testAuthz),
+		chals:      make(map[string]*testChal),
+		certs:      make(map[string][]byte),
+		dnsRecords: make(map[string][]string),
+	}
+	ca.server = httptest.NewServer(http.HandlerFunc(ca.handle))
+	t.Cleanup(ca.server.Close)
+	return ca
+}
+
+func (ca *testCA) directory() string {
+	return ca.server.URL + "/dir"
+}
+
+func (ca *testCA) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	if r.URL.Path == "/dir" {
+		ca.writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   ca.server.URL + "/nonce",
+			"newAccount": ca.server.URL + "/account",
+			"newOrder":   ca.server.URL + "/order",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	payload, jwk := ca.readJWS(r)
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	url := ca.server.URL + r.URL.Path
+	switch {
+	case r.URL.Path == "/account":
+		status := http.StatusOK
+		thumbprint := ca.thumbprintOf(jwk)
+		if thumbprint != ca.thumbprint {
+			ca.thumbprint = thumbprint
+			status = http.StatusCreated
+		}
+		w.Header().Set("Location", ca.server.URL+"/account/1")
+		ca.writeJSON(w, status, map[string]string{"status": "valid"})
+	case r.URL.Path == "/order":
+		var req struct {
+			Identifiers []map[string]string `json:"identifiers"`
+		}
+		_ = json.Unmarshal(payload, &req)
+		order := &testOrder{Status: acme.StatusPending, Identifiers: req.Identifiers}
+		for _, id := range req.Identifiers {
+			order.Authorizations = append(order.Authorizations, ca.newAuthz(id["value"]))
+		}
+		ca.orderCount++
+		orderURL := ca.newURL("order")
+		order.Finalize = ca.newURL("finalize")
+		ca.orders[orderURL] = order
+		ca.orders[order.Finalize] = order
+		w.Header().Set("Location", orderURL)
+		ca.writeJSON(w, http.StatusCreated, order)
+	case strings.HasPrefix(r.URL.Path, "/order/"):
+		order := ca.orders[url]
+		ca.updateOrder(order)
+		w.Header().Set("Location", url)
+		ca.writeJSON(w, http.StatusOK, order)
+	case strings.HasPrefix(r.URL.Path, "/authz/"):
+		ca.writeJSON(w, http.StatusOK, ca.authzs[url])
+	case strings.HasPrefix(r.URL.Path, "/chal/"):
+		chal := ca.chals[url]
+		chal.Status = acme.StatusInvalid
+		if err := ca.validate(chal); err != nil {
+			ca.t.Logf("%s validation failed: %s", chal.Type, err)
+		} else {
+			chal.Status = acme.StatusValid
+		}
+		chal.authz.Status = chal.Status
+		ca.writeJSON(w, http.StatusOK, chal)
+	case strings.HasPrefix(r.URL.Path, "/finalize/"):
+		order := ca.orders[url]
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		_ = json.Unmarshal(payload, &req)
+		csrDER, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(csrDER)
+		if err != nil {
+			ca.t.Errorf("bad CSR: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		order.Certificate = ca.newURL("cert")
+		ca.certs[order.Certificate] = ca.issue(csr)
+		order.Status = acme.StatusValid
+		w.Header().Set("Location", url)
+		ca.writeJSON(w, http.StatusOK, order)
+	case strings.HasPrefix(r.URL.Path, "/cert/"):
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(ca.certs[url])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (ca *testCA) readJWS(r *http.Request) ([]byte, json.RawMessage) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&jws)
+	var protected struct {
+		JWK json.RawMessage `json:"jwk"`
+	}
+	b, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	_ = json.Unmarshal(b, &protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, protected.JWK
+}
+
+func (ca *testCA) thumbprintOf(jwk json.RawMessage) string {
+	var k struct {
+		X, Y string
+	}
+	_ = json.Unmarshal(jwk, &k)
+	x, _ := base64.RawURLEncoding.DecodeString(k.X)
+	y, _ := base64.RawURLEncoding.DecodeString(k.Y)
+	thumbprint, err := acme.JWKThumbprint(&ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	})
+	if err != nil {
+		ca.t.Errorf("bad JWK: %s", err)
+	}
+	return thumbprint
+}
+
+func (ca *testCA) newURL(kind string) string {
+	ca.nextID++
+	return fmt.Sprintf("%s/%s/%d", ca.server.URL, kind, ca.nextID)
+}
+
+func (ca *testCA) newAuthz(domain string) string {
+	authz := &testAuthz{Status: acme.StatusPending}
+	types := []string{ChallengeHTTP01, ChallengeTLSALPN01, ChallengeDNS01}
+	if strings.HasPrefix(domain, "*.") {
+		domain = strings.TrimPrefix(domain, "*.")
+		authz.Wildcard = true
+		types = []string{ChallengeDNS01}
+	}
+	authz.Identifier = map[string]string{"type": "dns", "value": domain}
+	for _, typ := range types {
+		chal := &testChal{Type: typ, URL: ca.newURL("chal"), Token: fmt.Sprintf("token-%d", ca.nextID),
+			Status: acme.StatusPending, authz: authz}
+		ca.chals[chal.URL] = chal
+		authz.Challenges = append(authz.Challenges, chal)
+	}
+	url := ca.newURL("authz")
+	ca.authzs[url] = authz
+	return url
+}
+
+func (ca *testCA) updateOrder(order *testOrder) {
+	if order.Status != acme.StatusPending {
+		return
+	}
+	for _, url := range order.Authorizations {
+		if ca.authzs[url].Status != acme.StatusValid {
+			return
+		}
+	}
+	order.Status = acme.StatusReady
+}
+
+func (ca *testCA) validate(chal *testChal) error {
+	keyAuth := chal.Token + "." + ca.thumbprint
+	sum := sha256.Sum256([]byte(keyAuth))
+	domain := chal.authz.Identifier["value"]
+	switch chal.Type {
+	case ChallengeHTTP01:
+		req, _ := http.NewRequest(http.MethodGet, "http://"+ca.httpAddr+"/.well-known/acme-challenge/"+chal.Token, nil)
+		req.Host = domain
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != keyAuth {
+			return fmt.Errorf("got %q", body)
+		}
+	case ChallengeTLSALPN01:
+		conn, err := tls.Dial("tcp", ca.tlsAddr, &tls.Config{
+			ServerName:         domain,
+			NextProtos:         []string{acme.ALPNProto},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.NegotiatedProtocol != acme.ALPNProto {
+			return fmt.Errorf("negotiated %q", state.NegotiatedProtocol)
+		}
+		leaf := state.PeerCertificates[0]
+		if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != domain {
+			return fmt.Errorf("certificate for %v", leaf.DNSNames)
+		}
+		for _, ext := range leaf.Extensions {
+			if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) {
+				var value []byte
+				if _, err := asn1.Unmarshal(ext.Value, &value); err != nil || string(value) != string(sum[:]) {
+					return fmt.Errorf("wrong acmeIdentifier")
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("no acmeIdentifier")
+	case ChallengeDNS01:
+		want := base64.RawURLEncoding.EncodeToString(sum[:])
+		for _, value := range ca.dnsRecords["_acme-challenge."+domain] {
+			if value == want {
+				return nil
+			}
+		}
+		return fmt.Errorf("no TXT record %s", want)
+	}
+	return nil
+}
+
+func (ca *testCA) issue(csr *x509.CertificateRequest) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(ca.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+}
+
+func (ca *testCA) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func newTestManager(t *testing.T, config Config) *Manager {
+	m, err := NewManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Close() })
+	return m
+}
+
+func checkCertificate(t *testing.T, m *Manager, domains ...string) *x509.Certificate {
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: domains[0], SupportedProtos: []string{"h3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(leaf.DNSNames, ",") != strings.Join(domains, ",") {
+		t.Errorf("certificate for %v, want %v", leaf.DNSNames, domains)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Errorf("chain of %d certificates, want the issuer too", len(cert.Certificate))
+	}
+	return leaf
+}
+
+func TestManagerHTTP01(t *testing.T) {
+	ca := newTestCA(t)
+	ca.httpAddr = freeAddr(t)
+	config := Config{
+		Domains:    []string{"example.test", "www.example.test"},
+		CA:         ca.directory(),
+		Dir:        t.TempDir(),
+		HTTPListen: ca.httpAddr,
+	}
+	m := newTestManager(t, config)
+	leaf := checkCertificate(t, m, config.Domains...)
+	for _, name := range []string{accountKeyFile, "example.test.crt", "example.test.key"} {
+		if _, err := os.Stat(filepath.Join(config.Dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The stored certificate and account are used again
+	m = newTestManager(t, config)
+	if again := checkCertificate(t, m, config.Domains...); again.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Error("certificate issued again")
+	}
+	if ca.orderCount != 1 {
+		t.Errorf("%d orders, want 1", ca.orderCount)
+	}
+	if _, err := http.Get("http://" + ca.httpAddr); err == nil {
+		t.Error("http-01 listener still running")
+	}
+
+	// Missing domains get a new certificate
+	config.Domains = append(config.Domains, "api.example.test")
+	m = newTestManager(t, config)
+	checkCertificate(t, m, config.Domains...)
+	if ca.orderCount != 2 {
+		t.Errorf("%d orders, want 2", ca.orderCount)
+	}
+}
+
+func TestManagerTLSALPN01(t *testing.T) {
+	ca := newTestCA(t)
+	ca.tlsAddr = freeAddr(t)
+	m := newTestManager(t, Config{
+		Domains:   []string{"example.test"},
+		CA:        ca.directory(),
+		Dir:       t.TempDir(),
+		Challenge: ChallengeTLSALPN01,
+		TLSListen: ca.tlsAddr,
+	})
+	checkCertificate(t, m, "example.test")
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      "example.test",
+		SupportedProtos: []string{acme.ALPNProto},
+	}); err == nil {
+		t.Error("challenge certificate still served")
+	}
+}
+
+type testDNSProvider struct {
+	ca *testCA
+}
+
+func (p *testDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	p.ca.mutex.Lock()
+	defer p.ca.mutex.Unlock()
+	p.ca.dnsRecords[fqdn] = append(p.ca.dnsRecords[fqdn], value)
+	return nil
+}
+
+func (p *testDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	p.ca.mutex.Lock()
+	defer p.ca.mutex.Unlock()
+	var records []string
+	for _, record := range p.ca.dnsRecords[fqdn] {
+		if record != value {
+			records = append(records, record)
+		}
+	}
+	p.ca.dnsRecords[fqdn] = records
+	return nil
+}
+
+func TestManagerDNS01(t *testing.T) {
+	ca := newTestCA(t)
+	RegisterDNSProvider("test", func(config map[string]string) (DNSProvider, error) {
+		return &testDNSProvider{ca: ca}, nil
+	})
+	config := Config{
+		Domains:     []string{"*.example.test", "example.test"},
+		CA:          ca.directory(),
+		Dir:         t.TempDir(),
+		Challenge:   ChallengeDNS01,
+		DNSProvider: "test",
+	}
+	checkTXT = func(ctx context.Context, fqdn, value string) error { return nil }
+	defer func() { checkTXT = lookupTXT }()
+	m := newTestManager(t, config)
+	checkCertificate(t, m, config.Domains...)
+	if _, err := os.Stat(filepath.Join(config.Dir, "_.example.test.crt")); err != nil {
+		t.Error(err)
+	}
+	if records := ca.dnsRecords["_acme-challenge.example.test"]; len(records) != 0 {
+		t.Errorf("records left behind: %v", records)
+	}
+}
+
+func TestManagerRenew(t *testing.T) {
+	ca := newTestCA(t)
+	ca.validity = 10 * 24 * time.Hour
+	ca.httpAddr = freeAddr(t)
+	m := newTestManager(t, Config{
+		Domains:    []string{"example.test"},
+		CA:         ca.directory(),
+		Dir:        t.TempDir(),
+		HTTPListen: ca.httpAddr,
+	})
+	leaf := checkCertificate(t, m, "example.test")
+
+	// Expiring within RenewBefore
+	if err := m.renewIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if renewed := checkCertificate(t, m, "example.test"); renewed.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+		t.Error("certificate not renewed")
+	}
+	if ca.orderCount != 2 {
+		t.Errorf("%d orders, want 2", ca.orderCount)
+	}
+
+	// Failed renewals keep the certificate
+	ca.httpAddr = freeAddr(t)
+	if err := m.renewIfNeeded(); err == nil {
+		t.Error("renewal with failing challenge succeeded")
+	}
+	checkCertificate(t, m, "example.test")
+}
+
+func TestConfigCheck(t *testing.T) {
+	for _, c := range []struct {
+		config Config
+		ok     bool
+	}{
+		{Config{}, true},
+		{Config{Domains: []string{"example.com"}}, true},
+		{Config{Domains: []string{"example.com"}, Challenge: ChallengeTLSALPN01}, true},
+		{Config{Domains: []string{"example.com"}, Challenge: "tls-sni-01"}, false},
+		{Config{Domains: []string{"https://example.com"}}, false},
+		{Config{Domains: []string{"*.example.com"}}, false},
+		{Config{Domains: []string{"*.example.com"}, Challenge: ChallengeDNS01}, false},
+		{Config{Domains: []string{"*.example.com"}, Challenge: ChallengeDNS01, DNSProvider: "exec"}, false},
+		{Config{Domains: []string{"*.example.com"}, Challenge: ChallengeDNS01, DNSProvider: "exec",
+			DNSConfig: map[string]string{"command": "/usr/local/bin/dns-hook"}}, true},
+		{Config{Domains: []string{"*.example.com"}, Challenge: ChallengeDNS01, DNSProvider: "cloudflare",
+			DNSConfig: map[string]string{"api_token": "token"}}, true},
+		{Config{Domains: []string{"*.example.com"}, Challenge: ChallengeDNS01, DNSProvider: "route66"}, false},
+	} {
+		if err := c.config.Check(); (err == nil) != c.ok {
+			t.Errorf("%+v: %v", c.config, err)
+		}
+	}
+}
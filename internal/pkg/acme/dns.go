@@ -0,0 +1,204 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSProvider creates and removes the TXT records of dns-01 challenges. fqdn has no trailing dot,
+// and a name may have several records at once, one per challenge.
+type DNSProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// DNSProviderFactory creates a DNS provider from its dns_config.
+type DNSProviderFactory func(config map[string]string) (DNSProvider, error)
+
+var (
+	dnsProvidersMutex sync.RWMutex
+	dnsProviders      = map[string]DNSProviderFactory{
+		"exec":       newExecProvider,
+		"cloudflare": newCloudflareProvider,
+	}
+)
+
+// RegisterDNSProvider makes a DNS provider available under a name.
+func RegisterDNSProvider(name string, factory DNSProviderFactory) {
+	dnsProvidersMutex.Lock()
+	defer dnsProvidersMutex.Unlock()
+	dnsProviders[name] = factory
+}
+
+// NewDNSProvider creates the named provider: exec runs the command of the config as
+// "<command> present|cleanup <fqdn> <value>", cloudflare takes an api_token allowed to edit the zone
+// and optionally its zone_id.
+func NewDNSProvider(name string, config map[string]string) (DNSProvider, error) {
+	if len(name) == 0 {
+		return nil, errors.New("dns-01 needs a DNS provider")
+	}
+	dnsProvidersMutex.RLock()
+	factory, ok := dnsProviders[name]
+	dnsProvidersMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown DNS provider %s", name)
+	}
+	return factory(config)
+}
+
+type execProvider struct {
+	command string
+}
+
+func newExecProvider(config map[string]string) (DNSProvider, error) {
+	command := config["command"]
+	if len(command) == 0 {
+		return nil, errors.New("the exec DNS provider needs a command")
+	}
+	return &execProvider{command: command}, nil
+}
+
+func (p *execProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+func (p *execProvider) run(ctx context.Context, action, fqdn, value string) error {
+	out, err := exec.CommandContext(ctx, p.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", p.command, action, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+type cloudflareProvider struct {
+	api    string
+	token  string
+	zoneID string
+	client *http.Client
+}
+
+func newCloudflareProvider(config map[string]string) (DNSProvider, error) {
+	token := config["api_token"]
+	if len(token) == 0 {
+		return nil, errors.New("the cloudflare DNS provider needs an api_token")
+	}
+	return &cloudflareProvider{
+		api:    cloudflareAPI,
+		token:  token,
+		zoneID: config["zone_id"],
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+func (p *cloudflareProvider) Present(ctx context.Context, fqdn, value string) error {
+	zoneID, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	return p.do(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records",
+		&cloudflareRecord{Type: "TXT", Name: fqdn, Content: value, TTL: 120}, nil)
+}
+
+func (p *cloudflareProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	zoneID, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	var records []cloudflareRecord
+	query := url.Values{"type": {"TXT"}, "name": {fqdn}}
+	if err := p.do(ctx, http.MethodGet, "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record.Content == value {
+			if err := p.do(ctx, http.MethodDelete, "/zones/"+zoneID+"/dns_records/"+record.ID, nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// zone returns the configured zone, or the one whose name is the longest suffix of fqdn.
+func (p *cloudflareProvider) zone(ctx context.Context, fqdn string) (string, error) {
+	if len(p.zoneID) > 0 {
+		return p.zoneID, nil
+	}
+	labels := strings.Split(fqdn, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		name := strings.Join(labels[i:], ".")
+		if err := p.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("no cloudflare zone for %s", fqdn)
+}
+
+func (p *cloudflareProvider) do(ctx context.Context, method, path string, body, result any) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.api+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var respBody struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return fmt.Errorf("cloudflare: %s: %w", resp.Status, err)
+	}
+	if !respBody.Success {
+		if len(respBody.Errors) > 0 {
+			return fmt.Errorf("cloudflare: %s", respBody.Errors[0].Message)
+		}
+		return fmt.Errorf("cloudflare: %s", resp.Status)
+	}
+	if result != nil {
+		return json.Unmarshal(respBody.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	dnsPropagationTimeout  = 2 * time.Minute
+	dnsPropagationInterval = 5 * time.Second
+)
+
+// solver answers the challenges of one type. The listeners it needs only run between start and stop,
+// while a certificate is issued.
+type solver interface {
+	start() error
+	present(ctx context.Context, domain string, chal *acme.Challenge) error
+	cleanUp(domain string, chal *acme.Challenge)
+	stop()
+}
+
+func (m *Manager) newSolver() (solver, error) {
+	switch m.config.Challenge {
+	case ChallengeHTTP01:
+		return &httpSolver{client: m.client, addr: m.config.HTTPListen}, nil
+	case ChallengeTLSALPN01:
+		return &tlsALPNSolver{manager: m, addr: m.config.TLSListen}, nil
+	case ChallengeDNS01:
+		provider, err := NewDNSProvider(m.config.DNSProvider, m.config.DNSConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &dnsSolver{manager: m, provider: provider}, nil
+	}
+	return nil, errors.New("unknown challenge " + m.config.Challenge)
+}
+
+// httpSolver serves the key authorizations of http-01 challenges under /.well-known/acme-challenge/.
+type httpSolver struct {
+	client *acme.Client
+	addr   string
+	tokens sync.Map // path -> key authorization
+	server *http.Server
+}
+
+func (s *httpSolver) start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if keyAuth, ok := s.tokens.Load(r.URL.Path); ok {
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = w.Write([]byte(keyAuth.(string)))
+				return
+			}
+			http.NotFound(w, r)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() { _ = s.server.Serve(listener) }()
+	return nil
+}
+
+func (s *httpSolver) present(ctx context.Context, domain string, chal *acme.Challenge) error {
+	keyAuth, err := s.client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	s.tokens.Store(s.client.HTTP01ChallengePath(chal.Token), keyAuth)
+	return nil
+}
+
+func (s *httpSolver) cleanUp(domain string, chal *acme.Challenge) {
+	s.tokens.Delete(s.client.HTTP01ChallengePath(chal.Token))
+}
+
+func (s *httpSolver) stop() {
+	_ = s.server.Close()
+}
+
+// tlsALPNSolver answers acme-tls/1 handshakes of tls-alpn-01 challenges on TCP, with the certificates
+// of Manager.GetCertificate.
+type tlsALPNSolver struct {
+	manager  *Manager
+	addr     string
+	listener net.Listener
+}
+
+func (s *tlsALPNSolver) start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = tls.NewListener(listener, &tls.Config{
+		GetCertificate: s.manager.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	})
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+				_ = conn.(*tls.Conn).Handshake()
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return nil
+}
+
+func (s *tlsALPNSolver) present(ctx context.Context, domain string, chal *acme.Challenge) error {
+	cert, err := s.manager.client.TLSALPN01ChallengeCert(chal.Token, domain)
+	if err != nil {
+		return err
+	}
+	s.manager.alpnCerts.Store(strings.ToLower(domain), &cert)
+	return nil
+}
+
+func (s *tlsALPNSolver) cleanUp(domain string, chal *acme.Challenge) {
+	s.manager.alpnCerts.Delete(strings.ToLower(domain))
+}
+
+func (s *tlsALPNSolver) stop() {
+	_ = s.listener.Close()
+}
+
+// dnsSolver has the DNS provider create the TXT records of dns-01 challenges.
+type dnsSolver struct {
+	manager  *Manager
+	provider DNSProvider
+}
+
+func (s *dnsSolver) start() error {
+	return nil
+}
+
+func (s *dnsSolver) present(ctx context.Context, domain string, chal *acme.Challenge) error {
+	value, err := s.manager.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := challengeFQDN(domain)
+	if err := s.provider.Present(ctx, fqdn, value); err != nil {
+		return err
+	}
+	return checkTXT(ctx, fqdn, value)
+}
+
+func (s *dnsSolver) cleanUp(domain string, chal *acme.Challenge) {
+	value, _ := s.manager.client.DNS01ChallengeRecord(chal.Token)
+	fqdn := challengeFQDN(domain)
+	if err := s.provider.CleanUp(context.Background(), fqdn, value); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"record": fqdn,
+		}).Warn("Failed to remove the dns-01 challenge record")
+	}
+}
+
+func (s *dnsSolver) stop() {}
+
+// challengeFQDN is the name of the TXT record of a domain, wildcards are validated on the domain below.
+func challengeFQDN(domain string) string {
+	return "_acme-challenge." + strings.TrimPrefix(domain, "*.")
+}
+
+// checkTXT waits for a dns-01 record to be visible, replaced by the tests.
+var checkTXT = lookupTXT
+
+// lookupTXT waits until the record is visible to the system resolver. The CA may see it earlier, so
+// after dnsPropagationTimeout the challenge is tried anyway.
+func lookupTXT(ctx context.Context, fqdn, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsPropagationTimeout)
+	defer cancel()
+	for {
+		records, _ := net.DefaultResolver.LookupTXT(ctx, fqdn)
+		for _, record := range records {
+			if record == value {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			logrus.WithField("record", fqdn).Warn("The dns-01 challenge record is not visible yet, trying anyway")
+			return nil
+		case <-time.After(dnsPropagationInterval):
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Package auth provides the ways clients can be authenticated: the panel's users, a static users file,
+// an HTTP callback, and a chain of those.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/core"
+)
+
+const (
+	mbpsToBps = 125000
+
+	// SpecPanel is the spec of the panel authenticator.
+	SpecPanel = "panel"
+	// SpecFilePrefix starts the spec of a users file, file:/etc/hysteria/users.json.
+	SpecFilePrefix = "file:"
+)
+
+// PanelUsers are the users of the users service, service.UsersService.
+type PanelUsers interface {
+	Auth(uuid string) (int, bool)
+	SpeedLimit(userId int) uint64
+	DeviceLimit(userId int) int
+}
+
+// Panel authenticates clients whose auth is the UUID of one of the panel's users,
+// or of the config file's users in standalone mode.
+type Panel struct {
+	Users PanelUsers
+}
+
+func (p *Panel) Authenticate(addr net.Addr, auth []byte, sendBPS, recvBPS uint64) (core.AuthResult, bool) {
+	userId, ok := p.Users.Auth(string(auth))
+	if !ok {
+		return core.AuthResult{}, false
+	}
+	return core.AuthResult{
+		UserId:      userId,
+		SpeedLimit:  p.Users.SpeedLimit(userId),
+		DeviceLimit: p.Users.DeviceLimit(userId),
+		Panel:       true,
+	}, true
+}
+
+// Chain tries the authenticators in order, the first one that accepts the client wins.
+// It's the way to fall back from one backend to another.
+type Chain []core.Authenticator
+
+func (c Chain) Authenticate(addr net.Addr, auth []byte, sendBPS, recvBPS uint64) (core.AuthResult, bool) {
+	for _, a := range c {
+		if result, ok := a.Authenticate(addr, auth, sendBPS, recvBPS); ok {
+			return result, true
+		}
+	}
+	return core.AuthResult{}, false
+}
+
+// SetKickFunc passes the function on to the authenticators of the chain that revoke users.
+// Their user ids aren't told apart, a user revoked by one is kicked off the others too.
+func (c Chain) SetKickFunc(kick func(userId int) int) {
+	for _, a := range c {
+		if r, ok := a.(core.Revoker); ok {
+			r.SetKickFunc(kick)
+		}
+	}
+}
+
+// New creates the authenticator of a spec: "panel", "file:<path>" or an http(s):// callback URL.
+// Several specs make a Chain. Users files are watched for changes.
+func New(specs []string, panel PanelUsers) (core.Authenticator, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("no authenticator")
+	}
+	var chain Chain
+	for _, spec := range specs {
+		a, err := newAuthenticator(spec, panel)
+		if err != nil {
+			return nil, err
+		}
+		if f, ok := a.(*File); ok {
+			if err := f.Watch(); err != nil {
+				logrus.WithField("error", err).Warn("Failed to watch users file, changes need a restart")
+			}
+		}
+		chain = append(chain, a)
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+// Check checks the specs without setting anything up, users files are loaded to see if they are fine.
+func Check(specs []string) error {
+	for _, spec := range specs {
+		if spec == SpecPanel {
+			continue
+		}
+		if _, err := newAuthenticator(spec, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newAuthenticator(spec string, panel PanelUsers) (core.Authenticator, error) {
+	switch {
+	case spec == SpecPanel:
+		if panel == nil {
+			return nil, errors.New("panel authenticator without a panel")
+		}
+		return &Panel{Users: panel}, nil
+	case strings.HasPrefix(spec, SpecFilePrefix):
+		f := &File{}
+		if err := f.LoadFile(strings.TrimPrefix(spec, SpecFilePrefix)); err != nil {
+			return nil, err
+		}
+		return f, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return NewHTTP(spec), nil
+	}
+	return nil, fmt.Errorf("unknown authenticator %s", spec)
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/xflash-panda/server-hysteria/internal/pkg/core"
+)
+
+var testAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+var (
+	_ core.Revoker = (*File)(nil)
+	_ core.Revoker = Chain(nil)
+)
+
+func writeUsersFile(t *testing.T, users string) string {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(path, []byte(users), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFile(t *testing.T) {
+	path := writeUsersFile(t, `[{"id": 1, "uuid": "alice", "speed_limit": 8, "device_limit": 2}, {"id": 2, "uuid": "bob"}]`)
+	f := &File{}
+	if err := f.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	result, ok := f.Authenticate(testAddr, []byte("alice"), 0, 0)
+	if want := (core.AuthResult{UserId: 1, SpeedLimit: 1000000, DeviceLimit: 2}); !ok || result != want {
+		t.Errorf("alice = %+v, %v, want %+v", result, ok, want)
+	}
+	if result, ok := f.Authenticate(testAddr, []byte("bob"), 0, 0); !ok || result.UserId != 2 {
+		t.Errorf("bob = %+v, %v", result, ok)
+	}
+	if _, ok := f.Authenticate(testAddr, []byte("eve"), 0, 0); ok {
+		t.Error("eve accepted")
+	}
+
+	// A broken file leaves the users as they are
+	if err := os.WriteFile(path, []byte(`[{"id": 3}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.LoadFile(path); err == nil {
+		t.Error("user without uuid loaded")
+	}
+	if f.Len() != 2 {
+		t.Errorf("%d users after a failed load", f.Len())
+	}
+}
+
+func TestFileRevoke(t *testing.T) {
+	path := writeUsersFile(t, `[{"id": 1, "uuid": "alice"}, {"id": 2, "uuid": "bob"}, {"id": 3, "uuid": "carol"}]`)
+	f := &File{}
+	if err := f.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	var kicked []int
+	Chain{&Panel{}, f}.SetKickFunc(func(userId int) int {
+		kicked = append(kicked, userId)
+		return 1
+	})
+
+	// bob is gone and carol has a new uuid, alice stays
+	if err := os.WriteFile(path, []byte(`[{"id": 1, "uuid": "alice"}, {"id": 3, "uuid": "dave"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(kicked)
+	if len(kicked) != 2 || kicked[0] != 2 || kicked[1] != 3 {
+		t.Errorf("kicked %v, want [2 3]", kicked)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var got httpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch got.Auth {
+		case "alice":
+			_, _ = w.Write([]byte(`{"ok": true, "user_id": 7, "speed_limit": 16, "device_limit": 1}`))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			_, _ = w.Write([]byte(`{"ok": false}`))
+		}
+	}))
+	defer srv.Close()
+
+	h := NewHTTP(srv.URL)
+	result, ok := h.Authenticate(testAddr, []byte("alice"), 100, 200)
+	if want := (core.AuthResult{UserId: 7, SpeedLimit: 2000000, DeviceLimit: 1}); !ok || result != want {
+		t.Errorf("alice = %+v, %v, want %+v", result, ok, want)
+	}
+	if want := (httpRequest{Addr: testAddr.String(), Auth: "alice", SendBPS: 100, RecvBPS: 200}); got != want {
+		t.Errorf("request = %+v, want %+v", got, want)
+	}
+	for _, auth := range []string{"eve", "broken"} {
+		if _, ok := h.Authenticate(testAddr, []byte(auth), 0, 0); ok {
+			t.Errorf("%s accepted", auth)
+		}
+	}
+}
+
+type testPanelUsers map[string]int
+
+func (p testPanelUsers) Auth(uuid string) (int, bool) {
+	id, ok := p[uuid]
+	return id, ok
+}
+
+func (p testPanelUsers) SpeedLimit(userId int) uint64 { return 0 }
+
+func (p testPanelUsers) DeviceLimit(userId int) int { return 3 }
+
+func TestNew(t *testing.T) {
+	path := writeUsersFile(t, `[{"id": 1, "uuid": "alice"}]`)
+	a, err := New([]string{SpecFilePrefix + path, SpecPanel}, testPanelUsers{"bob": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.(Chain); !ok {
+		t.Fatalf("got %T, want a Chain", a)
+	}
+	if result, ok := a.Authenticate(testAddr, []byte("alice"), 0, 0); !ok || result.UserId != 1 || result.Panel {
+		t.Errorf("alice = %+v, %v", result, ok)
+	}
+	if result, ok := a.Authenticate(testAddr, []byte("bob"), 0, 0); !ok || result.UserId != 2 || result.DeviceLimit != 3 || !result.Panel {
+		t.Errorf("bob = %+v, %v", result, ok)
+	}
+	if _, ok := a.Authenticate(testAddr, []byte("eve"), 0, 0); ok {
+		t.Error("eve accepted")
+	}
+
+	for _, specs := range [][]string{nil, {"ldap://x"}, {SpecFilePrefix + "/nonexistent"}} {
+		if _, err := New(specs, nil); err == nil {
+			t.Errorf("New(%q) succeeded", specs)
+		}
+	}
+	if _, err := New([]string{SpecPanel}, nil); err == nil {
+		t.Error("panel without a panel succeeded")
+	}
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/core"
+)
+
+// FileUser is a user of a users file, the same record the panel sends. SpeedLimit is in Mbps,
+// zero means unlimited for both limits.
+type FileUser struct {
+	ID          int    `json:"id"`
+	UUID        string `json:"uuid"`
+	SpeedLimit  int    `json:"speed_limit"`
+	DeviceLimit int    `json:"device_limit"`
+}
+
+// File authenticates clients against a JSON list of users, whose auth is the UUID of one of them.
+// Users that a reload removes, or whose UUID it changes, are kicked off with the function of SetKickFunc.
+type File struct {
+	path  string
+	users atomic.Pointer[map[string]core.AuthResult]
+	kick  atomic.Pointer[func(userId int) int]
+}
+
+// SetKickFunc sets the function that closes all live connections of a user, it is provided by the server.
+func (f *File) SetKickFunc(kick func(userId int) int) {
+	f.kick.Store(&kick)
+}
+
+// LoadFile replaces the users with those of the file, they stay as they are on error.
+func (f *File) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var list []FileUser
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parse users file %s: %s", path, err)
+	}
+	users := make(map[string]core.AuthResult, len(list))
+	for _, u := range list {
+		if len(u.UUID) == 0 {
+			return fmt.Errorf("user %d of %s has no uuid", u.ID, path)
+		}
+		users[u.UUID] = core.AuthResult{
+			UserId:      u.ID,
+			SpeedLimit:  uint64(u.SpeedLimit) * mbpsToBps,
+			DeviceLimit: u.DeviceLimit,
+		}
+	}
+	f.path = path
+	if old := f.users.Swap(&users); old != nil {
+		f.kickRevoked(*old, users)
+	}
+	return nil
+}
+
+// kickRevoked kicks the users of old that users doesn't have with the same UUID.
+func (f *File) kickRevoked(old, users map[string]core.AuthResult) {
+	kick := f.kick.Load()
+	if kick == nil {
+		return
+	}
+	kicked := make(map[int]bool)
+	for uuid, result := range old {
+		if u, ok := users[uuid]; (ok && u.UserId == result.UserId) || kicked[result.UserId] {
+			continue
+		}
+		kicked[result.UserId] = true
+		if n := (*kick)(result.UserId); n > 0 {
+			logrus.WithFields(logrus.Fields{
+				"user":        result.UserId,
+				"connections": n,
+			}).Info("Kicked a user removed from the users file")
+		}
+	}
+}
+
+// Len returns the number of users.
+func (f *File) Len() int {
+	if users := f.users.Load(); users != nil {
+		return len(*users)
+	}
+	return 0
+}
+
+func (f *File) Authenticate(addr net.Addr, auth []byte, sendBPS, recvBPS uint64) (core.AuthResult, bool) {
+	users := f.users.Load()
+	if users == nil {
+		return core.AuthResult{}, false
+	}
+	result, ok := (*users)[string(auth)]
+	return result, ok
+}
+
+// Watch reloads the file whenever it changes.
+func (f *File) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				switch event.Op {
+				case fsnotify.Create, fsnotify.Write, fsnotify.Rename, fsnotify.Chmod:
+					logrus.WithField("file", event.Name).Info("Users file change detected, reloading...")
+					if err := f.LoadFile(f.path); err != nil {
+						logrus.WithField("error", err).Error("Failed to reload users file")
+					} else {
+						logrus.WithField("users", f.Len()).Info("Users file successfully reloaded")
+					}
+				case fsnotify.Remove:
+					_ = watcher.Add(event.Name) // Workaround for vim
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.WithField("error", err).Error("Failed to watch users file for changes")
+			}
+		}
+	}()
+	if err := watcher.Add(f.path); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	return nil
+}
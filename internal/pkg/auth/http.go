@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/core"
+)
+
+const httpTimeout = 5 * time.Second
+
+// httpRequest is what the callback is POSTed for every client.
+type httpRequest struct {
+	Addr    string `json:"addr"`
+	Auth    string `json:"auth"`
+	SendBPS uint64 `json:"send_bps"`
+	RecvBPS uint64 `json:"recv_bps"`
+}
+
+// httpVerdict is what the callback answers, with a 200. SpeedLimit is in Mbps,
+// zero means unlimited for both limits.
+type httpVerdict struct {
+	OK          bool `json:"ok"`
+	UserId      int  `json:"user_id"`
+	SpeedLimit  int  `json:"speed_limit"`
+	DeviceLimit int  `json:"device_limit"`
+}
+
+// HTTP asks an HTTP callback about every client. Clients are rejected if the callback fails.
+// The callback is only asked when a client connects, so taking a user's access away there only
+// keeps them from connecting again, the connections they already have stay up until they close.
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTP(url string) *HTTP {
+	return &HTTP{URL: url, Client: &http.Client{Timeout: httpTimeout}}
+}
+
+func (h *HTTP) Authenticate(addr net.Addr, auth []byte, sendBPS, recvBPS uint64) (core.AuthResult, bool) {
+	verdict, err := h.ask(&httpRequest{Addr: addr.String(), Auth: string(auth), SendBPS: sendBPS, RecvBPS: recvBPS})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"url":   h.URL,
+		}).Error("Auth callback failed")
+		return core.AuthResult{}, false
+	}
+	if !verdict.OK {
+		return core.AuthResult{}, false
+	}
+	return core.AuthResult{
+		UserId:      verdict.UserId,
+		SpeedLimit:  uint64(verdict.SpeedLimit) * mbpsToBps,
+		DeviceLimit: verdict.DeviceLimit,
+	}, true
+}
+
+func (h *HTTP) ask(req *httpRequest) (*httpVerdict, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.Client.Post(h.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var verdict httpVerdict
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return nil, fmt.Errorf("parse verdict: %s", err)
+	}
+	return &verdict, nil
+}
@@ -1,6 +1,8 @@
 package congestion
 
 import (
+	"math"
+	"sync/atomic"
 	"time"
 
 	"github.com/quic-go/quic-go/congestion"
@@ -22,6 +24,10 @@ type BrutalSender struct {
 
 	pktInfoSlots [pktInfoSlotCount]pktInfo
 	ackRate      float64
+
+	// Copies of the state for other goroutines to read, the rest is only touched by the connection
+	lastAckRate uint64 // math.Float64bits
+	lastCwnd    int64
 }
 
 type pktInfo struct {
@@ -35,6 +41,7 @@ func NewBrutalSender(bps uint64) *BrutalSender {
 		bps:             congestion.ByteCount(bps),
 		maxDatagramSize: initMaxDatagramSize,
 		ackRate:         1,
+		lastAckRate:     math.Float64bits(1),
 	}
 	bs.pacer = newPacer(func() congestion.ByteCount {
 		return congestion.ByteCount(float64(bs.bps) / bs.ackRate)
@@ -60,10 +67,22 @@ func (b *BrutalSender) CanSend(bytesInFlight congestion.ByteCount) bool {
 
 func (b *BrutalSender) GetCongestionWindow() congestion.ByteCount {
 	rtt := b.rttStats.SmoothedRTT()
-	if rtt <= 0 {
-		return 10240
+	cwnd := congestion.ByteCount(10240)
+	if rtt > 0 {
+		cwnd = congestion.ByteCount(float64(b.bps) * rtt.Seconds() * 1.5 / b.ackRate)
 	}
-	return congestion.ByteCount(float64(b.bps) * rtt.Seconds() * 1.5 / b.ackRate)
+	atomic.StoreInt64(&b.lastCwnd, int64(cwnd))
+	return cwnd
+}
+
+// AckRate returns the last computed ack rate, it is safe to call from any goroutine.
+func (b *BrutalSender) AckRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&b.lastAckRate))
+}
+
+// CongestionWindow returns the last computed congestion window, it is safe to call from any goroutine.
+func (b *BrutalSender) CongestionWindow() congestion.ByteCount {
+	return congestion.ByteCount(atomic.LoadInt64(&b.lastCwnd))
 }
 
 func (b *BrutalSender) OnPacketSent(sentTime time.Time, bytesInFlight congestion.ByteCount,
@@ -127,6 +146,7 @@ func (b *BrutalSender) updateAckRate(currentTimestamp int64) {
 		b.ackRate = minAckRate
 	}
 	b.ackRate = rate
+	atomic.StoreUint64(&b.lastAckRate, math.Float64bits(b.ackRate))
 }
 
 func (b *BrutalSender) InSlowStart() bool {
@@ -0,0 +1,29 @@
+package core
+
+import "net"
+
+// AuthResult is who an authenticated client is and what it may use.
+type AuthResult struct {
+	UserId int
+	// SpeedLimit is the user's speed limit in bytes per second, zero means unlimited.
+	SpeedLimit uint64
+	// DeviceLimit is how many devices the user may be online with at once, zero means unlimited.
+	DeviceLimit int
+	// Panel is set for the users of the panel. Only their traffic goes to the panel and only they are
+	// revoked by it, other authenticators have user ids of their own, which may be the same numbers.
+	Panel bool
+}
+
+// Revoker is an Authenticator that revokes users while they are connected, like a users file that changes.
+// The server gives it the function that closes every connection of one of its users, which are all but
+// the panel's. Auth only happens once per connection, so without it revoked users stay connected.
+type Revoker interface {
+	SetKickFunc(kick func(userId int) int)
+}
+
+// Authenticator decides which clients may connect.
+type Authenticator interface {
+	// Authenticate checks the credentials the client presented. sendBPS and recvBPS are the rates
+	// the client asked for, already clamped to the server's, zero means it didn't say.
+	Authenticate(addr net.Addr, auth []byte, sendBPS, recvBPS uint64) (AuthResult, bool)
+}
@@ -65,3 +65,66 @@ func (d *defragger) Feed(m udpMessage) *udpMessage {
 	}
 	return nil
 }
+
+func fragUDPMessageV2(m udpMessageV2, maxSize int) []udpMessageV2 {
+	if m.Size() <= maxSize {
+		return []udpMessageV2{m}
+	}
+	fullPayload := m.Data
+	maxPayloadSize := maxSize - m.HeaderSize()
+	off := 0
+	fragID := uint8(0)
+	fragCount := uint8((len(fullPayload) + maxPayloadSize - 1) / maxPayloadSize) // round up
+	var frags []udpMessageV2
+	for off < len(fullPayload) {
+		payloadSize := len(fullPayload) - off
+		if payloadSize > maxPayloadSize {
+			payloadSize = maxPayloadSize
+		}
+		frag := m
+		frag.FragID = fragID
+		frag.FragCount = fragCount
+		frag.Data = fullPayload[off : off+payloadSize]
+		frags = append(frags, frag)
+		off += payloadSize
+		fragID++
+	}
+	return frags
+}
+
+type defraggerV2 struct {
+	packetID uint16
+	frags    []*udpMessageV2
+	count    uint8
+}
+
+func (d *defraggerV2) Feed(m udpMessageV2) *udpMessageV2 {
+	if m.FragCount <= 1 {
+		return &m
+	}
+	if m.FragID >= m.FragCount {
+		return nil
+	}
+	if m.PacketID != d.packetID || m.FragCount != uint8(len(d.frags)) {
+		// new message, clear previous state
+		d.packetID = m.PacketID
+		d.frags = make([]*udpMessageV2, m.FragCount)
+		d.count = 1
+		d.frags[m.FragID] = &m
+	} else if d.frags[m.FragID] == nil {
+		d.frags[m.FragID] = &m
+		d.count++
+		if int(d.count) == len(d.frags) {
+			// all fragments received, assemble
+			var data []byte
+			for _, frag := range d.frags {
+				data = append(data, frag.Data...)
+			}
+			m.Data = data
+			m.FragID = 0
+			m.FragCount = 1
+			return &m
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// SetMasquerade sets the handler serving HTTP/3 to connections that turn out not to be clients, nil closes them
+// with an error instead. It applies to connections made from now on.
+func (s *Server) SetMasquerade(handler http.Handler) {
+	s.configMutex.Lock()
+	s.masquerade = handler
+	s.configMutex.Unlock()
+}
+
+func (s *Server) masqueradeHandler() http.Handler {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.masquerade
+}
+
+// serveMasquerade serves the connection as a plain HTTP/3 server until it's closed.
+// first is a stream already accepted off the connection, if any, HTTP/3 gets to see it first.
+func serveMasquerade(cc quic.Connection, handler http.Handler, first quic.Stream) {
+	conn := cc
+	if first != nil {
+		conn = &replayConn{Connection: cc, first: first}
+	}
+	h3s := http3.Server{Handler: handler}
+	_ = h3s.ServeQUICConn(conn)
+	_ = cc.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+}
+
+// replayConn hands out a stream that was already accepted before the ones still to come.
+type replayConn struct {
+	quic.Connection
+	mutex sync.Mutex
+	first quic.Stream
+}
+
+func (c *replayConn) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	c.mutex.Lock()
+	stream := c.first
+	c.first = nil
+	c.mutex.Unlock()
+	if stream != nil {
+		return stream, nil
+	}
+	return c.Connection.AcceptStream(ctx)
+}
+
+// replayStream gives back what has already been read off the stream before reading on.
+type replayStream struct {
+	quic.Stream
+	head []byte
+}
+
+func (s *replayStream) Read(p []byte) (int, error) {
+	if len(s.head) > 0 {
+		n := copy(p, s.head)
+		s.head = s.head[n:]
+		return n, nil
+	}
+	return s.Stream.Read(p)
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ackRateBuckets = []float64{.5, .6, .7, .8, .85, .9, .95, .98, .99, 1}
+	cwndBuckets    = prometheus.ExponentialBuckets(16384, 4, 8) // 16 KB to 256 MB
+)
+
+// brutalCollector exposes the state of the congestion control of every live connection as histograms.
+type brutalCollector struct {
+	server      *Server
+	ackRateDesc *prometheus.Desc
+	cwndDesc    *prometheus.Desc
+}
+
+func newBrutalCollector(s *Server, node string) *brutalCollector {
+	labels := prometheus.Labels{"node": node}
+	return &brutalCollector{
+		server: s,
+		ackRateDesc: prometheus.NewDesc("hysteria_brutal_ack_rate",
+			"Ack rate seen by the congestion control of live connections.", nil, labels),
+		cwndDesc: prometheus.NewDesc("hysteria_brutal_congestion_window_bytes",
+			"Congestion window of live connections.", nil, labels),
+	}
+}
+
+func (c *brutalCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.ackRateDesc
+	ch <- c.cwndDesc
+}
+
+func (c *brutalCollector) Collect(ch chan<- prometheus.Metric) {
+	var ackRates, cwnds []float64
+	for _, sess := range c.server.sessions.all() {
+		if sess.Sender == nil {
+			continue
+		}
+		ackRates = append(ackRates, sess.Sender.AckRate())
+		cwnds = append(cwnds, float64(sess.Sender.CongestionWindow()))
+	}
+	ch <- constHistogram(c.ackRateDesc, ackRateBuckets, ackRates)
+	ch <- constHistogram(c.cwndDesc, cwndBuckets, cwnds)
+}
+
+func constHistogram(desc *prometheus.Desc, buckets []float64, values []float64) prometheus.Metric {
+	counts := make(map[float64]uint64, len(buckets))
+	var sum float64
+	for _, v := range values {
+		sum += v
+		for _, b := range buckets {
+			if v <= b {
+				counts[b]++
+			}
+		}
+	}
+	return prometheus.MustNewConstHistogram(desc, uint64(len(values)), sum, counts)
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"fmt"
 	"github.com/quic-go/quic-go"
 	"time"
 )
@@ -23,8 +24,17 @@ var (
 	qErrorGeneric  = qError{0, ""}
 	qErrorProtocol = qError{1, "protocol error"}
 	qErrorAuth     = qError{2, "auth error"}
+	qErrorShutdown = qError{3, "server shutting down"}
 )
 
+// versionError is the error of a control stream starting with another protocol version,
+// or something else altogether.
+type versionError uint8
+
+func (e versionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %d, expecting %d", uint8(e), protocolVersion)
+}
+
 type maxRate struct {
 	SendBPS uint64
 	RecvBPS uint64
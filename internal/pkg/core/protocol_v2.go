@@ -0,0 +1,158 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// Hysteria 2 runs on HTTP/3, the client authenticates with a request and then opens
+// TCP requests as streams of their own frame type. UDP goes in datagrams.
+const (
+	v2URLHost = "hysteria"
+	v2URLPath = "/auth"
+
+	v2HeaderAuth       = "Hysteria-Auth"
+	v2HeaderUDPEnabled = "Hysteria-UDP"
+	v2HeaderCCRX       = "Hysteria-CC-RX"
+	v2HeaderPadding    = "Hysteria-Padding"
+
+	v2StatusAuthOK = 233
+
+	v2FrameTypeTCPRequest = 0x401
+
+	v2MaxAddressLength = 2048
+	v2MaxMessageLength = 2048
+	v2MaxPaddingLength = 4096
+
+	v2UDPIdleTimeout = 60 * time.Second
+)
+
+const paddingChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// padding is a random string of random length, so that the sizes of the messages say nothing.
+type padding struct {
+	Min, Max int
+}
+
+func (p padding) String() string {
+	bs := make([]byte, p.Min+rand.Intn(p.Max-p.Min))
+	for i := range bs {
+		bs[i] = paddingChars[rand.Intn(len(paddingChars))]
+	}
+	return string(bs)
+}
+
+var (
+	v2AuthResponsePadding = padding{Min: 256, Max: 2048}
+	v2TCPResponsePadding  = padding{Min: 128, Max: 1024}
+)
+
+// readV2TCPRequest reads the address of a TCP request, the frame type before it is already read by HTTP/3.
+//
+//	Address length (varint) | Address | Padding length (varint) | Padding
+func readV2TCPRequest(r io.Reader) (string, error) {
+	br := quicvarint.NewReader(r)
+	addrLen, err := quicvarint.Read(br)
+	if err != nil {
+		return "", err
+	}
+	if addrLen == 0 || addrLen > v2MaxAddressLength {
+		return "", errors.New("invalid address length")
+	}
+	addr := make([]byte, addrLen)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", err
+	}
+	paddingLen, err := quicvarint.Read(br)
+	if err != nil {
+		return "", err
+	}
+	if paddingLen > v2MaxPaddingLength {
+		return "", errors.New("invalid padding length")
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(paddingLen)); err != nil {
+		return "", err
+	}
+	return string(addr), nil
+}
+
+// writeV2TCPResponse writes the result of a TCP request.
+//
+//	Status (0 ok, 1 error) | Message length (varint) | Message | Padding length (varint) | Padding
+func writeV2TCPResponse(w io.Writer, ok bool, msg string) error {
+	p := v2TCPResponsePadding.String()
+	buf := make([]byte, 1, 1+8+len(msg)+8+len(p))
+	if !ok {
+		buf[0] = 1
+	}
+	buf = quicvarint.Append(buf, uint64(len(msg)))
+	buf = append(buf, msg...)
+	buf = quicvarint.Append(buf, uint64(len(p)))
+	buf = append(buf, p...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// udpMessageV2 is a UDP datagram, or a fragment of one.
+//
+//	Session ID (uint32) | Packet ID (uint16) | Fragment ID (uint8) | Fragment count (uint8) |
+//	Address length (varint) | Address | Data
+type udpMessageV2 struct {
+	SessionID uint32
+	PacketID  uint16 // doesn't matter when not fragmented, but must not be 0 when fragmented
+	FragID    uint8  // doesn't matter when not fragmented, starts at 0 when fragmented
+	FragCount uint8  // must be 1 when not fragmented
+	Addr      string // host:port
+	Data      []byte
+}
+
+func (m udpMessageV2) HeaderSize() int {
+	return 4 + 2 + 1 + 1 + int(quicvarint.Len(uint64(len(m.Addr)))) + len(m.Addr)
+}
+
+func (m udpMessageV2) Size() int {
+	return m.HeaderSize() + len(m.Data)
+}
+
+func (m udpMessageV2) Bytes() []byte {
+	buf := make([]byte, 8, m.Size())
+	binary.BigEndian.PutUint32(buf, m.SessionID)
+	binary.BigEndian.PutUint16(buf[4:], m.PacketID)
+	buf[6] = m.FragID
+	buf[7] = m.FragCount
+	buf = quicvarint.Append(buf, uint64(len(m.Addr)))
+	buf = append(buf, m.Addr...)
+	return append(buf, m.Data...)
+}
+
+func parseUDPMessageV2(msg []byte) (udpMessageV2, error) {
+	var m udpMessageV2
+	if len(msg) < 8 {
+		return m, errors.New("message too short")
+	}
+	m.SessionID = binary.BigEndian.Uint32(msg)
+	m.PacketID = binary.BigEndian.Uint16(msg[4:])
+	m.FragID = msg[6]
+	m.FragCount = msg[7]
+	r := bytes.NewReader(msg[8:])
+	addrLen, err := quicvarint.Read(r)
+	if err != nil {
+		return m, err
+	}
+	if addrLen == 0 || addrLen > v2MaxMessageLength {
+		return m, errors.New("invalid address length")
+	}
+	rest := msg[len(msg)-r.Len():]
+	if len(rest) < int(addrLen) {
+		return m, errors.New("invalid message length")
+	}
+	m.Addr = string(rest[:addrLen])
+	m.Data = rest[addrLen:]
+	return m, nil
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+func TestReadV2TCPRequest(t *testing.T) {
+	var buf []byte
+	buf = quicvarint.Append(buf, uint64(len("example.com:443")))
+	buf = append(buf, "example.com:443"...)
+	buf = quicvarint.Append(buf, 300)
+	buf = append(buf, bytes.Repeat([]byte("x"), 300)...)
+	buf = append(buf, "payload"...)
+	r := bytes.NewReader(buf)
+	addr, err := readV2TCPRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "example.com:443" {
+		t.Errorf("got address %s", addr)
+	}
+	if r.Len() != len("payload") {
+		t.Errorf("%d bytes left, want the payload only", r.Len())
+	}
+}
+
+func TestUDPMessageV2(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	msg := udpMessageV2{
+		SessionID: 7,
+		PacketID:  42,
+		FragCount: 1,
+		Addr:      "1.1.1.1:53",
+		Data:      data,
+	}
+	frags := fragUDPMessageV2(msg, 1200)
+	if len(frags) != 3 {
+		t.Fatalf("got %d fragments, want 3", len(frags))
+	}
+	var d defraggerV2
+	var out *udpMessageV2
+	for _, frag := range frags {
+		b := frag.Bytes()
+		if len(b) > 1200 {
+			t.Fatalf("fragment of %d bytes", len(b))
+		}
+		m, err := parseUDPMessageV2(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = d.Feed(m)
+	}
+	if out == nil {
+		t.Fatal("message not reassembled")
+	}
+	if out.SessionID != 7 || out.Addr != "1.1.1.1:53" || !bytes.Equal(out.Data, data) {
+		t.Errorf("got %+v", out)
+	}
+	if _, err := parseUDPMessageV2(msg.Bytes()[:10]); err == nil {
+		t.Error("truncated message parsed")
+	}
+}
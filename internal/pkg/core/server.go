@@ -8,14 +8,20 @@ import (
 	"github.com/lunixbochs/struc"
 	"github.com/quic-go/quic-go"
 	"github.com/xflash-panda/server-hysteria/internal/app/service"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/acl"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/congestion"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/metrics"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/pmtud"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/ratelimit"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/transport"
 	"net"
+	"net/http"
+	"sync"
+	"time"
 )
 
 type (
-	ConnectFunc    func(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, int)
+	ConnectFunc    func(addr net.Addr, ok bool, userId int)
 	DisconnectFunc func(addr net.Addr, userId int, err error)
 	TCPRequestFunc func(addr net.Addr, userId int, reqAddr string)
 	TCPErrorFunc   func(addr net.Addr, userId int, reqAddr string, err error)
@@ -23,11 +29,26 @@ type (
 	UDPErrorFunc   func(addr net.Addr, userId int, sessionID uint32, err error)
 )
 
+// Protocol is the protocol the server speaks to clients.
+type Protocol int
+
+const (
+	// ProtocolHysteria is the original protocol, version 3 on the wire.
+	ProtocolHysteria = Protocol(iota)
+	// ProtocolHysteria2 is Hysteria 2, over HTTP/3.
+	ProtocolHysteria2
+)
+
 type Server struct {
 	transport        *transport.ServerTransport
+	acl              *acl.Engine
+	configMutex      sync.RWMutex
+	protocol         Protocol
 	sendBPS, recvBPS uint64
 	disableUDP       bool
+	masquerade       http.Handler
 
+	authenticator  Authenticator
 	connectFunc    ConnectFunc
 	disconnectFunc DisconnectFunc
 	tcpRequestFunc TCPRequestFunc
@@ -35,15 +56,25 @@ type Server struct {
 	udpRequestFunc UDPRequestFunc
 	udpErrorFunc   UDPErrorFunc
 	userService    *service.UsersService
+	sessions       *sessionRegistry
+	metrics        *metrics.NodeMetrics
 
-	pktConn  net.PacketConn
-	listener quic.Listener
+	tlsConfig     *tls.Config
+	quicConfig    *quic.Config
+	listenerMutex sync.Mutex
+	pktConn       net.PacketConn
+	listener      quic.Listener
+
+	connMutex sync.Mutex
+	conns     map[quic.Connection]struct{}
+	connWg    sync.WaitGroup
+	draining  bool
 }
 
-func NewServer(tlsConfig *tls.Config, quicConfig *quic.Config,
-	pktConn net.PacketConn, transport *transport.ServerTransport,
-	sendBPS uint64, recvBPS uint64, disableUDP bool, userService *service.UsersService,
-	connectFunc ConnectFunc, disconnectFunc DisconnectFunc,
+func NewServer(tlsConfig *tls.Config, quicConfig *quic.Config, protocol Protocol,
+	pktConn net.PacketConn, transport *transport.ServerTransport, aclEngine *acl.Engine,
+	sendBPS uint64, recvBPS uint64, disableUDP bool, userService *service.UsersService, metrics *metrics.NodeMetrics,
+	authenticator Authenticator, connectFunc ConnectFunc, disconnectFunc DisconnectFunc,
 	tcpRequestFunc TCPRequestFunc, tcpErrorFunc TCPErrorFunc,
 	udpRequestFunc UDPRequestFunc, udpErrorFunc UDPErrorFunc,
 ) (*Server, error) {
@@ -54,13 +85,21 @@ func NewServer(tlsConfig *tls.Config, quicConfig *quic.Config,
 		return nil, err
 	}
 	s := &Server{
+		tlsConfig:      tlsConfig,
+		quicConfig:     quicConfig,
 		pktConn:        pktConn,
 		listener:       listener,
 		transport:      transport,
+		acl:            aclEngine,
+		protocol:       protocol,
 		sendBPS:        sendBPS,
 		recvBPS:        recvBPS,
 		disableUDP:     disableUDP,
 		userService:    userService,
+		sessions:       newSessionRegistry(),
+		metrics:        metrics,
+		conns:          make(map[quic.Connection]struct{}),
+		authenticator:  authenticator,
 		connectFunc:    connectFunc,
 		disconnectFunc: disconnectFunc,
 		tcpRequestFunc: tcpRequestFunc,
@@ -68,82 +107,300 @@ func NewServer(tlsConfig *tls.Config, quicConfig *quic.Config,
 		udpRequestFunc: udpRequestFunc,
 		udpErrorFunc:   udpErrorFunc,
 	}
+	userService.SetOnlineFunc(s.sessions.onlineDevices)
+	userService.SetKickFunc(s.KickUser)
+	if r, ok := authenticator.(Revoker); ok {
+		r.SetKickFunc(func(userId int) int {
+			return s.kickUser(userKey{id: userId})
+		})
+	}
+	metrics.Register(newBrutalCollector(s, metrics.Node))
 	return s, nil
 }
 
+// Serve accepts connections until the server is closed, it returns nil if that was done by Shutdown.
 func (s *Server) Serve() error {
 	for {
-		cc, err := s.listener.Accept(context.Background())
+		listener := s.currentListener()
+		cc, err := listener.Accept(context.Background())
 		if err != nil {
+			s.connMutex.Lock()
+			draining := s.draining
+			s.connMutex.Unlock()
+			if draining {
+				return nil
+			}
+			if s.currentListener() != listener {
+				// Rebound, carry on with the new listener
+				continue
+			}
 			return err
 		}
-		go s.handleClient(cc)
+		s.connMutex.Lock()
+		if s.draining {
+			s.connMutex.Unlock()
+			_ = qErrorShutdown.Send(cc)
+			continue
+		}
+		s.conns[cc] = struct{}{}
+		s.connWg.Add(1)
+		s.connMutex.Unlock()
+		s.configMutex.RLock()
+		protocol := s.protocol
+		s.configMutex.RUnlock()
+		go func() {
+			if protocol == ProtocolHysteria2 {
+				s.handleClientV2(cc)
+			} else {
+				s.handleClient(cc)
+			}
+			s.connMutex.Lock()
+			delete(s.conns, cc)
+			s.connMutex.Unlock()
+			s.connWg.Done()
+		}()
 	}
 }
 
 func (s *Server) Close() error {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
 	err := s.listener.Close()
 	_ = s.pktConn.Close()
 	return err
 }
 
+func (s *Server) currentListener() quic.Listener {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	return s.listener
+}
+
+// Rebind moves the server to a new packet conn created by newPktConn, the old one is closed along with its
+// connections once the new listener is up. When the new conn wants the address of the old one (sameAddr) and
+// can't be created next to it, the old one is closed first, and if the new one fails then too the server goes
+// back to a conn created by restore with the QUIC config it had.
+func (s *Server) Rebind(newPktConn func() (net.PacketConn, error), quicConfig *quic.Config,
+	sameAddr bool, restore func() (net.PacketConn, error),
+) error {
+	quicConfig.DisablePathMTUDiscovery = quicConfig.DisablePathMTUDiscovery || pmtud.DisablePathMTUDiscovery
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	pktConn, listener, err := listenQUIC(newPktConn, s.tlsConfig, quicConfig)
+	if err != nil {
+		if !sameAddr {
+			return err
+		}
+		_ = s.listener.Close()
+		_ = s.pktConn.Close()
+		pktConn, listener, err = listenQUIC(newPktConn, s.tlsConfig, quicConfig)
+		if err != nil {
+			oldPktConn, oldListener, restoreErr := listenQUIC(restore, s.tlsConfig, s.quicConfig)
+			if restoreErr != nil {
+				return fmt.Errorf("%s, and the old listener can't be restored: %s", err, restoreErr)
+			}
+			s.pktConn = oldPktConn
+			s.listener = oldListener
+			return err
+		}
+	} else {
+		_ = s.listener.Close()
+		_ = s.pktConn.Close()
+	}
+	s.pktConn = pktConn
+	s.listener = listener
+	s.quicConfig = quicConfig
+	return nil
+}
+
+func listenQUIC(newPktConn func() (net.PacketConn, error), tlsConfig *tls.Config, quicConfig *quic.Config,
+) (net.PacketConn, quic.Listener, error) {
+	pktConn, err := newPktConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	listener, err := quic.Listen(pktConn, tlsConfig, quicConfig)
+	if err != nil {
+		_ = pktConn.Close()
+		return nil, nil, err
+	}
+	return pktConn, listener, nil
+}
+
+// SetSpeed changes the server-wide rate limits, they apply to connections made from now on.
+func (s *Server) SetSpeed(sendBPS, recvBPS uint64) {
+	s.configMutex.Lock()
+	s.sendBPS, s.recvBPS = sendBPS, recvBPS
+	s.configMutex.Unlock()
+}
+
+// SetProtocol changes the protocol spoken to connections made from now on.
+// Clients of one protocol can't talk to the other, so this goes along with a Rebind.
+func (s *Server) SetProtocol(protocol Protocol) {
+	s.configMutex.Lock()
+	s.protocol = protocol
+	s.configMutex.Unlock()
+}
+
+// SetDisableUDP turns UDP relaying on or off for connections made from now on.
+func (s *Server) SetDisableUDP(disableUDP bool) {
+	s.configMutex.Lock()
+	s.disableUDP = disableUDP
+	s.configMutex.Unlock()
+}
+
+// Shutdown stops taking new connections and gives the existing ones drainTimeout to finish on their own.
+// Whatever is still connected after that is told the server is going away. Shutdown returns once every
+// connection and all of its streams are done, then closes the server.
+func (s *Server) Shutdown(drainTimeout time.Duration) error {
+	s.connMutex.Lock()
+	s.draining = true
+	s.connMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.connWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		s.connMutex.Lock()
+		for cc := range s.conns {
+			_ = qErrorShutdown.Send(cc)
+		}
+		s.connMutex.Unlock()
+		<-done
+	}
+	return s.Close()
+}
+
+// KickUser closes every connection of the panel user with an auth error and returns how many were closed.
+// Auth only happens once per connection, so this is how revoked users get cut off. Users of other
+// authenticators are left alone, whatever their ids, those that revoke users do it through Revoker.
+func (s *Server) KickUser(userId int) int {
+	return s.kickUser(userKey{id: userId, panel: true})
+}
+
+func (s *Server) kickUser(key userKey) int {
+	sessions := s.sessions.userSessions(key)
+	for _, sess := range sessions {
+		_ = qErrorAuth.Send(sess.CC)
+	}
+	return len(sessions)
+}
+
+// Sessions returns a snapshot of all live connections.
+func (s *Server) Sessions() []SessionInfo {
+	sessions := s.sessions.all()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		infos = append(infos, sess.info())
+	}
+	return infos
+}
+
+// KickSession closes the connection with the session id, it returns false if there is no such connection.
+func (s *Server) KickSession(id uint64) bool {
+	sess := s.sessions.get(id)
+	if sess == nil {
+		return false
+	}
+	_ = qErrorAuth.Send(sess.CC)
+	return true
+}
+
+// handleClient serves a Hysteria connection. Connections that turn out not to be clients get the masquerade,
+// if there is one: those that open no stream or don't start with a Hysteria control stream look just like
+// an HTTP/3 server. A client that fails authentication has been answered with a serverHello already,
+// so falling back to the masquerade then only hides the rest, a prober can still tell from that reply.
 func (s *Server) handleClient(cc quic.Connection) {
 	// Expect the client to create a control stream to send its own information
 	ctx, ctxCancel := context.WithTimeout(context.Background(), protocolTimeout)
 	stream, err := cc.AcceptStream(ctx)
 	ctxCancel()
+	masq := s.masqueradeHandler()
 	if err != nil {
+		if masq != nil && cc.Context().Err() == nil {
+			// Just as quiet as an HTTP/3 client that has nothing to ask yet
+			serveMasquerade(cc, masq, nil)
+			return
+		}
 		_ = qErrorProtocol.Send(cc)
 		return
 	}
 	// Handle the control stream
-	userId, ok, err := s.handleControlStream(cc, stream)
+	sess, ok, err := s.handleControlStream(cc, stream)
 	if err != nil {
+		var vErr versionError
+		if masq != nil && errors.As(err, &vErr) {
+			// Most likely an HTTP/3 request, the first byte of which is gone already
+			serveMasquerade(cc, masq, &replayStream{Stream: stream, head: []byte{byte(vErr)}})
+			return
+		}
 		_ = qErrorProtocol.Send(cc)
 		return
 	}
 	if !ok {
+		if masq != nil {
+			serveMasquerade(cc, masq, nil)
+			return
+		}
 		_ = qErrorAuth.Send(cc)
 		return
 	}
+	defer s.sessions.remove(sess)
+	s.metrics.Connections.Inc()
+	defer s.metrics.Connections.Dec()
 	// Start accepting streams and messages
-	sc := newServerClient(cc, s.transport, userId, s.disableUDP, s.userService.GetTrafficItem(userId),
-		s.tcpRequestFunc, s.tcpErrorFunc, s.udpRequestFunc, s.udpErrorFunc)
+	sc := s.newClient(cc, sess)
 	err = sc.Run()
 	_ = qErrorGeneric.Send(cc)
-	s.disconnectFunc(cc.RemoteAddr(), userId, err)
+	s.disconnectFunc(cc.RemoteAddr(), sess.UserId, err)
+}
+
+// newClient creates the client of an authenticated session.
+func (s *Server) newClient(cc quic.Connection, sess *session) *serverClient {
+	s.configMutex.RLock()
+	disableUDP := s.disableUDP
+	s.configMutex.RUnlock()
+	// Only the traffic of panel users is reported to the panel
+	var trafficItem *service.TrafficItem
+	if sess.Panel {
+		trafficItem = s.userService.GetTrafficItem(sess.UserId)
+	}
+	return newServerClient(cc, s.transport, s.acl, sess, disableUDP, trafficItem,
+		s.metrics, s.tcpRequestFunc, s.tcpErrorFunc, s.udpRequestFunc, s.udpErrorFunc)
 }
 
 // Auth & negotiate speed
-func (s *Server) handleControlStream(cc quic.Connection, stream quic.Stream) (int, bool, error) {
+// On success the returned session is already registered, the caller must remove it when done.
+func (s *Server) handleControlStream(cc quic.Connection, stream quic.Stream) (*session, bool, error) {
 	// Check version
 	vb := make([]byte, 1)
 	_, err := stream.Read(vb)
 	if err != nil {
-		return -1, false, err
+		return nil, false, err
 	}
 	if vb[0] != protocolVersion {
-		return -1, false, fmt.Errorf("unsupported protocol version %d, expecting %d", vb[0], protocolVersion)
+		return nil, false, versionError(vb[0])
 	}
 	// Parse client hello
 	var ch clientHello
 	err = struc.Unpack(stream, &ch)
 	if err != nil {
-		return -1, false, err
+		return nil, false, err
 	}
 	// Speed
 	if ch.Rate.SendBPS == 0 || ch.Rate.RecvBPS == 0 {
-		return -1, false, errors.New("invalid rate from client")
-	}
-	serverSendBPS, serverRecvBPS := ch.Rate.RecvBPS, ch.Rate.SendBPS
-	if s.sendBPS > 0 && serverSendBPS > s.sendBPS {
-		serverSendBPS = s.sendBPS
+		return nil, false, errors.New("invalid rate from client")
 	}
-	if s.recvBPS > 0 && serverRecvBPS > s.recvBPS {
-		serverRecvBPS = s.recvBPS
+	sess, message := s.authenticate(cc, ch.Auth, ch.Rate.RecvBPS, ch.Rate.SendBPS)
+	ok := sess != nil
+	var serverSendBPS, serverRecvBPS uint64
+	if ok {
+		serverSendBPS, serverRecvBPS = sess.SendBPS, sess.RecvBPS
 	}
-	// Auth
-	ok, userId := s.connectFunc(cc.RemoteAddr(), ch.Auth, serverSendBPS, serverRecvBPS)
 	// Response
 	err = struc.Pack(stream, &serverHello{
 		OK: ok,
@@ -151,14 +408,59 @@ func (s *Server) handleControlStream(cc quic.Connection, stream quic.Stream) (in
 			SendBPS: serverSendBPS,
 			RecvBPS: serverRecvBPS,
 		},
-		Message: "Welcome",
+		Message: message,
 	})
 	if err != nil {
-		return -1, false, err
+		if sess != nil {
+			s.sessions.remove(sess)
+		}
+		return nil, false, err
 	}
 	// Set the congestion accordingly
 	if ok {
-		cc.SetCongestionControl(congestion.NewBrutalSender(serverSendBPS))
+		cc.SetCongestionControl(sess.Sender)
+	}
+	return sess, ok, nil
+}
+
+// authenticate checks the client's credentials and sets up its session. The rates the client asked for are
+// clamped to the server's and the user's limits, 0 means the client didn't say. The session gets a Brutal
+// sender if there is a send rate, otherwise the connection keeps the default congestion control.
+// On success the returned session is already registered, the caller must remove it when done.
+// On failure the session is nil and the message tells why.
+func (s *Server) authenticate(cc quic.Connection, auth []byte, sendBPS, recvBPS uint64) (*session, string) {
+	s.configMutex.RLock()
+	sendBPS, recvBPS = clampRate(sendBPS, s.sendBPS), clampRate(recvBPS, s.recvBPS)
+	s.configMutex.RUnlock()
+	result, ok := s.authenticator.Authenticate(cc.RemoteAddr(), auth, sendBPS, recvBPS)
+	s.connectFunc(cc.RemoteAddr(), ok, result.UserId)
+	if !ok {
+		s.metrics.AuthFailures.Inc()
+		return nil, "auth error"
+	}
+	// Per-user limits
+	userLimit := result.SpeedLimit
+	sendBPS, recvBPS = clampRate(sendBPS, userLimit), clampRate(recvBPS, userLimit)
+	sess := newSession(cc, result.UserId, result.Panel)
+	sess.SendBPS, sess.RecvBPS = sendBPS, recvBPS
+	// The user's own limit is enforced on the receive side too,
+	// no matter how fast the client actually sends.
+	if userLimit > 0 {
+		sess.RecvBucket = ratelimit.NewBucket(recvBPS)
+	}
+	if sendBPS > 0 {
+		sess.Sender = congestion.NewBrutalSender(sendBPS)
+	}
+	if !s.sessions.add(sess, result.DeviceLimit) {
+		return nil, "device limit exceeded"
+	}
+	return sess, "Welcome"
+}
+
+// clampRate caps the rate to the limit, either being 0 means unlimited.
+func clampRate(rate, limit uint64) uint64 {
+	if limit > 0 && (rate == 0 || rate > limit) {
+		return limit
 	}
-	return userId, ok, nil
+	return rate
 }
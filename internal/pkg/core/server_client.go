@@ -3,51 +3,73 @@ package core
 import (
 	"bytes"
 	"context"
+	"errors"
 	"github.com/lunixbochs/struc"
 	"github.com/quic-go/quic-go"
 	"github.com/xflash-panda/server-hysteria/internal/app/service"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/acl"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/metrics"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/ratelimit"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/transport"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/utils"
 	"math/rand"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const udpBufferSize = 4096
 
+var errBlocked = errors.New("blocked by ACL")
+
+// errOutboundMismatch is a datagram routed to another outbound than the one its UDP session goes through.
+var errOutboundMismatch = errors.New("routed to another outbound than the UDP session")
+
 type serverClient struct {
 	CC               quic.Connection
 	Transport        *transport.ServerTransport
+	ACL              *acl.Engine
+	Session          *session
 	UserId           int
 	DisableUDP       bool
+	Hysteria2        bool
 	CTCPRequestFunc  TCPRequestFunc
 	CTCPErrorFunc    TCPErrorFunc
 	CUDPRequestFunc  UDPRequestFunc
 	CUDPErrorFunc    UDPErrorFunc
 	TrafficItem      *service.TrafficItem
+	RecvBucket       *ratelimit.Bucket
+	Metrics          *metrics.NodeMetrics
 	udpSessionMutex  sync.RWMutex
-	udpSessionMap    map[uint32]transport.STPacketConn
+	udpSessionMap    map[uint32]*udpSession
 	nextUDPSessionID uint32
 	udpDefragger     defragger
+	udpDefraggerV2   defraggerV2
+	streamWg         sync.WaitGroup
 }
 
-func newServerClient(cc quic.Connection, tr *transport.ServerTransport, userId int, disableUDP bool,
-	trafficItem *service.TrafficItem,
+func newServerClient(cc quic.Connection, tr *transport.ServerTransport, aclEngine *acl.Engine, sess *session, disableUDP bool,
+	trafficItem *service.TrafficItem, metrics *metrics.NodeMetrics,
 	CTCPRequestFunc TCPRequestFunc, CTCPErrorFunc TCPErrorFunc,
 	CUDPRequestFunc UDPRequestFunc, CUDPErrorFunc UDPErrorFunc,
 ) *serverClient {
 	sc := &serverClient{
 		CC:              cc,
 		Transport:       tr,
-		UserId:          userId,
+		ACL:             aclEngine,
+		Session:         sess,
+		UserId:          sess.UserId,
 		DisableUDP:      disableUDP,
 		TrafficItem:     trafficItem,
+		RecvBucket:      sess.RecvBucket,
+		Metrics:         metrics,
 		CTCPRequestFunc: CTCPRequestFunc,
 		CTCPErrorFunc:   CTCPErrorFunc,
 		CUDPRequestFunc: CUDPRequestFunc,
 		CUDPErrorFunc:   CUDPErrorFunc,
-		udpSessionMap:   make(map[uint32]transport.STPacketConn),
+		udpSessionMap:   make(map[uint32]*udpSession),
 	}
 	return sc
 }
@@ -58,6 +80,20 @@ func (c *serverClient) ClientAddr() net.Addr {
 	return c.CC.RemoteAddr()
 }
 
+func (c *serverClient) countUp(n uint64) {
+	atomic.AddUint64(&c.Session.bytesUp, n)
+	if c.TrafficItem != nil {
+		c.TrafficItem.AddUp(n)
+	}
+}
+
+func (c *serverClient) countDown(n uint64) {
+	atomic.AddUint64(&c.Session.bytesDown, n)
+	if c.TrafficItem != nil {
+		c.TrafficItem.AddDown(n)
+	}
+}
+
 func (c *serverClient) Run() error {
 	if !c.DisableUDP {
 		go func() {
@@ -73,6 +109,8 @@ func (c *serverClient) Run() error {
 	for {
 		stream, err := c.CC.AcceptStream(context.Background())
 		if err != nil {
+			// The connection is gone, so are its streams, wait for the pipes to wind down
+			c.streamWg.Wait()
 			return err
 		}
 
@@ -80,8 +118,13 @@ func (c *serverClient) Run() error {
 			c.TrafficItem.Count.Add(1)
 		}
 
+		c.streamWg.Add(1)
 		go func() {
-			stream := &qStream{stream}
+			defer c.streamWg.Done()
+			var stream quic.Stream = &qStream{stream}
+			if c.RecvBucket != nil {
+				stream = &limitedStream{Stream: stream, Bucket: c.RecvBucket}
+			}
 			c.handleStream(stream)
 			_ = stream.Close()
 		}()
@@ -111,6 +154,10 @@ func (c *serverClient) handleStream(stream quic.Stream) {
 }
 
 func (c *serverClient) handleMessage(msg []byte) {
+	if c.RecvBucket != nil && !c.RecvBucket.Allow(len(msg)) {
+		// Over the user's limit, drop it like a congested link would
+		return
+	}
 	var udpMsg udpMessage
 	err := struc.Unpack(bytes.NewBuffer(msg), &udpMsg)
 	if err != nil {
@@ -121,114 +168,135 @@ func (c *serverClient) handleMessage(msg []byte) {
 		return
 	}
 	c.udpSessionMutex.RLock()
-	conn, ok := c.udpSessionMap[dfMsg.SessionID]
+	us, ok := c.udpSessionMap[dfMsg.SessionID]
 	c.udpSessionMutex.RUnlock()
 	if ok {
 		// Session found, send the message
-		var isDomain bool
-		var ipAddr *net.IPAddr
-		var err error
-
-		ipAddr, isDomain, err = c.Transport.ResolveIPAddr(dfMsg.Host)
-		if err != nil { // Special case for domain requests + SOCKS5 outbound
-			return
-		}
+		c.sendUDP(us, dfMsg.Host, dfMsg.Port, dfMsg.Data)
+	}
+}
 
-		addrEx := &transport.AddrEx{
-			IPAddr: ipAddr,
-			Port:   int(dfMsg.Port),
-		}
-		if isDomain {
-			addrEx.Domain = dfMsg.Host
-		}
-		_, _ = conn.WriteTo(dfMsg.Data, addrEx)
-		if c.TrafficItem != nil {
-			c.TrafficItem.Up.Add(uint64(len(dfMsg.Data)))
-		}
+// sendUDP routes the datagram and sends it through the conn of the session.
+func (c *serverClient) sendUDP(us *udpSession, host string, port uint16, data []byte) {
+	res, err := c.ACL.Match(host, port, true)
+	if err != nil && !(res.IsDomain && c.Transport.ProxyEnabled(res.Outbound)) { // Special case for domain requests + SOCKS5 outbound
+		return
+	}
+	if res.Action == acl.ActionBlock || res.Action == acl.ActionReject {
+		// No way to tell the client, just drop it
+		return
+	}
+	conn, err := c.udpSessionConn(us, res.Outbound)
+	if err == errOutboundMismatch {
+		// Sending it through the session's outbound would ignore its route, drop it
+		return
+	}
+	if err != nil {
+		// The session is of no use without a conn, end it
+		c.CUDPErrorFunc(c.ClientAddr(), c.UserId, us.ID, err)
+		us.end()
+		return
 	}
 
+	addrEx := &transport.AddrEx{
+		IPAddr:   res.IPAddr,
+		IPAddrs:  res.IPAddrs,
+		Port:     int(res.Port),
+		Hijacked: res.Action == acl.ActionHijack,
+	}
+	if res.IsDomain {
+		addrEx.Domain = res.Host
+	}
+	_, _ = conn.WriteTo(data, addrEx)
+	c.countUp(uint64(len(data)))
 }
 
 func (c *serverClient) handleTCP(stream quic.Stream, host string, port uint16) {
-	addrStr := net.JoinHostPort(host, strconv.Itoa(int(port)))
-	var isDomain bool
-	var ipAddr *net.IPAddr
-	var err error
+	c.proxyTCP(stream, host, port, func(ok bool, msg string) error {
+		return struc.Pack(stream, &serverResponse{
+			OK:      ok,
+			Message: msg,
+		})
+	})
+}
 
-	ipAddr, isDomain, err = c.Transport.ResolveIPAddr(host)
+// proxyTCP routes and dials the request, tells the client how it went with respond and pipes the stream
+// to the target. Blocked requests get no response at all.
+func (c *serverClient) proxyTCP(stream quic.Stream, host string, port uint16, respond func(ok bool, msg string) error) {
+	addrStr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	res, err := c.ACL.Match(host, port, false)
 
-	if err != nil && !(isDomain && c.Transport.ProxyEnabled()) { // Special case for domain requests + SOCKS5 outbound
-		_ = struc.Pack(stream, &serverResponse{
-			OK:      false,
-			Message: "host resolution failure",
-		})
+	if err != nil && !(res.IsDomain && c.Transport.ProxyEnabled(res.Outbound)) { // Special case for domain requests + SOCKS5 outbound
+		_ = respond(false, "host resolution failure")
+		c.Metrics.DialError(err)
 		c.CTCPErrorFunc(c.ClientAddr(), c.UserId, addrStr, err)
 		return
 	}
+	switch res.Action {
+	case acl.ActionBlock:
+		// Close without a word, as if nothing is there
+		c.CTCPErrorFunc(c.ClientAddr(), c.UserId, addrStr, errBlocked)
+		return
+	case acl.ActionReject:
+		_ = respond(false, errBlocked.Error())
+		c.CTCPErrorFunc(c.ClientAddr(), c.UserId, addrStr, errBlocked)
+		return
+	}
 	c.CTCPRequestFunc(c.ClientAddr(), c.UserId, addrStr)
 
 	var conn net.Conn // Connection to be piped
 
 	addrEx := &transport.AddrEx{
-		IPAddr: ipAddr,
-		Port:   int(port),
+		IPAddr:   res.IPAddr,
+		IPAddrs:  res.IPAddrs,
+		Port:     int(res.Port),
+		Hijacked: res.Action == acl.ActionHijack,
 	}
-	if isDomain {
-		addrEx.Domain = host
+	if res.IsDomain {
+		addrEx.Domain = res.Host
 	}
-	conn, err = c.Transport.DialTCP(addrEx)
+	conn, err = c.Transport.DialTCP(res.Outbound, addrEx)
 	if err != nil {
-		_ = struc.Pack(stream, &serverResponse{
-			OK:      false,
-			Message: err.Error(),
-		})
+		_ = respond(false, err.Error())
+		c.Metrics.DialError(err)
 		c.CTCPErrorFunc(c.ClientAddr(), c.UserId, addrStr, err)
 		return
 	}
 
 	// So far so good if we reach here
 	defer conn.Close()
-	err = struc.Pack(stream, &serverResponse{
-		OK: true,
-	})
+	err = respond(true, "")
 	if err != nil {
 		return
 	}
-	if c.TrafficItem != nil {
-		err = utils.Pipe2Way(stream, conn, func(i int) {
-			if i > 0 {
-				c.TrafficItem.Up.Add(uint64(i))
-			} else {
-				c.TrafficItem.Down.Add(uint64(-i))
-			}
-		})
-	} else {
-		err = utils.Pipe2Way(stream, conn, nil)
-	}
+	c.Metrics.Streams.Inc()
+	atomic.AddInt64(&c.Session.streams, 1)
+	defer func() {
+		c.Metrics.Streams.Dec()
+		atomic.AddInt64(&c.Session.streams, -1)
+	}()
+	err = utils.Pipe2Way(stream, conn, func(i int) {
+		if i > 0 {
+			c.countUp(uint64(i))
+		} else {
+			c.countDown(uint64(-i))
+		}
+	})
 	c.CTCPErrorFunc(c.ClientAddr(), c.UserId, addrStr, err)
 }
 
 func (c *serverClient) handleUDP(stream quic.Stream) {
 	// Like in SOCKS5, the stream here is only used to maintain the UDP session. No need to read anything from it
-	conn, err := c.Transport.ListenUDP()
-	if err != nil {
-		_ = struc.Pack(stream, &serverResponse{
-			OK:      false,
-			Message: "UDP initialization failed",
-		})
-		c.CUDPErrorFunc(c.ClientAddr(), c.UserId, 0, err)
-		return
-	}
-	defer conn.Close()
-
 	var id uint32
 	c.udpSessionMutex.Lock()
 	id = c.nextUDPSessionID
-	c.udpSessionMap[id] = conn
+	us := &udpSession{ID: id, end: func() { _ = stream.Close() }}
+	c.udpSessionMap[id] = us
 	c.nextUDPSessionID += 1
 	c.udpSessionMutex.Unlock()
+	defer us.close()
 
-	err = struc.Pack(stream, &serverResponse{
+	err := struc.Pack(stream, &serverResponse{
 		OK:           true,
 		UDPSessionID: id,
 	})
@@ -236,45 +304,11 @@ func (c *serverClient) handleUDP(stream quic.Stream) {
 		return
 	}
 	c.CUDPRequestFunc(c.ClientAddr(), c.UserId, id)
-
-	// Receive UDP packets, send them to the client
-	go func() {
-		buf := make([]byte, udpBufferSize)
-		for {
-			n, rAddr, err := conn.ReadFrom(buf)
-			if n > 0 {
-				var msgBuf bytes.Buffer
-				msg := udpMessage{
-					SessionID: id,
-					Host:      rAddr.IP.String(),
-					Port:      uint16(rAddr.Port),
-					FragCount: 1,
-					Data:      buf[:n],
-				}
-				// try no frag first
-				_ = struc.Pack(&msgBuf, &msg)
-				sendErr := c.CC.SendMessage(msgBuf.Bytes())
-				if sendErr != nil {
-					if errSize, ok := sendErr.(quic.ErrMessageTooLarge); ok {
-						// need to frag
-						msg.MsgID = uint16(rand.Intn(0xFFFF)) + 1 // msgID must be > 0 when fragCount > 1
-						fragMessages := fragUDPMessage(msg, int(errSize))
-						for _, fragMsg := range fragMessages {
-							msgBuf.Reset()
-							_ = struc.Pack(&msgBuf, &fragMsg)
-							_ = c.CC.SendMessage(msgBuf.Bytes())
-						}
-					}
-				}
-				if c.TrafficItem != nil {
-					c.TrafficItem.Down.Add(uint64(n))
-				}
-			}
-			if err != nil {
-				break
-			}
-		}
-		_ = stream.Close()
+	c.Metrics.UDPSessions.Inc()
+	atomic.AddInt64(&c.Session.udpSessions, 1)
+	defer func() {
+		c.Metrics.UDPSessions.Dec()
+		atomic.AddInt64(&c.Session.udpSessions, -1)
 	}()
 
 	// Hold the stream until it's closed by the client
@@ -292,3 +326,107 @@ func (c *serverClient) handleUDP(stream quic.Stream) {
 	delete(c.udpSessionMap, id)
 	c.udpSessionMutex.Unlock()
 }
+
+// udpSessionConn returns the packet conn of the session, opening it through the outbound on the first datagram.
+// The outbound of a UDP session is thus picked by the route of its first datagram, later datagrams routed
+// elsewhere get errOutboundMismatch.
+func (c *serverClient) udpSessionConn(us *udpSession, outbound string) (transport.STPacketConn, error) {
+	if outbound == "" {
+		outbound = c.Transport.DefaultOutbound
+	}
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+	if us.closed {
+		return nil, net.ErrClosed
+	}
+	if us.conn != nil {
+		if outbound != us.outbound {
+			return nil, errOutboundMismatch
+		}
+		return us.conn, nil
+	}
+	conn, err := c.Transport.ListenUDP(outbound)
+	if err != nil {
+		return nil, err
+	}
+	us.conn = conn
+	us.outbound = outbound
+	go c.relayUDP(us, conn)
+	return conn, nil
+}
+
+// relayUDP receives UDP packets and sends them to the client, until the conn is closed.
+func (c *serverClient) relayUDP(us *udpSession, conn transport.STPacketConn) {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, rAddr, err := conn.ReadFrom(buf)
+		if n > 0 {
+			if c.Hysteria2 {
+				us.touch()
+				c.sendUDPMessageV2(us.ID, rAddr, buf[:n])
+			} else {
+				c.sendUDPMessage(us.ID, rAddr, buf[:n])
+			}
+			c.countDown(uint64(n))
+		}
+		if err != nil {
+			break
+		}
+	}
+	us.end()
+}
+
+func (c *serverClient) sendUDPMessage(id uint32, rAddr *net.UDPAddr, data []byte) {
+	var msgBuf bytes.Buffer
+	msg := udpMessage{
+		SessionID: id,
+		Host:      rAddr.IP.String(),
+		Port:      uint16(rAddr.Port),
+		FragCount: 1,
+		Data:      data,
+	}
+	// try no frag first
+	_ = struc.Pack(&msgBuf, &msg)
+	sendErr := c.CC.SendMessage(msgBuf.Bytes())
+	if sendErr != nil {
+		if errSize, ok := sendErr.(quic.ErrMessageTooLarge); ok {
+			// need to frag
+			msg.MsgID = uint16(rand.Intn(0xFFFF)) + 1 // msgID must be > 0 when fragCount > 1
+			fragMessages := fragUDPMessage(msg, int(errSize))
+			for _, fragMsg := range fragMessages {
+				msgBuf.Reset()
+				_ = struc.Pack(&msgBuf, &fragMsg)
+				_ = c.CC.SendMessage(msgBuf.Bytes())
+			}
+		}
+	}
+}
+
+// udpSession is a client UDP session, its packet conn is opened lazily by udpSessionConn.
+type udpSession struct {
+	ID uint32
+	// end ends the session from the outside, it's called when the conn of the session is gone
+	end        func()
+	lastActive int64 // unix nano, only kept for Hysteria 2 sessions, which end when idle
+	mutex      sync.Mutex
+	conn       transport.STPacketConn
+	outbound   string // the conn goes through
+	closed     bool
+}
+
+func (us *udpSession) touch() {
+	atomic.StoreInt64(&us.lastActive, time.Now().UnixNano())
+}
+
+func (us *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&us.lastActive)))
+}
+
+func (us *udpSession) close() {
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+	us.closed = true
+	if us.conn != nil {
+		_ = us.conn.Close()
+	}
+}
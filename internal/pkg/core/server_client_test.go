@@ -0,0 +1,29 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/xflash-panda/server-hysteria/internal/pkg/transport"
+)
+
+func TestUDPSessionConnOutbound(t *testing.T) {
+	c := &serverClient{Transport: &transport.ServerTransport{
+		Outbounds: map[string]transport.Outbound{
+			transport.OutboundDirect: &transport.DirectOutbound{},
+			"other":                  &transport.DirectOutbound{},
+		},
+		DefaultOutbound: transport.OutboundDirect,
+	}}
+	us := &udpSession{end: func() {}}
+	defer us.close()
+	conn, err := c.udpSessionConn(us, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := c.udpSessionConn(us, transport.OutboundDirect); err != nil || again != conn {
+		t.Errorf("default outbound by name: got %v, %v", again, err)
+	}
+	if _, err := c.udpSessionConn(us, "other"); err != errOutboundMismatch {
+		t.Errorf("other outbound: got %v, want %v", err, errOutboundMismatch)
+	}
+}
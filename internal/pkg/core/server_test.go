@@ -0,0 +1,66 @@
+package core
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestRebind(t *testing.T) {
+	listenUDP := func(addr string) func() (net.PacketConn, error) {
+		return func() (net.PacketConn, error) {
+			return net.ListenPacket("udp", addr)
+		}
+	}
+	failed := errors.New("failed")
+	fail := func() (net.PacketConn, error) {
+		return nil, failed
+	}
+	newServer := func() *Server {
+		pktConn, listener, err := listenQUIC(listenUDP("127.0.0.1:0"), &tls.Config{}, &quic.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Server{tlsConfig: &tls.Config{}, quicConfig: &quic.Config{}, pktConn: pktConn, listener: listener}
+	}
+
+	// Another address: the old conn stays if the new one fails
+	s := newServer()
+	oldAddr := s.pktConn.LocalAddr().String()
+	if err := s.Rebind(fail, &quic.Config{}, false, nil); err != failed {
+		t.Fatalf("got %v, want %v", err, failed)
+	}
+	if _, err := net.ListenPacket("udp", oldAddr); err == nil {
+		t.Error("old conn closed by a failed rebind")
+	}
+	if err := s.Rebind(listenUDP("127.0.0.1:0"), &quic.Config{}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.pktConn.LocalAddr().String() == oldAddr {
+		t.Error("still on the old address")
+	}
+	_ = s.Close()
+
+	// The same address: the old conn makes way for the new one
+	s = newServer()
+	oldAddr = s.pktConn.LocalAddr().String()
+	if err := s.Rebind(listenUDP(oldAddr), &quic.Config{}, true, listenUDP(oldAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if s.pktConn.LocalAddr().String() != oldAddr {
+		t.Errorf("got %s, want %s", s.pktConn.LocalAddr(), oldAddr)
+	}
+
+	// ...and comes back if the new one fails anyway
+	oldConn := s.pktConn
+	if err := s.Rebind(fail, &quic.Config{}, true, listenUDP(oldAddr)); err != failed {
+		t.Fatalf("got %v, want %v", err, failed)
+	}
+	if s.pktConn == oldConn || s.pktConn.LocalAddr().String() != oldAddr {
+		t.Errorf("old conn not restored, got %s", s.pktConn.LocalAddr())
+	}
+	_ = s.Close()
+}
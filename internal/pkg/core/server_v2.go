@@ -0,0 +1,269 @@
+package core
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// v2Handler serves a Hysteria 2 connection. Until the client authenticates it's just an HTTP/3 server,
+// after that TCP requests come in as hijacked streams and UDP as datagrams.
+type v2Handler struct {
+	server *Server
+	cc     quic.Connection
+	mutex  sync.Mutex
+	client *serverClient // set once authenticated
+	closed bool
+}
+
+func (s *Server) handleClientV2(cc quic.Connection) {
+	h := &v2Handler{server: s, cc: cc}
+	h3s := http3.Server{
+		Handler:        h,
+		StreamHijacker: h.hijackStream,
+	}
+	err := h3s.ServeQUICConn(cc)
+	_ = qErrorGeneric.Send(cc)
+	h.mutex.Lock()
+	h.closed = true
+	sc := h.client
+	h.mutex.Unlock()
+	if sc == nil {
+		return
+	}
+	// The connection is gone, so are its streams, wait for the pipes to wind down
+	sc.streamWg.Wait()
+	s.sessions.remove(sc.Session)
+	s.metrics.Connections.Dec()
+	s.disconnectFunc(cc.RemoteAddr(), sc.UserId, err)
+}
+
+// ServeHTTP authenticates the client, anything else goes to the masquerade, or gets a 404 without one.
+func (h *v2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Host != v2URLHost || r.URL.Path != v2URLPath {
+		h.serveMasquerade(w, r)
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return
+	}
+	if h.client == nil {
+		// The client tells how fast it can receive, which is how fast we send, 0 means it doesn't know
+		clientRx, _ := strconv.ParseUint(r.Header.Get(v2HeaderCCRX), 10, 64)
+		sess, _ := h.server.authenticate(h.cc, []byte(r.Header.Get(v2HeaderAuth)), clientRx, 0)
+		if sess == nil {
+			h.serveMasquerade(w, r)
+			return
+		}
+		if sess.Sender != nil {
+			h.cc.SetCongestionControl(sess.Sender)
+		}
+		h.server.metrics.Connections.Inc()
+		h.client = h.server.newClient(h.cc, sess)
+		h.client.Hysteria2 = true
+		if !h.client.DisableUDP {
+			go h.client.receiveMessagesV2()
+		}
+	}
+	// Already authenticated clients asking again get the same answer
+	w.Header().Set(v2HeaderUDPEnabled, strconv.FormatBool(!h.client.DisableUDP))
+	w.Header().Set(v2HeaderCCRX, strconv.FormatUint(h.client.Session.RecvBPS, 10))
+	w.Header().Set(v2HeaderPadding, v2AuthResponsePadding.String())
+	w.WriteHeader(v2StatusAuthOK)
+}
+
+func (h *v2Handler) serveMasquerade(w http.ResponseWriter, r *http.Request) {
+	if masq := h.server.masqueradeHandler(); masq != nil {
+		masq.ServeHTTP(w, r)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// hijackStream takes the TCP requests of authenticated clients away from HTTP/3.
+func (h *v2Handler) hijackStream(ft http3.FrameType, cc quic.Connection, stream quic.Stream, err error) (bool, error) {
+	if err != nil || ft != v2FrameTypeTCPRequest {
+		return false, nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.client == nil || h.closed {
+		return false, nil
+	}
+	sc := h.client
+	sc.streamWg.Add(1)
+	go func() {
+		defer sc.streamWg.Done()
+		sc.handleStreamV2(stream)
+	}()
+	return true, nil
+}
+
+func (c *serverClient) handleStreamV2(stream quic.Stream) {
+	if c.TrafficItem != nil {
+		c.TrafficItem.Count.Add(1)
+	}
+	stream = &qStream{stream}
+	if c.RecvBucket != nil {
+		stream = &limitedStream{Stream: stream, Bucket: c.RecvBucket}
+	}
+	defer stream.Close()
+	reqAddr, err := readV2TCPRequest(stream)
+	if err != nil {
+		return
+	}
+	respond := func(ok bool, msg string) error {
+		return writeV2TCPResponse(stream, ok, msg)
+	}
+	host, port, err := splitHostPort(reqAddr)
+	if err != nil {
+		_ = respond(false, err.Error())
+		return
+	}
+	c.proxyTCP(stream, host, port, respond)
+}
+
+func splitHostPort(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, uint16(port), nil
+}
+
+// receiveMessagesV2 relays the UDP messages of the client until the connection is gone.
+// Sessions are not set up beforehand, a message with a new session ID starts one.
+func (c *serverClient) receiveMessagesV2() {
+	go c.expireUDPSessionsV2()
+	for {
+		msg, err := c.CC.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		c.handleMessageV2(msg)
+	}
+}
+
+func (c *serverClient) handleMessageV2(msg []byte) {
+	if c.RecvBucket != nil && !c.RecvBucket.Allow(len(msg)) {
+		// Over the user's limit, drop it like a congested link would
+		return
+	}
+	udpMsg, err := parseUDPMessageV2(msg)
+	if err != nil {
+		return
+	}
+	dfMsg := c.udpDefraggerV2.Feed(udpMsg)
+	if dfMsg == nil {
+		return
+	}
+	host, port, err := splitHostPort(dfMsg.Addr)
+	if err != nil {
+		return
+	}
+	us := c.udpSessionV2(dfMsg.SessionID)
+	if us == nil {
+		return
+	}
+	c.sendUDP(us, host, port, dfMsg.Data)
+}
+
+// udpSessionV2 returns the session with the id, starting it if there isn't one yet.
+// It returns nil once the connection is gone.
+func (c *serverClient) udpSessionV2(id uint32) *udpSession {
+	c.udpSessionMutex.Lock()
+	us, ok := c.udpSessionMap[id]
+	if !ok {
+		if c.CC.Context().Err() != nil {
+			c.udpSessionMutex.Unlock()
+			return nil
+		}
+		us = &udpSession{ID: id}
+		us.end = func() { c.closeUDPSessionV2(us, io.EOF) }
+		c.udpSessionMap[id] = us
+	}
+	us.touch()
+	c.udpSessionMutex.Unlock()
+	if !ok {
+		c.CUDPRequestFunc(c.ClientAddr(), c.UserId, id)
+		c.Metrics.UDPSessions.Inc()
+		atomic.AddInt64(&c.Session.udpSessions, 1)
+	}
+	return us
+}
+
+func (c *serverClient) closeUDPSessionV2(us *udpSession, err error) {
+	c.udpSessionMutex.Lock()
+	if c.udpSessionMap[us.ID] != us {
+		// Already closed
+		c.udpSessionMutex.Unlock()
+		return
+	}
+	delete(c.udpSessionMap, us.ID)
+	c.udpSessionMutex.Unlock()
+	us.close()
+	c.CUDPErrorFunc(c.ClientAddr(), c.UserId, us.ID, err)
+	c.Metrics.UDPSessions.Dec()
+	atomic.AddInt64(&c.Session.udpSessions, -1)
+}
+
+// expireUDPSessionsV2 ends the sessions idle for v2UDPIdleTimeout, and all of them once the connection is gone.
+// The client never says when it's done with a session.
+func (c *serverClient) expireUDPSessionsV2() {
+	ticker := time.NewTicker(v2UDPIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		var done bool
+		select {
+		case <-c.CC.Context().Done():
+			done = true
+		case <-ticker.C:
+		}
+		var expired []*udpSession
+		c.udpSessionMutex.RLock()
+		for _, us := range c.udpSessionMap {
+			if done || us.idle() > v2UDPIdleTimeout {
+				expired = append(expired, us)
+			}
+		}
+		c.udpSessionMutex.RUnlock()
+		for _, us := range expired {
+			c.closeUDPSessionV2(us, io.EOF)
+		}
+		if done {
+			return
+		}
+	}
+}
+
+func (c *serverClient) sendUDPMessageV2(id uint32, rAddr *net.UDPAddr, data []byte) {
+	msg := udpMessageV2{
+		SessionID: id,
+		FragCount: 1,
+		Addr:      rAddr.String(),
+		Data:      data,
+	}
+	// try no frag first
+	sendErr := c.CC.SendMessage(msg.Bytes())
+	if errSize, ok := sendErr.(quic.ErrMessageTooLarge); ok {
+		// need to frag
+		msg.PacketID = uint16(rand.Intn(0xFFFF)) + 1 // packetID must be > 0 when fragCount > 1
+		for _, fragMsg := range fragUDPMessageV2(msg, int(errSize)) {
+			_ = c.CC.SendMessage(fragMsg.Bytes())
+		}
+	}
+}
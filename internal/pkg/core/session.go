@@ -0,0 +1,192 @@
+package core
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/congestion"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/ratelimit"
+)
+
+var lastSessionID uint64
+
+// session is a live, authenticated client connection.
+type session struct {
+	ID               uint64
+	CC               quic.Connection
+	UserId           int
+	Panel            bool   // the user is one of the panel's, see AuthResult
+	IP               string // client IP at connect time, identifies the device
+	ConnectedAt      time.Time
+	SendBPS, RecvBPS uint64
+	RecvBucket       *ratelimit.Bucket
+	Sender           *congestion.BrutalSender
+
+	streams     int64
+	udpSessions int64
+	bytesUp     uint64
+	bytesDown   uint64
+}
+
+func newSession(cc quic.Connection, userId int, panel bool) *session {
+	ip := cc.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return &session{
+		ID:          atomic.AddUint64(&lastSessionID, 1),
+		CC:          cc,
+		UserId:      userId,
+		Panel:       panel,
+		IP:          ip,
+		ConnectedAt: time.Now(),
+	}
+}
+
+// SessionInfo is a snapshot of a live connection.
+type SessionInfo struct {
+	ID uint64 `json:"id"`
+	// Node is left to whoever runs several servers, the core doesn't know it.
+	Node        string    `json:"node,omitempty"`
+	UserId      int       `json:"user_id"`
+	Panel       bool      `json:"panel"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	SendBPS     uint64    `json:"send_bps"`
+	RecvBPS     uint64    `json:"recv_bps"`
+	Streams     int64     `json:"streams"`
+	UDPSessions int64     `json:"udp_sessions"`
+	BytesUp     uint64    `json:"bytes_up"`
+	BytesDown   uint64    `json:"bytes_down"`
+}
+
+func (s *session) info() SessionInfo {
+	return SessionInfo{
+		ID:          s.ID,
+		UserId:      s.UserId,
+		Panel:       s.Panel,
+		RemoteAddr:  s.CC.RemoteAddr().String(),
+		ConnectedAt: s.ConnectedAt,
+		SendBPS:     s.SendBPS,
+		RecvBPS:     s.RecvBPS,
+		Streams:     atomic.LoadInt64(&s.streams),
+		UDPSessions: atomic.LoadInt64(&s.udpSessions),
+		BytesUp:     atomic.LoadUint64(&s.bytesUp),
+		BytesDown:   atomic.LoadUint64(&s.bytesDown),
+	}
+}
+
+// userKey tells users apart, the user ids of the panel and of other authenticators may be the same.
+type userKey struct {
+	id    int
+	panel bool
+}
+
+func (s *session) userKey() userKey {
+	return userKey{id: s.UserId, panel: s.Panel}
+}
+
+// sessionRegistry keeps track of live sessions by user.
+type sessionRegistry struct {
+	mutex sync.RWMutex
+	users map[userKey]map[*session]struct{}
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{users: make(map[userKey]map[*session]struct{})}
+}
+
+// add registers the session unless it would be a new device beyond deviceLimit.
+// Sessions from an IP the user is already connected from never count as a new device.
+// deviceLimit <= 0 means unlimited.
+func (r *sessionRegistry) add(s *session, deviceLimit int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := s.userKey()
+	sessions := r.users[key]
+	if deviceLimit > 0 {
+		ips := devices(sessions)
+		if _, ok := ips[s.IP]; !ok && len(ips) >= deviceLimit {
+			return false
+		}
+	}
+	if sessions == nil {
+		sessions = make(map[*session]struct{})
+		r.users[key] = sessions
+	}
+	sessions[s] = struct{}{}
+	return true
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := s.userKey()
+	sessions := r.users[key]
+	delete(sessions, s)
+	if len(sessions) == 0 {
+		delete(r.users, key)
+	}
+}
+
+// userSessions returns a snapshot of the live sessions of the user.
+func (r *sessionRegistry) userSessions(key userKey) []*session {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	list := make([]*session, 0, len(r.users[key]))
+	for s := range r.users[key] {
+		list = append(list, s)
+	}
+	return list
+}
+
+// get returns the live session with the id, or nil.
+func (r *sessionRegistry) get(id uint64) *session {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, sessions := range r.users {
+		for s := range sessions {
+			if s.ID == id {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// all returns a snapshot of all live sessions.
+func (r *sessionRegistry) all() []*session {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var list []*session
+	for _, sessions := range r.users {
+		for s := range sessions {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// onlineDevices returns the number of distinct devices of every online panel user.
+func (r *sessionRegistry) onlineDevices() map[int]int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	online := make(map[int]int, len(r.users))
+	for key, sessions := range r.users {
+		if key.panel {
+			online[key.id] = len(devices(sessions))
+		}
+	}
+	return online
+}
+
+func devices(sessions map[*session]struct{}) map[string]struct{} {
+	ips := make(map[string]struct{}, len(sessions))
+	for s := range sessions {
+		ips[s.IP] = struct{}{}
+	}
+	return ips
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSessionRegistryDeviceLimit(t *testing.T) {
+	r := newSessionRegistry()
+	user := userKey{id: 1, panel: true}
+	phone := &session{ID: 1, UserId: 1, Panel: true, IP: "192.0.2.1"}
+	phoneAgain := &session{ID: 2, UserId: 1, Panel: true, IP: "192.0.2.1"}
+	laptop := &session{ID: 3, UserId: 1, Panel: true, IP: "192.0.2.2"}
+	tests := []struct {
+		name   string
+		s      *session
+		remove bool
+		want   bool
+		online int
+	}{
+		{"first device", phone, false, true, 1},
+		{"same device again", phoneAgain, false, true, 1},
+		{"device over the limit", laptop, false, false, 1},
+		{"first device leaves", phone, true, true, 1},
+		{"still over the limit", laptop, false, false, 1},
+		{"first device gone", phoneAgain, true, true, 0},
+		{"device in the freed slot", laptop, false, true, 1},
+	}
+	for _, tt := range tests {
+		if tt.remove {
+			r.remove(tt.s)
+		} else if ok := r.add(tt.s, 1); ok != tt.want {
+			t.Errorf("%s: add = %v, want %v", tt.name, ok, tt.want)
+		}
+		if online := r.onlineDevices()[1]; online != tt.online {
+			t.Errorf("%s: %d devices online, want %d", tt.name, online, tt.online)
+		}
+	}
+	if sessions := r.userSessions(user); len(sessions) != 1 || sessions[0] != laptop {
+		t.Errorf("user sessions = %v, want the laptop", sessions)
+	}
+	r.remove(laptop)
+	if sessions := r.userSessions(user); len(sessions) != 0 || len(r.users) != 0 {
+		t.Errorf("sessions left after disconnecting: %v", r.users)
+	}
+
+	// No limit
+	for i := 0; i < 3; i++ {
+		if !r.add(&session{ID: uint64(10 + i), UserId: 2, Panel: true, IP: fmt.Sprintf("192.0.2.%d", i)}, 0) {
+			t.Errorf("device %d rejected without a limit", i)
+		}
+	}
+}
+
+func TestSessionRegistryPanelUsers(t *testing.T) {
+	r := newSessionRegistry()
+	panelUser := &session{ID: 1, UserId: 7, Panel: true, IP: "192.0.2.1"}
+	fileUser := &session{ID: 2, UserId: 7, IP: "192.0.2.2"}
+	// Same id, but not the same user, so not the same devices either
+	if !r.add(panelUser, 1) || !r.add(fileUser, 1) {
+		t.Fatal("device limit shared by the users of different authenticators")
+	}
+	if sessions := r.userSessions(userKey{id: 7, panel: true}); len(sessions) != 1 || sessions[0] != panelUser {
+		t.Errorf("panel user sessions = %v", sessions)
+	}
+	if online := r.onlineDevices(); len(online) != 1 || online[7] != 1 {
+		t.Errorf("online devices = %v, want only the panel user", online)
+	}
+}
@@ -3,6 +3,7 @@ package core
 import (
 	"context"
 	"github.com/quic-go/quic-go"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/ratelimit"
 	"time"
 )
 
@@ -55,3 +56,18 @@ func (s *qStream) SetWriteDeadline(t time.Time) error {
 func (s *qStream) SetDeadline(t time.Time) error {
 	return s.Stream.SetDeadline(t)
 }
+
+// limitedStream throttles reads from the client with a token bucket.
+// Sending is already paced by the congestion control, so writes are left alone.
+type limitedStream struct {
+	quic.Stream
+	Bucket *ratelimit.Bucket
+}
+
+func (s *limitedStream) Read(p []byte) (n int, err error) {
+	n, err = s.Stream.Read(p)
+	if n > 0 {
+		s.Bucket.Wait(n)
+	}
+	return n, err
+}
@@ -20,6 +20,11 @@ func (c *Counter) Reset() {
 	atomic.StoreUint64(&c.num, 0)
 }
 
+// Take returns the current value and resets the counter in one atomic step.
+func (c *Counter) Take() uint64 {
+	return atomic.SwapUint64(&c.num, 0)
+}
+
 func (c *Counter) Value() uint64 {
 	return atomic.LoadUint64(&c.num)
 }
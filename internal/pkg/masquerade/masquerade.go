@@ -0,0 +1,64 @@
+// Package masquerade makes the server look like an ordinary website to anyone who isn't a client.
+package masquerade
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// NewHandler creates the handler serving everyone who isn't a client:
+//
+//	file:///var/www                  files of a local directory
+//	https://www.example.com          reverse proxy of a site
+//	string:<content>                 the content as is, for every request
+func NewHandler(spec string) (http.Handler, error) {
+	if content, ok := strings.CutPrefix(spec, "string:"); ok {
+		return stringHandler(content), nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		dir := u.Path
+		if u.Opaque != "" {
+			// file:relative/dir
+			dir = u.Opaque
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		return http.FileServer(http.Dir(dir)), nil
+	case "http", "https":
+		if u.Host == "" {
+			return nil, errors.New("missing host of the proxied site")
+		}
+		return &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(u)
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported masquerade %s", spec)
+	}
+}
+
+type stringHandler string
+
+func (h stringHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(h))
+}
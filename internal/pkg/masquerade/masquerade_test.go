@@ -0,0 +1,56 @@
+package masquerade
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "https://example.com"+path, nil))
+	body, _ := io.ReadAll(rec.Result().Body)
+	return rec.Code, string(body)
+}
+
+func TestNewHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello from file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello from " + r.Host + r.URL.Path))
+	}))
+	defer upstream.Close()
+	upstreamHost := upstream.Listener.Addr().String()
+
+	tests := []struct {
+		spec, path string
+		code       int
+		body       string
+	}{
+		{"string:hello", "/anything", http.StatusOK, "hello"},
+		{"file://" + dir, "/hello.txt", http.StatusOK, "hello from file"},
+		{"file://" + dir, "/missing.txt", http.StatusNotFound, ""},
+		{upstream.URL, "/page", http.StatusOK, "hello from " + upstreamHost + "/page"},
+	}
+	for _, tt := range tests {
+		h, err := NewHandler(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.spec, err)
+		}
+		code, body := get(t, h, tt.path)
+		if code != tt.code || (tt.body != "" && body != tt.body) {
+			t.Errorf("%s%s: got %d %q, want %d %q", tt.spec, tt.path, code, body, tt.code, tt.body)
+		}
+	}
+
+	for _, spec := range []string{"ftp://example.com", "https://", "file://" + filepath.Join(dir, "hello.txt")} {
+		if _, err := NewHandler(spec); err == nil {
+			t.Errorf("%s: no error", spec)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "hysteria"
+
+// Registry holds every metric of the process, it is what Serve exposes.
+var Registry = prometheus.NewRegistry()
+
+var (
+	connections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connections",
+		Help:      "Active QUIC connections.",
+	}, []string{"node"})
+	streams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "streams",
+		Help:      "Active TCP streams.",
+	}, []string{"node"})
+	udpSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "udp_sessions",
+		Help:      "Active UDP sessions.",
+	}, []string{"node"})
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Rejected client authentications.",
+	}, []string{"node"})
+	dialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dial_errors_total",
+		Help:      "Failed outbound connections by error type.",
+	}, []string{"node", "type"})
+	apiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of panel API calls.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 15},
+	}, []string{"node", "call"})
+	apiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_errors_total",
+		Help:      "Failed panel API calls.",
+	}, []string{"node", "call"})
+
+	// DNSDuration is shared by all nodes, they all resolve through the same transport.
+	DNSDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dns_lookup_duration_seconds",
+		Help:      "Latency of DNS lookups for outbound requests.",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 8},
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		connections, streams, udpSessions, authFailures, dialErrors, apiDuration, apiErrors, DNSDuration,
+	)
+}
+
+// NodeMetrics are the metrics of a single node.
+type NodeMetrics struct {
+	Node         string
+	Connections  prometheus.Gauge
+	Streams      prometheus.Gauge
+	UDPSessions  prometheus.Gauge
+	AuthFailures prometheus.Counter
+}
+
+func ForNode(nodeID int) *NodeMetrics {
+	node := strconv.Itoa(nodeID)
+	return &NodeMetrics{
+		Node:         node,
+		Connections:  connections.WithLabelValues(node),
+		Streams:      streams.WithLabelValues(node),
+		UDPSessions:  udpSessions.WithLabelValues(node),
+		AuthFailures: authFailures.WithLabelValues(node),
+	}
+}
+
+// DialError counts a failed outbound connection.
+func (m *NodeMetrics) DialError(err error) {
+	dialErrors.WithLabelValues(m.Node, dialErrorType(err)).Inc()
+}
+
+// ObserveAPICall records the duration and outcome of a panel API call started at start.
+func (m *NodeMetrics) ObserveAPICall(call string, start time.Time, err error) {
+	apiDuration.WithLabelValues(m.Node, call).Observe(time.Since(start).Seconds())
+	if err != nil {
+		apiErrors.WithLabelValues(m.Node, call).Inc()
+	}
+}
+
+// Register adds a node specific collector, registering one for the same node twice is not an error.
+func (m *NodeMetrics) Register(c prometheus.Collector) {
+	if err := Registry.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			panic(err)
+		}
+	}
+}
+
+func dialErrorType(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "resolve"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	}
+	return "other"
+}
+
+// Serve exposes the registry on listen at /metrics.
+func Serve(listen string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	return http.ListenAndServe(listen, mux)
+}
@@ -0,0 +1,87 @@
+// Package porthop lets clients hop across a range of UDP ports while the server listens on one,
+// by redirecting the range to the listen port in the kernel.
+package porthop
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Start, End uint16
+}
+
+func (r PortRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(int(r.Start))
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// PortRanges are ports as "443", "20000-50000" or a comma separated list of both.
+type PortRanges []PortRange
+
+// ParsePortRanges parses a port spec like "443,20000-50000".
+func ParsePortRanges(s string) (PortRanges, error) {
+	var rs PortRanges
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		start, end, isRange := strings.Cut(part, "-")
+		if !isRange {
+			end = start
+		}
+		a, err := parsePort(start)
+		if err != nil {
+			return nil, err
+		}
+		b, err := parsePort(end)
+		if err != nil {
+			return nil, err
+		}
+		if a > b {
+			return nil, fmt.Errorf("invalid port range %s", part)
+		}
+		rs = append(rs, PortRange{Start: a, End: b})
+	}
+	return rs, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	p, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || p == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(p), nil
+}
+
+func (rs PortRanges) String() string {
+	parts := make([]string, len(rs))
+	for i, r := range rs {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// SplitListen splits a listen address with a port spec, like ":20000-50000", into the address
+// of the socket, on the first port, and the ports to redirect to it. A plain address has no ports to redirect.
+func SplitListen(listen string) (string, PortRanges, error) {
+	host, ports, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := strconv.ParseUint(ports, 10, 16); err == nil {
+		return listen, nil, nil
+	}
+	rs, err := ParsePortRanges(ports)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(rs) == 0 {
+		return "", nil, errors.New("no listen port")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(rs[0].Start))), rs, nil
+}
@@ -0,0 +1,58 @@
+package porthop
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    PortRanges
+		wantErr bool
+	}{
+		{s: "443", want: PortRanges{{443, 443}}},
+		{s: "20000-50000", want: PortRanges{{20000, 50000}}},
+		{s: "443, 20000-30000,40000-50000", want: PortRanges{{443, 443}, {20000, 30000}, {40000, 50000}}},
+		{s: "", wantErr: true},
+		{s: "0-10", wantErr: true},
+		{s: "50000-20000", wantErr: true},
+		{s: "20000-70000", wantErr: true},
+		{s: "443,", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortRanges(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePortRanges(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePortRanges(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestSplitListen(t *testing.T) {
+	tests := []struct {
+		listen    string
+		wantAddr  string
+		wantPorts string
+		wantErr   bool
+	}{
+		{listen: ":443", wantAddr: ":443"},
+		{listen: ":20000-50000", wantAddr: ":20000", wantPorts: "20000-50000"},
+		{listen: "[::1]:443,20000-50000", wantAddr: "[::1]:443", wantPorts: "443,20000-50000"},
+		{listen: "1.2.3.4:x", wantErr: true},
+		{listen: "1.2.3.4", wantErr: true},
+	}
+	for _, tt := range tests {
+		addr, ports, err := SplitListen(tt.listen)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SplitListen(%q) error = %v, wantErr %v", tt.listen, err, tt.wantErr)
+			continue
+		}
+		if addr != tt.wantAddr || ports.String() != tt.wantPorts {
+			t.Errorf("SplitListen(%q) = %q, %q, want %q, %q", tt.listen, addr, ports, tt.wantAddr, tt.wantPorts)
+		}
+	}
+}
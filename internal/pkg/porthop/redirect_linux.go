@@ -0,0 +1,108 @@
+package porthop
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/sirupsen/logrus"
+)
+
+const ruleComment = "hysteria-node port hopping"
+
+type installedRule struct {
+	ipt  *iptables.IPTables
+	rule []string
+}
+
+// Redirect is a set of iptables REDIRECT rules in the nat table that send UDP packets
+// for the hop ports to the listen port. Conntrack sends the replies back from the port the client used.
+type Redirect struct {
+	rules []installedRule
+}
+
+// NewRedirect installs the rules for the listen address, for both IPv4 and IPv6 unless the address
+// has a host of one of them. The rules of a protocol go in all or none. On an unspecified address
+// a protocol whose rules can't be installed (often IPv6 without NAT) is skipped with a warning,
+// NewRedirect only fails if none could be installed, or if the one protocol of the address fails.
+func NewRedirect(listen string, ports PortRanges) (*Redirect, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	var protos []iptables.Protocol
+	switch {
+	case ip == nil || ip.IsUnspecified():
+		protos = []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6}
+		ip = nil
+	case ip.To4() != nil:
+		protos = []iptables.Protocol{iptables.ProtocolIPv4}
+	default:
+		protos = []iptables.Protocol{iptables.ProtocolIPv6}
+	}
+	r := &Redirect{}
+	var lastErr error
+	for _, proto := range protos {
+		rules, err := installRules(proto, ip, port, ports)
+		if err != nil {
+			lastErr = fmt.Errorf("install %s rules: %w", protoName(proto), err)
+			if len(protos) > 1 {
+				logrus.WithFields(logrus.Fields{
+					"protocol": protoName(proto),
+					"error":    err,
+				}).Warn("Port hopping rules not installed for the protocol")
+			}
+			continue
+		}
+		r.rules = append(r.rules, rules...)
+	}
+	if len(r.rules) == 0 {
+		return nil, lastErr
+	}
+	return r, nil
+}
+
+// installRules installs the rules of every port range for a protocol, removing them again if one fails.
+func installRules(proto iptables.Protocol, ip net.IP, port string, ports PortRanges) ([]installedRule, error) {
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, err
+	}
+	r := &Redirect{}
+	for _, pr := range ports {
+		rule := []string{"-p", "udp"}
+		if ip != nil {
+			rule = append(rule, "-d", ip.String())
+		}
+		rule = append(rule, "--dport", strconv.Itoa(int(pr.Start))+":"+strconv.Itoa(int(pr.End)),
+			"-m", "comment", "--comment", ruleComment,
+			"-j", "REDIRECT", "--to-ports", port)
+		if err := ipt.AppendUnique("nat", "PREROUTING", rule...); err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+		r.rules = append(r.rules, installedRule{ipt: ipt, rule: rule})
+	}
+	return r.rules, nil
+}
+
+func protoName(proto iptables.Protocol) string {
+	if proto == iptables.ProtocolIPv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// Close removes the rules.
+func (r *Redirect) Close() error {
+	var err error
+	for _, ir := range r.rules {
+		if e := ir.ipt.DeleteIfExists("nat", "PREROUTING", ir.rule...); e != nil {
+			err = e
+		}
+	}
+	r.rules = nil
+	return err
+}
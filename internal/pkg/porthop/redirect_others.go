@@ -0,0 +1,15 @@
+//go:build !linux
+
+package porthop
+
+import "errors"
+
+type Redirect struct{}
+
+func NewRedirect(listen string, ports PortRanges) (*Redirect, error) {
+	return nil, errors.New("port hopping is not supported on the current system")
+}
+
+func (r *Redirect) Close() error {
+	return nil
+}
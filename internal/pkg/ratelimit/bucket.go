@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const minBurstBytes = 64 * 1024
+
+// Bucket is a token bucket that limits throughput to a number of bytes per second.
+// Tokens refill continuously and are capped at one tenth of a second worth of traffic,
+// but never less than minBurstBytes so that a single full-sized read is always allowed.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(bps uint64) *Bucket {
+	b := &Bucket{last: time.Now()}
+	b.setRate(bps)
+	b.tokens = b.burst
+	return b
+}
+
+// SetRate changes the rate of the bucket, already taken tokens are kept.
+func (b *Bucket) SetRate(bps uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.setRate(bps)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *Bucket) setRate(bps uint64) {
+	b.rate = float64(bps)
+	b.burst = b.rate / 10
+	if b.burst < minBurstBytes {
+		b.burst = minBurstBytes
+	}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Allow takes n tokens if they are available right now, it never blocks.
+// It is meant for datagrams, which are simply dropped when over the limit.
+func (b *Bucket) Allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Wait takes n tokens, sleeping until the bucket has caught up if it runs into debt.
+func (b *Bucket) Wait(n int) {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 && b.rate > 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
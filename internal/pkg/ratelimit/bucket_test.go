@@ -0,0 +1,26 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketAllow(t *testing.T) {
+	b := NewBucket(1024 * 1024)
+	if !b.Allow(minBurstBytes) {
+		t.Error("burst should be allowed")
+	}
+	if b.Allow(minBurstBytes) {
+		t.Error("bucket should be empty after burst")
+	}
+}
+
+func TestBucketWait(t *testing.T) {
+	b := NewBucket(1024 * 1024)
+	start := time.Now()
+	// Burst plus 512 KB of debt, which takes about half a second to pay back
+	b.Wait(minBurstBytes + 512*1024)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Wait returned too early: %s", elapsed)
+	}
+}
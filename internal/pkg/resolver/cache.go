@@ -0,0 +1,67 @@
+package resolver
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	host    string
+	addrs   []net.IPAddr
+	err     error // set for negative entries
+	expires time.Time
+}
+
+// cache is an LRU of lookup results, each expiring after its own TTL.
+type cache struct {
+	mutex   sync.Mutex
+	size    int
+	list    *list.List
+	entries map[string]*list.Element
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		list:    list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *cache) get(host string) (*cacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	el, ok := c.entries[host]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.list.Remove(el)
+		delete(c.entries, host)
+		return nil, false
+	}
+	c.list.MoveToFront(el)
+	return entry, true
+}
+
+func (c *cache) put(entry *cacheEntry) {
+	if c.size <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el, ok := c.entries[entry.host]; ok {
+		el.Value = entry
+		c.list.MoveToFront(el)
+		return
+	}
+	c.entries[entry.host] = c.list.PushFront(entry)
+	for c.list.Len() > c.size {
+		el := c.list.Back()
+		c.list.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).host)
+	}
+}
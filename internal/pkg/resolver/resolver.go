@@ -0,0 +1,290 @@
+// Package resolver resolves the destinations of client requests, with a cache in front of
+// configurable upstreams.
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xflash-panda/server-hysteria/internal/pkg/utils"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DefaultCacheSize   = 4096
+	DefaultNegativeTTL = 30 * time.Second
+
+	// systemTTL is how long answers of the system resolver are cached, it doesn't tell their TTL.
+	systemTTL = 60 * time.Second
+	// maxTTL caps the TTL of cached answers, whatever the upstream says.
+	maxTTL = 6 * time.Hour
+)
+
+type Config struct {
+	// Upstream is the default upstream, see NewUpstream, empty means the system resolver.
+	Upstream string `json:"upstream"`
+	// Rules send the domains under a suffix to their own upstream, e.g. "corp.example.com" -> "10.0.0.53".
+	Rules map[string]string `json:"rules"`
+	// Hosts are static entries, answered without asking anyone.
+	Hosts map[string][]string `json:"hosts"`
+	// CacheSize is the number of domains cached, 0 means DefaultCacheSize, negative disables the cache.
+	CacheSize int `json:"cache_size"`
+	// NegativeTTL is how long a domain without addresses is cached, 0 means DefaultNegativeTTL.
+	NegativeTTL utils.Duration `json:"negative_ttl"`
+}
+
+type rule struct {
+	suffix   string
+	upstream Upstream
+}
+
+// Resolver looks up the addresses of a domain, asking the hosts, the cache and then the upstream in turn.
+type Resolver struct {
+	upstream    Upstream // nil means the system resolver
+	rules       []rule
+	hosts       map[string][]net.IPAddr
+	cache       *cache
+	negativeTTL time.Duration
+
+	inflightMutex sync.Mutex
+	inflight      map[string]*call
+}
+
+// call is a lookup in progress, shared by everyone asking for the same domain meanwhile.
+type call struct {
+	done  chan struct{}
+	addrs []net.IPAddr
+	err   error
+}
+
+func New(config *Config) (*Resolver, error) {
+	r := &Resolver{
+		hosts:       make(map[string][]net.IPAddr),
+		negativeTTL: time.Duration(config.NegativeTTL),
+		inflight:    make(map[string]*call),
+	}
+	var err error
+	if config.Upstream != "" {
+		r.upstream, err = NewUpstream(config.Upstream)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for suffix, addr := range config.Rules {
+		up, err := NewUpstream(addr)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rule{suffix: normalize(suffix), upstream: up})
+	}
+	for host, ips := range config.Hosts {
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %s of host %s", s, host)
+			}
+			r.hosts[normalize(host)] = append(r.hosts[normalize(host)], net.IPAddr{IP: ip})
+		}
+	}
+	size := config.CacheSize
+	if size == 0 {
+		size = DefaultCacheSize
+	}
+	r.cache = newCache(size)
+	if r.negativeTTL == 0 {
+		r.negativeTTL = DefaultNegativeTTL
+	}
+	return r, nil
+}
+
+func normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// upstreamFor returns the upstream of the longest matching rule, or the default one.
+func (r *Resolver) upstreamFor(host string) Upstream {
+	up, matched := r.upstream, -1
+	for _, rl := range r.rules {
+		if (host == rl.suffix || strings.HasSuffix(host, "."+rl.suffix)) && len(rl.suffix) > matched {
+			up, matched = rl.upstream, len(rl.suffix)
+		}
+	}
+	return up
+}
+
+// LookupIPAddr returns the IPv4 and IPv6 addresses of the host, like net.Resolver.LookupIPAddr.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = normalize(host)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	if entry, ok := r.cache.get(host); ok {
+		return entry.addrs, entry.err
+	}
+
+	r.inflightMutex.Lock()
+	if c, ok := r.inflight[host]; ok {
+		r.inflightMutex.Unlock()
+		select {
+		case <-c.done:
+			return c.addrs, c.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c := &call{done: make(chan struct{})}
+	r.inflight[host] = c
+	r.inflightMutex.Unlock()
+
+	var ttl time.Duration
+	c.addrs, ttl, c.err = r.lookup(ctx, host)
+	if ttl > 0 {
+		r.cache.put(&cacheEntry{host: host, addrs: c.addrs, err: c.err, expires: time.Now().Add(ttl)})
+	}
+
+	r.inflightMutex.Lock()
+	delete(r.inflight, host)
+	r.inflightMutex.Unlock()
+	close(c.done)
+	return c.addrs, c.err
+}
+
+// lookup asks the upstream, the returned TTL is 0 if the result must not be cached.
+func (r *Resolver) lookup(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	up := r.upstreamFor(host)
+	if up == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, r.negativeTTL, err
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return addrs, systemTTL, nil
+	}
+
+	type result struct {
+		addrs []net.IPAddr
+		ttl   time.Duration
+		err   error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(qtype dnsmessage.Type) {
+			addrs, ttl, err := query(ctx, up, host, qtype)
+			results <- result{addrs, ttl, err}
+		}(qtype)
+	}
+	var addrs []net.IPAddr
+	var ttl time.Duration
+	var errs []error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+		addrs = append(addrs, res.addrs...)
+		if len(res.addrs) > 0 && (ttl == 0 || res.ttl < ttl) {
+			ttl = res.ttl
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, ttl, nil
+	}
+	if len(errs) > 0 {
+		// The failed query may have had the addresses, nothing to tell for sure, don't cache it
+		return nil, 0, &net.DNSError{Err: errs[0].Error(), Name: host, IsTemporary: true}
+	}
+	return nil, r.negativeTTL, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// query asks the upstream for one type of records. A domain that doesn't exist isn't an error,
+// it just has no addresses.
+func query(ctx context.Context, up Upstream, host string, qtype dnsmessage.Type) ([]net.IPAddr, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	var idBuf [2]byte
+	_, _ = rand.Read(idBuf[:])
+	id := binary.BigEndian.Uint16(idBuf[:])
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	q, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := up.Exchange(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.ID != id {
+		return nil, 0, errors.New("mismatched response id")
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, fmt.Errorf("upstream returned %s", header.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	var addrs []net.IPAddr
+	ttl := maxTTL
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			rr, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, net.IPAddr{IP: net.IP(rr.A[:])})
+		case dnsmessage.TypeAAAA:
+			rr, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, net.IPAddr{IP: net.IP(rr.AAAA[:])})
+		default:
+			// CNAMEs and such, the addresses they lead to are in the answer as well
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if t := time.Duration(h.TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	return addrs, ttl, nil
+}
@@ -0,0 +1,164 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeUpstream answers from a table of A records, counting the queries. With failAAAA set the AAAA queries fail.
+type fakeUpstream struct {
+	records  map[string]string
+	failAAAA bool
+	queries  int32
+}
+
+func (u *fakeUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	atomic.AddInt32(&u.queries, 1)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	q := msg.Questions[0]
+	if u.failAAAA && q.Type == dnsmessage.TypeAAAA {
+		return nil, errors.New("timeout")
+	}
+	msg.Header.Response = true
+	ip, ok := u.records[q.Name.String()]
+	if !ok {
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	} else if q.Type == dnsmessage.TypeA {
+		var a [4]byte
+		copy(a[:], net.ParseIP(ip).To4())
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: a},
+		}}
+	}
+	return msg.Pack()
+}
+
+func newTestResolver(t *testing.T, ups map[string]*fakeUpstream) *Resolver {
+	r, err := New(&Config{
+		Hosts: map[string][]string{"static.example.com": {"192.0.2.1", "2001:db8::1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.upstream = ups[""]
+	for suffix, up := range ups {
+		if suffix != "" {
+			r.rules = append(r.rules, rule{suffix: suffix, upstream: up})
+		}
+	}
+	return r
+}
+
+func TestResolver_Cache(t *testing.T) {
+	up := &fakeUpstream{records: map[string]string{"example.com.": "93.184.216.34"}}
+	r := newTestResolver(t, map[string]*fakeUpstream{"": up})
+	for i := 0; i < 3; i++ {
+		addrs, err := r.LookupIPAddr(context.Background(), "Example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0].String() != "93.184.216.34" {
+			t.Fatalf("got %v", addrs)
+		}
+	}
+	// A and AAAA, once
+	if q := atomic.LoadInt32(&up.queries); q != 2 {
+		t.Errorf("got %d queries, want 2", q)
+	}
+}
+
+func TestResolver_NegativeCache(t *testing.T) {
+	up := &fakeUpstream{}
+	r := newTestResolver(t, map[string]*fakeUpstream{"": up})
+	for i := 0; i < 3; i++ {
+		_, err := r.LookupIPAddr(context.Background(), "nonexistent.example.com")
+		dnsErr, ok := err.(*net.DNSError)
+		if !ok || !dnsErr.IsNotFound {
+			t.Fatalf("got %v, want not found", err)
+		}
+	}
+	if q := atomic.LoadInt32(&up.queries); q != 2 {
+		t.Errorf("got %d queries, want 2", q)
+	}
+}
+
+func TestResolver_NoNegativeCacheOnError(t *testing.T) {
+	up := &fakeUpstream{failAAAA: true}
+	r := newTestResolver(t, map[string]*fakeUpstream{"": up})
+	for i := 0; i < 3; i++ {
+		_, err := r.LookupIPAddr(context.Background(), "nonexistent.example.com")
+		dnsErr, ok := err.(*net.DNSError)
+		if !ok || !dnsErr.IsTemporary || dnsErr.IsNotFound {
+			t.Fatalf("got %v, want a temporary error", err)
+		}
+	}
+	// The AAAA query failed, so every lookup asks again
+	if q := atomic.LoadInt32(&up.queries); q != 6 {
+		t.Errorf("got %d queries, want 6", q)
+	}
+}
+
+func TestResolver_HostsAndRules(t *testing.T) {
+	def := &fakeUpstream{records: map[string]string{"www.corp.example.com.": "203.0.113.1"}}
+	corp := &fakeUpstream{records: map[string]string{"www.corp.example.com.": "10.0.0.1"}}
+	dev := &fakeUpstream{records: map[string]string{"www.dev.corp.example.com.": "10.1.0.1"}}
+	r := newTestResolver(t, map[string]*fakeUpstream{"": def, "corp.example.com": corp, "dev.corp.example.com": dev})
+	tests := map[string]string{
+		"static.example.com":       "192.0.2.1",
+		"www.corp.example.com":     "10.0.0.1",
+		"www.dev.corp.example.com": "10.1.0.1",
+		"198.51.100.1":             "198.51.100.1",
+	}
+	for host, want := range tests {
+		addrs, err := r.LookupIPAddr(context.Background(), host)
+		if err != nil {
+			t.Fatalf("%s: %s", host, err)
+		}
+		if addrs[0].String() != want {
+			t.Errorf("%s: got %s, want %s", host, addrs[0].String(), want)
+		}
+	}
+	if q := atomic.LoadInt32(&def.queries); q != 0 {
+		t.Errorf("default upstream got %d queries, want 0", q)
+	}
+}
+
+func TestUDPUpstream(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	up := &fakeUpstream{records: map[string]string{"example.com.": "93.184.216.34"}}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp, _ := up.Exchange(context.Background(), buf[:n])
+			_, _ = pc.WriteTo(resp, addr)
+		}
+	}()
+	r, err := New(&Config{Upstream: "udp://" + pc.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := r.LookupIPAddr(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "93.184.216.34" {
+		t.Fatalf("got %v", addrs)
+	}
+}
@@ -0,0 +1,167 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	upstreamTimeout = 5 * time.Second
+	maxMessageSize  = 65535
+)
+
+// Upstream exchanges a DNS query for a response, both in wire format.
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// NewUpstream creates an upstream from an address:
+//
+//	1.1.1.1, udp://1.1.1.1:53        plain DNS over UDP, falling back to TCP for truncated responses
+//	tcp://1.1.1.1:53                 plain DNS over TCP
+//	tls://1.1.1.1:853                DNS over TLS
+//	https://1.1.1.1/dns-query        DNS over HTTPS
+func NewUpstream(addr string) (Upstream, error) {
+	if net.ParseIP(addr) != nil {
+		return &udpUpstream{addr: net.JoinHostPort(addr, "53")}, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{addr: withPort(u.Host, "53")}, nil
+	case "tcp":
+		return &tcpUpstream{addr: withPort(u.Host, "53")}, nil
+	case "tls":
+		return &tcpUpstream{addr: withPort(u.Host, "853"), tlsConfig: &tls.Config{ServerName: u.Hostname()}}, nil
+	case "https":
+		return &httpsUpstream{url: u.String(), client: &http.Client{Timeout: upstreamTimeout}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream %s", addr)
+	}
+}
+
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+type udpUpstream struct {
+	addr string
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore anything not answering our query, it could be a late response to an earlier one
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue
+		}
+		if buf[2]&0x02 != 0 {
+			// Truncated, ask again over TCP
+			return (&tcpUpstream{addr: u.addr}).Exchange(ctx, query)
+		}
+		return buf[:n], nil
+	}
+}
+
+type tcpUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+}
+
+func (u *tcpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	var conn net.Conn
+	var err error
+	if u.tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: &d, Config: u.tlsConfig}).DialContext(ctx, "tcp", u.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", u.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var l uint16
+	if err := binary.Read(conn, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, l)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 12 {
+		return nil, errors.New("short response")
+	}
+	return body, nil
+}
+
+func setDeadline(ctx context.Context, conn net.Conn) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(upstreamTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+}
@@ -21,3 +21,47 @@ func BindUDPConn(network string, conn *net.UDPConn, intf *net.Interface) error {
 
 	return bindRawConn(network, c, intf)
 }
+
+// UDPOffload tells what a UDP socket does beyond one datagram per syscall.
+type UDPOffload struct {
+	// GSO is whether sends of the socket are segmented by the kernel, GRO whether it coalesces received packets.
+	GSO, GRO bool
+	// ReadBuffer and WriteBuffer are the socket buffer sizes as the kernel reports them.
+	ReadBuffer, WriteBuffer int
+}
+
+// SetUDPBuffers sets the receive and send buffers of the socket, past the system limits
+// where the process is allowed to.
+func SetUDPBuffers(conn *net.UDPConn, size int) error {
+	c, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if forceBuffers(c, size) == nil {
+		return nil
+	}
+	if err := conn.SetReadBuffer(size); err != nil {
+		return err
+	}
+	return conn.SetWriteBuffer(size)
+}
+
+// ProbeUDPOffload finds out the offloads of the socket: whether the kernel segments its sends if asked to
+// with AppendUDPSegment, whether GRO is on and the buffer sizes. The socket itself is left as it is.
+func ProbeUDPOffload(conn *net.UDPConn) UDPOffload {
+	c, err := conn.SyscallConn()
+	if err != nil {
+		return UDPOffload{}
+	}
+	return probeUDPOffload(c)
+}
+
+// EnableUDPGRO has the kernel coalesce the packets of a flow into a single read, which tells the size
+// of the packets in a control message, see UDPGROSize.
+func EnableUDPGRO(conn *net.UDPConn) error {
+	c, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return enableGRO(c)
+}
@@ -3,6 +3,7 @@ package sockopt
 import (
 	"net"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -20,3 +21,73 @@ func bindRawConn(network string, c syscall.RawConn, bindIface *net.Interface) er
 		return err2
 	}
 }
+
+func forceBuffers(c syscall.RawConn, size int) error {
+	var err1, err2 error
+	err1 = c.Control(func(fd uintptr) {
+		err2 = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, size)
+		if err2 == nil {
+			err2 = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, size)
+		}
+	})
+	if err1 != nil {
+		return err1
+	} else {
+		return err2
+	}
+}
+
+func probeUDPOffload(c syscall.RawConn) UDPOffload {
+	var o UDPOffload
+	_ = c.Control(func(fd uintptr) {
+		o.ReadBuffer, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		o.WriteBuffer, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+		// Reading the option only works where the kernel knows it
+		_, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+		o.GSO = err == nil
+		gro, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO)
+		o.GRO = err == nil && gro == 1
+	})
+	return o
+}
+
+func enableGRO(c syscall.RawConn) error {
+	var err1, err2 error
+	err1 = c.Control(func(fd uintptr) {
+		err2 = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1)
+	})
+	if err1 != nil {
+		return err1
+	} else {
+		return err2
+	}
+}
+
+// AppendUDPSegment appends the control message that has the kernel split a send into packets of size bytes,
+// the last one may be shorter.
+func AppendUDPSegment(oob []byte, size uint16) []byte {
+	start := len(oob)
+	oob = append(oob, make([]byte, unix.CmsgSpace(2))...)
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[start]))
+	h.Level = unix.SOL_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[start+unix.CmsgLen(0)])) = size
+	return oob
+}
+
+// UDPGROSize returns the size of the packets a read coalesced, 0 if it's a single packet.
+func UDPGROSize(oob []byte) int {
+	for len(oob) > 0 {
+		h, data, rest, err := unix.ParseOneSocketControlMessage(oob)
+		if err != nil {
+			return 0
+		}
+		if h.Level == unix.SOL_UDP && h.Type == unix.UDP_GRO && len(data) >= 2 {
+			// The kernel puts an int, of which only the low 16 bits are used
+			return int(*(*uint16)(unsafe.Pointer(&data[0])))
+		}
+		oob = rest
+	}
+	return 0
+}
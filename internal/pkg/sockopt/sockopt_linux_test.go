@@ -0,0 +1,41 @@
+package sockopt
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSetUDPBuffers(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	before := ProbeUDPOffload(conn)
+	if err := SetUDPBuffers(conn, 4*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	after := ProbeUDPOffload(conn)
+	// The kernel doubles the size, capped by the system limits unless forced
+	if after.ReadBuffer < before.ReadBuffer || after.WriteBuffer < before.WriteBuffer {
+		t.Errorf("buffers shrank from %+v to %+v", before, after)
+	}
+	t.Logf("offloads: %+v", after)
+}
+
+func TestEnableUDPGRO(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ProbeUDPOffload(conn).GRO {
+		t.Error("GRO on before it was enabled")
+	}
+	if err := EnableUDPGRO(conn); err != nil {
+		t.Skipf("no UDP GRO here: %s", err)
+	}
+	if !ProbeUDPOffload(conn).GRO {
+		t.Error("GRO off after it was enabled")
+	}
+}
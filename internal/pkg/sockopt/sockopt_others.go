@@ -11,3 +11,24 @@ import (
 func bindRawConn(network string, c syscall.RawConn, bindIface *net.Interface) error {
 	return errors.New("binding interface is not supported on the current system")
 }
+
+func forceBuffers(c syscall.RawConn, size int) error {
+	return errors.New("forcing buffer sizes is not supported on the current system")
+}
+
+func probeUDPOffload(c syscall.RawConn) UDPOffload {
+	return UDPOffload{}
+}
+
+func enableGRO(c syscall.RawConn) error {
+	return errors.New("UDP GRO is not supported on the current system")
+}
+
+// AppendUDPSegment is only supported on Linux, ProbeUDPOffload never reports GSO elsewhere.
+func AppendUDPSegment(oob []byte, size uint16) []byte {
+	return oob
+}
+
+func UDPGROSize(oob []byte) int {
+	return 0
+}
@@ -18,7 +18,7 @@ var DefaultClientTransport = &ClientTransport{
 }
 
 func (ct *ClientTransport) ResolveIPAddr(address string) (*net.IPAddr, error) {
-	return resolveIPAddrWithPreference(address, ct.ResolvePreference)
+	return resolveIPAddrWithPreference(nil, address, ct.ResolvePreference)
 }
 
 func (ct *ClientTransport) DialTCP(raddr *net.TCPAddr) (*net.TCPConn, error) {
@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var ErrDestinationBlocked = errors.New("destination not allowed")
+
+// privateCIDRs are never reachable through the node unless allowed explicitly:
+// "this" network, RFC1918, CGNAT, loopback, link-local (cloud metadata lives there),
+// multicast and broadcast, plus their IPv6 counterparts.
+var privateCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// Guard refuses destinations in the private ranges and the extra blocked CIDRs,
+// unless they are in the allowed CIDRs.
+type Guard struct {
+	block []*net.IPNet
+	allow []*net.IPNet
+}
+
+// NewGuard returns a guard blocking the private ranges plus blockCIDRs, with allowCIDRs taking precedence.
+func NewGuard(blockCIDRs, allowCIDRs []string) (*Guard, error) {
+	block, err := parseCIDRs(append(privateCIDRs[:len(privateCIDRs):len(privateCIDRs)], blockCIDRs...))
+	if err != nil {
+		return nil, err
+	}
+	allow, err := parseCIDRs(allowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return &Guard{block: block, allow: allow}, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s", s)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Check returns ErrDestinationBlocked if the address must not be reached.
+func (g *Guard) Check(ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		// IPv4-mapped IPv6 addresses count as what they map to
+		ip = ip4
+	}
+	for _, n := range g.allow {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	for _, n := range g.block {
+		if n.Contains(ip) {
+			return fmt.Errorf("%w: %s", ErrDestinationBlocked, ip)
+		}
+	}
+	return nil
+}
+
+type guardedSTPacketConn struct {
+	STPacketConn
+	transport *ServerTransport
+	outbound  Outbound
+}
+
+func (c *guardedSTPacketConn) WriteTo(bytes []byte, ex *AddrEx) (int, error) {
+	ex, err := c.transport.prepareAddrEx(ex, c.outbound)
+	if err != nil {
+		return 0, err
+	}
+	return c.STPacketConn.WriteTo(bytes, ex)
+}
@@ -0,0 +1,111 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestGuard_Check(t *testing.T) {
+	g, err := NewGuard([]string{"203.0.113.0/24"}, []string{"10.8.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"1.1.1.1", false},
+		{"127.0.0.1", true},
+		{"10.0.0.1", true},
+		{"10.8.1.1", false},
+		{"172.20.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"224.0.0.251", true},
+		{"203.0.113.7", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"2606:4700:4700::1111", false},
+	}
+	for _, tt := range tests {
+		err := g.Check(net.ParseIP(tt.ip))
+		if blocked := errors.Is(err, ErrDestinationBlocked); blocked != tt.blocked {
+			t.Errorf("%s: got blocked=%v, want %v", tt.ip, blocked, tt.blocked)
+		}
+	}
+}
+
+func TestPrepareAddrEx(t *testing.T) {
+	proxy := &SOCKS5Client{}
+	direct := &DirectOutbound{}
+	tests := []struct {
+		name     string
+		resolver staticResolver
+		outbound Outbound
+		blocked  bool
+		want     string // domain kept for the proxy, or the first IP to dial
+		matched  string // address the ACL matched, it's dialed instead of resolving the domain again
+	}{
+		{"proxy public", staticResolver{"192.0.2.1"}, proxy, false, "example.com", ""},
+		{"proxy loopback", staticResolver{"127.0.0.1"}, proxy, true, "", ""},
+		{"proxy partly private", staticResolver{"192.0.2.1", "10.0.0.1"}, proxy, true, "", ""},
+		{"proxy unguarded", staticResolver{"127.0.0.1"}, &unguardedOutbound{proxy}, false, "example.com", ""},
+		{"direct partly private", staticResolver{"10.0.0.1", "192.0.2.1"}, direct, false, "192.0.2.1", ""},
+		{"direct private", staticResolver{"10.0.0.1"}, direct, true, "", ""},
+		{"direct matched", staticResolver{"192.0.2.1"}, direct, false, "192.0.2.2", "192.0.2.2"},
+		{"direct matched private", staticResolver{"192.0.2.1"}, direct, true, "", "10.0.0.1"},
+		{"proxy matched", staticResolver{"10.0.0.1"}, proxy, true, "", "192.0.2.2"},
+	}
+	for _, tt := range tests {
+		st := &ServerTransport{Resolver: tt.resolver, Guard: mustNewGuard(nil, nil)}
+		addrEx := &AddrEx{Domain: "example.com", Port: 80}
+		if tt.matched != "" {
+			addrEx.IPAddrs = []net.IPAddr{{IP: net.ParseIP(tt.matched)}}
+		}
+		addr, err := st.prepareAddrEx(addrEx, tt.outbound)
+		if blocked := errors.Is(err, ErrDestinationBlocked); blocked != tt.blocked {
+			t.Errorf("%s: got %v, want blocked=%v", tt.name, err, tt.blocked)
+			continue
+		}
+		if tt.blocked {
+			continue
+		}
+		got := addr.Domain
+		if got == "" {
+			got = addr.IPAddr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrepareAddrExHijacked(t *testing.T) {
+	st := &ServerTransport{Resolver: staticResolver{"10.0.0.53"}, Guard: mustNewGuard(nil, nil)}
+	tests := []struct {
+		name string
+		addr AddrEx
+		want string
+	}{
+		{"loopback", AddrEx{IPAddr: &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, Port: 53}, "127.0.0.1"},
+		{"private domain", AddrEx{Domain: "dns.internal", Port: 53}, "10.0.0.53"},
+	}
+	for _, tt := range tests {
+		addr := tt.addr
+		if _, err := st.prepareAddrEx(&addr, &DirectOutbound{}); !errors.Is(err, ErrDestinationBlocked) {
+			t.Errorf("%s: got %v, want blocked from users", tt.name, err)
+		}
+		addr.Hijacked = true
+		got, err := st.prepareAddrEx(&addr, &DirectOutbound{})
+		if err != nil {
+			t.Errorf("%s: got %v, want allowed when hijacked", tt.name, err)
+			continue
+		}
+		if got.IPAddr.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got.IPAddr, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// HTTPClient is an outbound through an HTTP proxy supporting CONNECT, it carries TCP only.
+type HTTPClient struct {
+	ServerTCPAddr *net.TCPAddr
+	Username      string
+	Password      string
+	NegTimeout    time.Duration
+}
+
+func NewHTTPClient(serverAddr string, username string, password string, negTimeout time.Duration) (*HTTPClient, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPClient{
+		ServerTCPAddr: tcpAddr,
+		Username:      username,
+		Password:      password,
+		NegTimeout:    negTimeout,
+	}, nil
+}
+
+func (c *HTTPClient) DialTCP(raddr *AddrEx) (*net.TCPConn, error) {
+	conn, err := dialProxy(c.ServerTCPAddr, c.NegTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(c.NegTimeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	host := raddr.Domain
+	if host == "" {
+		host = raddr.IPAddr.String()
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(raddr.Port))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("request failed: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The destination can't have said anything yet, and we are handing out the raw conn
+		_ = conn.Close()
+		return nil, errors.New("unexpected data after the CONNECT response")
+	}
+	// Negotiation succeed, disable timeout
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *HTTPClient) ListenUDP() (STPacketConn, error) {
+	return nil, errors.New("UDP is not supported by HTTP proxies")
+}
+
+func (c *HTTPClient) ProxyEnabled() bool {
+	return true
+}
@@ -0,0 +1,48 @@
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	// Nothing listens on the same port of 127.0.0.2, the first attempt is refused
+	dialer := &net.Dialer{Timeout: time.Second}
+	conn, err := dialHappyEyeballs(dialer, []net.IPAddr{
+		{IP: net.ParseIP("127.0.0.2")},
+		{IP: net.ParseIP("127.0.0.1")},
+	}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("connected to %s, want 127.0.0.1", got)
+	}
+
+	_ = ln.Close()
+	if _, err := dialHappyEyeballs(dialer, []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("127.0.0.2")}}, port); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestParseOutboundSkipGuard(t *testing.T) {
+	ob, err := ParseOutbound("socks5://127.0.0.1:1080")
+	if err != nil || skipsGuard(ob) {
+		t.Errorf("got %v, %v", ob, err)
+	}
+	ob, err = ParseOutbound("socks5://127.0.0.1:1080?skip_guard=true")
+	if err != nil || !skipsGuard(ob) || !ob.ProxyEnabled() {
+		t.Errorf("got %v, %v", ob, err)
+	}
+	if _, err := ParseOutbound("http://127.0.0.1:8080?skip_guard=maybe"); err == nil {
+		t.Error("invalid skip_guard accepted")
+	}
+}
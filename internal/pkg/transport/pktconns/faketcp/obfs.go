@@ -2,44 +2,33 @@ package faketcp
 
 import (
 	"net"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/xflash-panda/server-hysteria/internal/pkg/transport/pktconns/obfs"
 )
 
-const udpBufferSize = 4096
-
 type ObfsFakeTCPPacketConn struct {
 	orig *TCPConn
 	obfs obfs.Obfuscator
-
-	readBuf    []byte
-	readMutex  sync.Mutex
-	writeBuf   []byte
-	writeMutex sync.Mutex
 }
 
 func NewObfsFakeTCPConn(orig *TCPConn, obfs obfs.Obfuscator) *ObfsFakeTCPPacketConn {
 	return &ObfsFakeTCPPacketConn{
-		orig:     orig,
-		obfs:     obfs,
-		readBuf:  make([]byte, udpBufferSize),
-		writeBuf: make([]byte, udpBufferSize),
+		orig: orig,
+		obfs: obfs,
 	}
 }
 
 func (c *ObfsFakeTCPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := obfs.GetBuffer()
+	defer obfs.PutBuffer(buf)
 	for {
-		c.readMutex.Lock()
-		n, addr, err := c.orig.ReadFrom(c.readBuf)
+		n, addr, err := c.orig.ReadFrom(*buf)
 		if n <= 0 {
-			c.readMutex.Unlock()
 			return 0, addr, err
 		}
-		newN := c.obfs.Deobfuscate(c.readBuf[:n], p)
-		c.readMutex.Unlock()
+		newN := c.obfs.Deobfuscate((*buf)[:n], p)
 		if newN > 0 {
 			// Valid packet
 			return newN, addr, err
@@ -51,10 +40,10 @@ func (c *ObfsFakeTCPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 }
 
 func (c *ObfsFakeTCPPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	c.writeMutex.Lock()
-	bn := c.obfs.Obfuscate(p, c.writeBuf)
-	_, err = c.orig.WriteTo(c.writeBuf[:bn], addr)
-	c.writeMutex.Unlock()
+	buf := obfs.GetBuffer()
+	bn := c.obfs.Obfuscate(p, *buf)
+	_, err = c.orig.WriteTo((*buf)[:bn], addr)
+	obfs.PutBuffer(buf)
 	if err != nil {
 		return 0, err
 	} else {
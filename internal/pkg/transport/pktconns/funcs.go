@@ -3,12 +3,17 @@ package pktconns
 import (
 	"net"
 
+	"github.com/xflash-panda/server-hysteria/internal/pkg/sockopt"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/transport/pktconns/faketcp"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/transport/pktconns/obfs"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/transport/pktconns/udp"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/transport/pktconns/wechat"
 )
 
+// DefaultUDPBufferSize is the default size of the receive and send buffers of UDP listeners,
+// room for a few thousand full-size packets.
+const DefaultUDPBufferSize = 16 * 1024 * 1024
+
 type (
 	ClientPacketConnFunc func(server string) (net.PacketConn, net.Addr, error)
 	ServerPacketConnFunc func(listen string) (net.PacketConn, error)
@@ -16,26 +21,27 @@ type (
 
 type (
 	ClientPacketConnFuncFactory func(obfsPassword string) ClientPacketConnFunc
-	ServerPacketConnFuncFactory func(obfsPassword string) ServerPacketConnFunc
+	// ServerPacketConnFuncFactory makes the listen func of a protocol. udpBuffer is the size of the receive
+	// and send buffers of UDP sockets, 0 leaves them to QUIC, which asks for a few MB.
+	ServerPacketConnFuncFactory func(obfsPassword string, udpBuffer int) ServerPacketConnFunc
 )
 
-func NewServerUDPConnFunc(obfsPassword string) ServerPacketConnFunc {
+func NewServerUDPConnFunc(obfsPassword string, udpBuffer int) ServerPacketConnFunc {
 	if obfsPassword == "" {
 		return func(listen string) (net.PacketConn, error) {
-			laddrU, err := net.ResolveUDPAddr("udp", listen)
+			udpConn, err := listenUDP(listen, udpBuffer)
 			if err != nil {
 				return nil, err
 			}
-			return net.ListenUDP("udp", laddrU)
+			return udp.NewUDPConn(udpConn), nil
 		}
 	} else {
 		return func(listen string) (net.PacketConn, error) {
-			ob := obfs.NewXPlusObfuscator([]byte(obfsPassword))
-			laddrU, err := net.ResolveUDPAddr("udp", listen)
+			ob, err := obfs.NewObfuscator(obfsPassword)
 			if err != nil {
 				return nil, err
 			}
-			udpConn, err := net.ListenUDP("udp", laddrU)
+			udpConn, err := listenUDP(listen, udpBuffer)
 			if err != nil {
 				return nil, err
 			}
@@ -44,14 +50,10 @@ func NewServerUDPConnFunc(obfsPassword string) ServerPacketConnFunc {
 	}
 }
 
-func NewServerWeChatConnFunc(obfsPassword string) ServerPacketConnFunc {
+func NewServerWeChatConnFunc(obfsPassword string, udpBuffer int) ServerPacketConnFunc {
 	if obfsPassword == "" {
 		return func(listen string) (net.PacketConn, error) {
-			laddrU, err := net.ResolveUDPAddr("udp", listen)
-			if err != nil {
-				return nil, err
-			}
-			udpConn, err := net.ListenUDP("udp", laddrU)
+			udpConn, err := listenUDP(listen, udpBuffer)
 			if err != nil {
 				return nil, err
 			}
@@ -59,12 +61,11 @@ func NewServerWeChatConnFunc(obfsPassword string) ServerPacketConnFunc {
 		}
 	} else {
 		return func(listen string) (net.PacketConn, error) {
-			ob := obfs.NewXPlusObfuscator([]byte(obfsPassword))
-			laddrU, err := net.ResolveUDPAddr("udp", listen)
+			ob, err := obfs.NewObfuscator(obfsPassword)
 			if err != nil {
 				return nil, err
 			}
-			udpConn, err := net.ListenUDP("udp", laddrU)
+			udpConn, err := listenUDP(listen, udpBuffer)
 			if err != nil {
 				return nil, err
 			}
@@ -73,14 +74,17 @@ func NewServerWeChatConnFunc(obfsPassword string) ServerPacketConnFunc {
 	}
 }
 
-func NewServerFakeTCPConnFunc(obfsPassword string) ServerPacketConnFunc {
+func NewServerFakeTCPConnFunc(obfsPassword string, udpBuffer int) ServerPacketConnFunc {
 	if obfsPassword == "" {
 		return func(listen string) (net.PacketConn, error) {
 			return faketcp.Listen("tcp", listen)
 		}
 	} else {
 		return func(listen string) (net.PacketConn, error) {
-			ob := obfs.NewXPlusObfuscator([]byte(obfsPassword))
+			ob, err := obfs.NewObfuscator(obfsPassword)
+			if err != nil {
+				return nil, err
+			}
 			fakeTCPListener, err := faketcp.Listen("tcp", listen)
 			if err != nil {
 				return nil, err
@@ -89,3 +93,19 @@ func NewServerFakeTCPConnFunc(obfsPassword string) ServerPacketConnFunc {
 		}
 	}
 }
+
+func listenUDP(listen string, bufferSize int) (*net.UDPConn, error) {
+	laddrU, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", laddrU)
+	if err != nil {
+		return nil, err
+	}
+	if bufferSize > 0 {
+		// Not fatal, the system limits might just be lower
+		_ = sockopt.SetUDPBuffers(udpConn, bufferSize)
+	}
+	return udpConn, nil
+}
@@ -0,0 +1,23 @@
+package pktconns
+
+import (
+	"testing"
+
+	"github.com/xflash-panda/server-hysteria/internal/pkg/transport/pktconns/udp"
+)
+
+func TestNewServerUDPConnFuncBuffer(t *testing.T) {
+	// Each listener gets the buffer size it was made with
+	readBuffer := func(size int) int {
+		conn, err := NewServerUDPConnFunc("", size)("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.(*udp.UDPConn).Offload().ReadBuffer
+	}
+	small, large := readBuffer(64*1024), readBuffer(128*1024)
+	if small <= 0 || large <= small {
+		t.Errorf("read buffers %d and %d, want the second larger", small, large)
+	}
+}
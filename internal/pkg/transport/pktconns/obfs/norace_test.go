@@ -0,0 +1,5 @@
+//go:build !race
+
+package obfs
+
+const raceEnabled = false
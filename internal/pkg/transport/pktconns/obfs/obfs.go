@@ -2,9 +2,9 @@ package obfs
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
 	"math/rand"
-	"sync"
-	"time"
 )
 
 type Obfuscator interface {
@@ -16,17 +16,17 @@ const xpSaltLen = 16
 
 // XPlusObfuscator obfuscates payload using one-time keys generated from hashing a pre-shared key and random salt.
 // Packet format: [salt][obfuscated payload]
+// It's safe for concurrent use and doesn't allocate.
 type XPlusObfuscator struct {
-	Key     []byte
-	RandSrc *rand.Rand
+	Key []byte
 
-	lk sync.Mutex
+	hasher *keyHasher
 }
 
 func NewXPlusObfuscator(key []byte) *XPlusObfuscator {
 	return &XPlusObfuscator{
-		Key:     key,
-		RandSrc: rand.New(rand.NewSource(time.Now().UnixNano())),
+		Key:    key,
+		hasher: newKeyHasher(sha256.New, key),
 	}
 }
 
@@ -35,10 +35,9 @@ func (x *XPlusObfuscator) Deobfuscate(in []byte, out []byte) int {
 	if outLen <= 0 || len(out) < outLen {
 		return 0
 	}
-	key := sha256.Sum256(append(x.Key, in[:xpSaltLen]...))
-	for i, c := range in[xpSaltLen:] {
-		out[i] = c ^ key[i%sha256.Size]
-	}
+	key := x.hasher.hash(in[:xpSaltLen])
+	xorKey(out, in[xpSaltLen:], key.Sum[:sha256.Size])
+	x.hasher.put(key)
 	return outLen
 }
 
@@ -47,12 +46,18 @@ func (x *XPlusObfuscator) Obfuscate(in []byte, out []byte) int {
 	if len(out) < outLen {
 		return 0
 	}
-	x.lk.Lock()
-	_, _ = x.RandSrc.Read(out[:xpSaltLen])
-	x.lk.Unlock()
-	key := sha256.Sum256(append(x.Key, out[:xpSaltLen]...))
-	for i, c := range in {
-		out[i+xpSaltLen] = c ^ key[i%sha256.Size]
-	}
+	// The global source is lock free since Go 1.20, and the salt needn't be unpredictable
+	binary.LittleEndian.PutUint64(out, rand.Uint64())
+	binary.LittleEndian.PutUint64(out[8:], rand.Uint64())
+	key := x.hasher.hash(out[:xpSaltLen])
+	xorKey(out[xpSaltLen:], in, key.Sum[:sha256.Size])
+	x.hasher.put(key)
 	return outLen
 }
+
+// xorKey XORs in with the key repeated into out, a whole key at a time, taking the same time whatever the data.
+func xorKey(out, in, key []byte) {
+	for i := 0; i < len(in); i += len(key) {
+		subtle.XORBytes(out[i:], in[i:], key)
+	}
+}
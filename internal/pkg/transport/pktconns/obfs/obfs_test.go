@@ -2,7 +2,10 @@ package obfs
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
+
+	"golang.org/x/crypto/blake2b"
 )
 
 func TestXPlusObfuscator(t *testing.T) {
@@ -29,3 +32,105 @@ func TestXPlusObfuscator(t *testing.T) {
 		})
 	}
 }
+
+func TestSalamanderObfuscator(t *testing.T) {
+	o, err := NewSalamanderObfuscator([]byte("Vaundy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		p    []byte
+	}{
+		{name: "1", p: []byte("HelloWorld")},
+		{name: "2", p: []byte("Regret is just a horrible attempt at time travel that ends with you feeling like crap")},
+		{name: "3", p: bytes.Repeat([]byte("0123456789abcdef"), 80)},
+		{name: "empty", p: []byte("")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, 10240)
+			n := o.Obfuscate(tt.p, buf)
+			if n != len(tt.p)+smSaltLen {
+				t.Fatalf("Obfuscated length %d, want %d", n, len(tt.p)+smSaltLen)
+			}
+			// The format Hysteria 2 clients expect
+			key := blake2b.Sum256(append([]byte("Vaundy"), buf[:smSaltLen]...))
+			for i, c := range tt.p {
+				if buf[smSaltLen+i] != c^key[i%smKeyLen] {
+					t.Fatalf("Byte %d not XORed with the BLAKE2b key", i)
+				}
+			}
+			n2 := o.Deobfuscate(buf[:n], buf[n:])
+			if !bytes.Equal(tt.p, buf[n:n+n2]) {
+				t.Errorf("Inconsistent deobfuscate result: got %v, want %v", buf[n:n+n2], tt.p)
+			}
+		})
+	}
+	if _, err := NewSalamanderObfuscator([]byte("abc")); err == nil {
+		t.Error("Short password accepted")
+	}
+}
+
+func TestNewObfuscator(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{config: "Vaundy", want: "*obfs.XPlusObfuscator"},
+		{config: "xplus:Vaundy", want: "*obfs.XPlusObfuscator"},
+		{config: "salamander:Vaundy", want: "*obfs.SalamanderObfuscator"},
+		{config: "other:Vaundy", want: "*obfs.XPlusObfuscator"},
+	}
+	for _, tt := range tests {
+		o, err := NewObfuscator(tt.config)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.config, err)
+		}
+		if got := fmt.Sprintf("%T", o); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestObfuscatorAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are off under the race detector")
+	}
+	sm, _ := NewSalamanderObfuscator([]byte("Vaundy"))
+	for _, o := range []Obfuscator{NewXPlusObfuscator([]byte("Vaundy")), sm} {
+		p := bytes.Repeat([]byte("a"), 1200)
+		buf := make([]byte, 2048)
+		out := make([]byte, 2048)
+		allocs := testing.AllocsPerRun(100, func() {
+			n := o.Obfuscate(p, buf)
+			o.Deobfuscate(buf[:n], out)
+		})
+		if allocs != 0 {
+			t.Errorf("%T: %v allocations per packet", o, allocs)
+		}
+	}
+}
+
+func BenchmarkXPlusObfuscator(b *testing.B) {
+	benchmarkObfuscator(b, NewXPlusObfuscator([]byte("Vaundy")))
+}
+
+func BenchmarkSalamanderObfuscator(b *testing.B) {
+	o, _ := NewSalamanderObfuscator([]byte("Vaundy"))
+	benchmarkObfuscator(b, o)
+}
+
+func benchmarkObfuscator(b *testing.B, o Obfuscator) {
+	p := bytes.Repeat([]byte("a"), 1200)
+	b.SetBytes(int64(len(p)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 2048)
+		out := make([]byte, 2048)
+		for pb.Next() {
+			n := o.Obfuscate(p, buf)
+			o.Deobfuscate(buf[:n], out)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package obfs
+
+import (
+	"encoding"
+	"hash"
+	"sync"
+)
+
+// BufferSize is big enough for any packet a packet conn reads or writes.
+const BufferSize = 4096
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, BufferSize)
+		return &b
+	},
+}
+
+// GetBuffer returns a packet buffer of BufferSize, give it back with PutBuffer when done.
+func GetBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func PutBuffer(b *[]byte) {
+	bufferPool.Put(b)
+}
+
+// keyHasher hashes the pre-shared key followed by a salt without allocating. The state after
+// hashing the key is computed once, every salt starts from a copy of it in a pooled hash.
+type keyHasher struct {
+	state []byte
+	pool  sync.Pool
+}
+
+// keyHash is a pooled hash along with the room for its sum.
+type keyHash struct {
+	h   hash.Hash
+	Sum [64]byte
+}
+
+// newKeyHasher creates a keyHasher, newHash must return a hash that implements encoding.BinaryMarshaler
+// and encoding.BinaryUnmarshaler, like the ones of the standard library do.
+func newKeyHasher(newHash func() hash.Hash, key []byte) *keyHasher {
+	h := newHash()
+	_, _ = h.Write(key)
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	kh := &keyHasher{state: state}
+	kh.pool.New = func() any {
+		return &keyHash{h: newHash()}
+	}
+	return kh
+}
+
+// hash returns the hash of the key and the salt, in the Sum of the returned keyHash,
+// which goes back to the pool with put.
+func (kh *keyHasher) hash(salt []byte) *keyHash {
+	k := kh.pool.Get().(*keyHash)
+	_ = k.h.(encoding.BinaryUnmarshaler).UnmarshalBinary(kh.state)
+	_, _ = k.h.Write(salt)
+	k.h.Sum(k.Sum[:0])
+	return k
+}
+
+func (kh *keyHasher) put(k *keyHash) {
+	kh.pool.Put(k)
+}
@@ -0,0 +1,6 @@
+//go:build race
+
+package obfs
+
+// sync.Pool drops items at random under the race detector, so allocations can't be counted.
+const raceEnabled = true
@@ -0,0 +1,85 @@
+package obfs
+
+import (
+	"crypto/rand"
+	"errors"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	smSaltLen = 8
+	smKeyLen  = blake2b.Size256
+
+	smMinPSKLen = 4
+
+	NameXPlus      = "xplus"
+	NameSalamander = "salamander"
+)
+
+var errPSKTooShort = errors.New("salamander password must be at least 4 bytes")
+
+// SalamanderObfuscator obfuscates payload like XPlus, but with BLAKE2b-256 keys and crypto/rand salts,
+// the format Hysteria 2 clients speak.
+// Packet format: [8-byte salt][payload XORed with BLAKE2b-256(key + salt), repeated]
+// It's safe for concurrent use and doesn't allocate.
+type SalamanderObfuscator struct {
+	PSK []byte
+
+	hasher *keyHasher
+}
+
+func NewSalamanderObfuscator(psk []byte) (*SalamanderObfuscator, error) {
+	if len(psk) < smMinPSKLen {
+		return nil, errPSKTooShort
+	}
+	return &SalamanderObfuscator{
+		PSK:    psk,
+		hasher: newKeyHasher(newBLAKE2b256, psk),
+	}, nil
+}
+
+func newBLAKE2b256() hash.Hash {
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+func (o *SalamanderObfuscator) Deobfuscate(in []byte, out []byte) int {
+	outLen := len(in) - smSaltLen
+	if outLen <= 0 || len(out) < outLen {
+		return 0
+	}
+	key := o.hasher.hash(in[:smSaltLen])
+	xorKey(out, in[smSaltLen:], key.Sum[:smKeyLen])
+	o.hasher.put(key)
+	return outLen
+}
+
+func (o *SalamanderObfuscator) Obfuscate(in []byte, out []byte) int {
+	outLen := len(in) + smSaltLen
+	if len(out) < outLen {
+		return 0
+	}
+	_, _ = rand.Read(out[:smSaltLen])
+	key := o.hasher.hash(out[:smSaltLen])
+	xorKey(out[smSaltLen:], in, key.Sum[:smKeyLen])
+	o.hasher.put(key)
+	return outLen
+}
+
+// NewObfuscator creates the obfuscator the obfs config string names, "salamander:<password>" or
+// "xplus:<password>". Anything else is an XPlus password as it has always been.
+func NewObfuscator(config string) (Obfuscator, error) {
+	name, password, ok := strings.Cut(config, ":")
+	if ok {
+		switch name {
+		case NameSalamander:
+			return NewSalamanderObfuscator([]byte(password))
+		case NameXPlus:
+			return NewXPlusObfuscator([]byte(password)), nil
+		}
+	}
+	return NewXPlusObfuscator([]byte(config)), nil
+}
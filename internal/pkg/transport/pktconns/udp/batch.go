@@ -0,0 +1,29 @@
+package udp
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// BatchSize is the most packets read by a single syscall.
+const BatchSize = 8
+
+// Message is a packet of a batch, like ipv4.Message.
+type Message = ipv4.Message
+
+// batchPacketConn is ipv4.PacketConn or ipv6.PacketConn, they use recvmmsg and sendmmsg on Linux
+// and read and write a single packet per call elsewhere. QUIC reads and writes through them too
+// if the packet conn has them.
+type batchPacketConn interface {
+	ReadBatch(ms []Message, flags int) (int, error)
+	WriteBatch(ms []Message, flags int) (int, error)
+}
+
+func newBatchPacketConn(conn *net.UDPConn) batchPacketConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
@@ -0,0 +1,98 @@
+package udp
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/xflash-panda/server-hysteria/internal/pkg/sockopt"
+)
+
+// UDPConn is a bare UDP socket with GSO and GRO where the kernel has them. QUIC reads and writes it
+// a batch at a time, with ReadBatch and WriteBatch, everything else goes a packet at a time.
+type UDPConn struct {
+	orig    *net.UDPConn
+	offload *offloadConn
+}
+
+func NewUDPConn(orig *net.UDPConn) *UDPConn {
+	return &UDPConn{orig: orig, offload: newOffloadConn(orig)}
+}
+
+// Offload tells the offloads in use and the buffer sizes of the socket.
+func (c *UDPConn) Offload() sockopt.UDPOffload {
+	o := sockopt.ProbeUDPOffload(c.orig)
+	o.GSO, o.GRO = c.offload.offload()
+	return o
+}
+
+func (c *UDPConn) ReadBatch(ms []Message, flags int) (int, error) {
+	return c.offload.ReadBatch(ms, flags)
+}
+
+func (c *UDPConn) WriteBatch(ms []Message, flags int) (int, error) {
+	return c.offload.WriteBatch(ms, flags)
+}
+
+// ReadMsgUDP is like net.UDPConn.ReadMsgUDP, reads of coalesced packets return one of them at a time.
+func (c *UDPConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	ms := []Message{{Buffers: [][]byte{b}, OOB: oob}}
+	if _, err = c.offload.ReadBatch(ms, 0); err != nil {
+		return 0, 0, 0, nil, err
+	}
+	addr, _ = ms[0].Addr.(*net.UDPAddr)
+	return ms[0].N, ms[0].NN, ms[0].Flags, addr, nil
+}
+
+func (c *UDPConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	return c.orig.WriteMsgUDP(b, oob, addr)
+}
+
+func (c *UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, _, _, addr, err := c.ReadMsgUDP(p, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, addr, nil
+}
+
+func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.orig.WriteTo(p, addr)
+}
+
+func (c *UDPConn) Close() error {
+	return c.orig.Close()
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	return c.orig.LocalAddr()
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	return c.orig.SetDeadline(t)
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	return c.orig.SetReadDeadline(t)
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	return c.orig.SetWriteDeadline(t)
+}
+
+func (c *UDPConn) SetReadBuffer(bytes int) error {
+	return c.orig.SetReadBuffer(bytes)
+}
+
+func (c *UDPConn) SetWriteBuffer(bytes int) error {
+	return c.orig.SetWriteBuffer(bytes)
+}
+
+func (c *UDPConn) SyscallConn() (syscall.RawConn, error) {
+	return c.orig.SyscallConn()
+}
+
+func (c *UDPConn) File() (f *os.File, err error) {
+	return c.orig.File()
+}
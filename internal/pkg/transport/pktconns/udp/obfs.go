@@ -7,55 +7,145 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/xflash-panda/server-hysteria/internal/pkg/sockopt"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/transport/pktconns/obfs"
 )
 
-const udpBufferSize = 4086
-
+// ObfsUDPPacketConn obfuscates every packet. QUIC reads and writes it a batch at a time, with ReadBatch and
+// WriteBatch, over recvmmsg and sendmmsg with GSO and GRO where the kernel has them. Packets are obfuscated
+// and deobfuscated in the goroutine that writes or reads them, in parallel, only reads take turns while GRO is on.
 type ObfsUDPPacketConn struct {
-	orig *net.UDPConn
-	obfs obfs.Obfuscator
-
-	readBuf    []byte
-	readMutex  sync.Mutex
-	writeBuf   []byte
-	writeMutex sync.Mutex
+	orig    *net.UDPConn
+	obfs    obfs.Obfuscator
+	offload *offloadConn
 }
 
 func NewObfsUDPConn(orig *net.UDPConn, obfs obfs.Obfuscator) *ObfsUDPPacketConn {
 	return &ObfsUDPPacketConn{
-		orig:     orig,
-		obfs:     obfs,
-		readBuf:  make([]byte, udpBufferSize),
-		writeBuf: make([]byte, udpBufferSize),
+		orig:    orig,
+		obfs:    obfs,
+		offload: newOffloadConn(orig),
 	}
 }
 
-func (c *ObfsUDPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+// Offload tells the offloads in use and the buffer sizes of the socket.
+func (c *ObfsUDPPacketConn) Offload() sockopt.UDPOffload {
+	o := sockopt.ProbeUDPOffload(c.orig)
+	o.GSO, o.GRO = c.offload.offload()
+	return o
+}
+
+// obfsBatch is the obfuscated packets of a batch in pooled buffers.
+type obfsBatch struct {
+	msgs []Message
+	bufs []*[]byte
+}
+
+var obfsBatchPool = sync.Pool{
+	New: func() interface{} { return new(obfsBatch) },
+}
+
+// getObfsBatch returns a batch of n messages, each with a buffer of obfs.BufferSize.
+func getObfsBatch(n int) *obfsBatch {
+	b := obfsBatchPool.Get().(*obfsBatch)
+	for len(b.msgs) < n {
+		b.msgs = append(b.msgs, Message{Buffers: make([][]byte, 1)})
+		b.bufs = append(b.bufs, obfs.GetBuffer())
+	}
+	for i := range b.msgs[:n] {
+		b.msgs[i].Buffers[0] = *b.bufs[i]
+	}
+	return b
+}
+
+func putObfsBatch(b *obfsBatch) {
+	for i := range b.msgs {
+		b.msgs[i].OOB, b.msgs[i].Addr = nil, nil
+	}
+	obfsBatchPool.Put(b)
+}
+
+// ReadBatch reads packets and deobfuscates them into ms, dropping the invalid ones.
+// It reads again rather than return no packets without an error.
+func (c *ObfsUDPPacketConn) ReadBatch(ms []Message, flags int) (int, error) {
+	b := getObfsBatch(len(ms))
+	defer putObfsBatch(b)
 	for {
-		c.readMutex.Lock()
-		n, addr, err := c.orig.ReadFrom(c.readBuf)
-		if n <= 0 {
-			c.readMutex.Unlock()
-			return 0, addr, err
+		for i := range ms {
+			// The control messages are read right into the caller's
+			b.msgs[i].OOB = ms[i].OOB
+		}
+		n, err := c.offload.ReadBatch(b.msgs[:len(ms)], flags)
+		valid := 0
+		for i := 0; i < n; i++ {
+			m := &b.msgs[i]
+			out := &ms[valid]
+			newN := c.obfs.Deobfuscate(m.Buffers[0][:m.N], out.Buffers[0])
+			if newN <= 0 {
+				continue
+			}
+			out.N = newN
+			out.NN = copy(out.OOB, m.OOB[:m.NN])
+			out.Addr = m.Addr
+			out.Flags = m.Flags
+			valid++
 		}
-		newN := c.obfs.Deobfuscate(c.readBuf[:n], p)
-		c.readMutex.Unlock()
-		if newN > 0 {
-			// Valid packet
-			return newN, addr, err
-		} else if err != nil {
-			// Not valid and orig.ReadFrom had some error
-			return 0, addr, err
+		if valid > 0 || err != nil {
+			return valid, err
 		}
 	}
 }
 
+// WriteBatch obfuscates the packets of ms, which must have a single buffer each, and writes them.
+func (c *ObfsUDPPacketConn) WriteBatch(ms []Message, flags int) (int, error) {
+	b := getObfsBatch(len(ms))
+	defer putObfsBatch(b)
+	for i := range ms {
+		m := &b.msgs[i]
+		m.Buffers[0] = m.Buffers[0][:c.obfs.Obfuscate(ms[i].Buffers[0], m.Buffers[0])]
+		m.OOB = ms[i].OOB
+		m.Addr = ms[i].Addr
+	}
+	return c.offload.WriteBatch(b.msgs[:len(ms)], flags)
+}
+
+func (c *ObfsUDPPacketConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	ms := []Message{{Buffers: [][]byte{b}, OOB: oob}}
+	if _, err = c.ReadBatch(ms, 0); err != nil {
+		return 0, 0, 0, nil, err
+	}
+	addr, _ = ms[0].Addr.(*net.UDPAddr)
+	return ms[0].N, ms[0].NN, ms[0].Flags, addr, nil
+}
+
+func (c *ObfsUDPPacketConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	buf := obfs.GetBuffer()
+	defer obfs.PutBuffer(buf)
+	bn := c.obfs.Obfuscate(b, *buf)
+	if _, oobn, err = c.orig.WriteMsgUDP((*buf)[:bn], oob, addr); err != nil {
+		return 0, 0, err
+	}
+	return len(b), oobn, nil
+}
+
+func (c *ObfsUDPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, _, _, addr, err := c.ReadMsgUDP(p, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, addr, nil
+}
+
 func (c *ObfsUDPPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	c.writeMutex.Lock()
-	bn := c.obfs.Obfuscate(p, c.writeBuf)
-	_, err = c.orig.WriteTo(c.writeBuf[:bn], addr)
-	c.writeMutex.Unlock()
+	buf := obfs.GetBuffer()
+	bn := c.obfs.Obfuscate(p, *buf)
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		// Unlike WriteTo, this doesn't allocate
+		_, err = c.orig.WriteToUDPAddrPort((*buf)[:bn], udpAddr.AddrPort())
+	} else {
+		_, err = c.orig.WriteTo((*buf)[:bn], addr)
+	}
+	obfs.PutBuffer(buf)
 	if err != nil {
 		return 0, err
 	} else {
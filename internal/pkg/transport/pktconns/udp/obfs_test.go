@@ -0,0 +1,160 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/xflash-panda/server-hysteria/internal/pkg/transport/pktconns/obfs"
+)
+
+var (
+	_ quic.OOBCapablePacketConn = (*ObfsUDPPacketConn)(nil)
+	_ batchPacketConn           = (*ObfsUDPPacketConn)(nil)
+)
+
+func newTestConn(t *testing.T) *ObfsUDPPacketConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm, _ := obfs.NewSalamanderObfuscator([]byte("Vaundy"))
+	c := NewObfsUDPConn(conn, sm)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestObfsUDPPacketConn(t *testing.T) {
+	server, client := newTestConn(t), newTestConn(t)
+	const packets = 50
+
+	// Half one after another, half concurrently
+	for i := 0; i < packets/2; i++ {
+		if _, err := client.WriteTo([]byte(fmt.Sprintf("packet %d", i)), server.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := packets / 2; i < packets; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _ = client.WriteTo([]byte(fmt.Sprintf("packet %d", i)), server.LocalAddr())
+		}(i)
+	}
+	wg.Wait()
+
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	seen := make(map[string]bool)
+	buf := make([]byte, 2048)
+	for len(seen) < packets {
+		n, addr, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %d packets: %s", len(seen), err)
+		}
+		if addr.String() != client.LocalAddr().String() {
+			t.Errorf("packet from %s", addr)
+		}
+		seen[string(buf[:n])] = true
+	}
+	for i := 0; i < packets; i++ {
+		if !seen[fmt.Sprintf("packet %d", i)] {
+			t.Errorf("packet %d missing", i)
+		}
+	}
+}
+
+func TestObfsUDPPacketConnBatch(t *testing.T) {
+	server, client := newTestConn(t), newTestConn(t)
+
+	const packets = 20
+	ms := make([]Message, packets)
+	for i := range ms {
+		ms[i] = Message{Buffers: [][]byte{bytes.Repeat([]byte{byte(i)}, 1200)}, Addr: server.LocalAddr()}
+	}
+	if n, err := client.WriteBatch(ms, 0); err != nil || n != packets {
+		t.Fatalf("wrote %d packets: %v", n, err)
+	}
+	// Not obfuscated, so it's dropped
+	if _, err := client.orig.WriteTo([]byte("garbage"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.WriteBatch(ms[:1], 0); err != nil || n != 1 {
+		t.Fatalf("wrote %d packets: %v", n, err)
+	}
+
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	in := make([]Message, 4)
+	for i := range in {
+		in[i] = Message{Buffers: [][]byte{make([]byte, 1500)}, OOB: make([]byte, oobBufferSize)}
+	}
+	var got int
+	for got < packets+1 {
+		n, err := server.ReadBatch(in, 0)
+		if err != nil {
+			t.Fatalf("got %d packets: %v", got, err)
+		}
+		for _, m := range in[:n] {
+			if !bytes.Equal(m.Buffers[0][:m.N], ms[got%packets].Buffers[0]) {
+				t.Fatalf("packet %d: got %d bytes of %d", got, m.N, m.Buffers[0][0])
+			}
+			if m.Addr.String() != client.LocalAddr().String() {
+				t.Errorf("packet from %s", m.Addr)
+			}
+			got++
+		}
+	}
+}
+
+func TestObfsUDPPacketConnQUIC(t *testing.T) {
+	server, client := newTestConn(t), newTestConn(t)
+	listener, err := quic.Listen(server, testTLSConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(stream, stream)
+		_ = stream.Close()
+	}()
+
+	conn, err := quic.Dial(client, server.LocalAddr(), "localhost",
+		&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"test"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4<<20)
+	_, _ = rand.Read(data)
+	go func() {
+		_, _ = stream.Write(data)
+		_ = stream.Close()
+	}()
+	echoed, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Errorf("echoed %d bytes, not what was sent", len(echoed))
+	}
+}
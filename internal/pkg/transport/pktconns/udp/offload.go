@@ -0,0 +1,196 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/xflash-panda/server-hysteria/internal/pkg/sockopt"
+)
+
+const (
+	// maxGSOSegments is the most packets the kernel takes in a single segmented send.
+	maxGSOSegments = 64
+	// maxGSOSize is the most bytes of a segmented send, what fits in a UDP datagram.
+	maxGSOSize = 65000
+	// groBufferSize fits the most the kernel coalesces into a single read.
+	groBufferSize = 65536
+	// oobBufferSize fits the control messages of a read: packet info, ECN and the GRO size.
+	oobBufferSize = 128
+)
+
+// offloadConn reads and writes packets a batch at a time with recvmmsg and sendmmsg. Where the kernel does,
+// the packets of a batch to the same address and of the same size go out as one send the kernel or the NIC
+// splits up (GSO), and the packets the kernel coalesced on the way in (GRO) are split up again.
+// Writes run in parallel, reads take turns while GRO is on.
+type offloadConn struct {
+	conn batchPacketConn
+	gso  atomic.Bool
+	gro  bool
+
+	readMutex sync.Mutex
+	msgs      []Message
+	n         int // messages of the last read
+	pos       int // next message
+	off       int // next segment of it
+}
+
+func newOffloadConn(conn *net.UDPConn) *offloadConn {
+	c := &offloadConn{conn: newBatchPacketConn(conn)}
+	c.gso.Store(sockopt.ProbeUDPOffload(conn).GSO)
+	if sockopt.EnableUDPGRO(conn) == nil {
+		c.gro = true
+		c.msgs = make([]Message, BatchSize)
+		for i := range c.msgs {
+			c.msgs[i].Buffers = [][]byte{make([]byte, groBufferSize)}
+			c.msgs[i].OOB = make([]byte, oobBufferSize)
+		}
+	}
+	return c
+}
+
+// offload tells which offloads are in use.
+func (c *offloadConn) offload() (gso, gro bool) {
+	return c.gso.Load(), c.gro
+}
+
+func (c *offloadConn) ReadBatch(ms []Message, flags int) (int, error) {
+	if !c.gro {
+		return c.conn.ReadBatch(ms, flags)
+	}
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	if c.pos == c.n {
+		n, err := c.conn.ReadBatch(c.msgs, flags)
+		if n <= 0 {
+			return 0, err
+		}
+		c.n, c.pos, c.off = n, 0, 0
+	}
+	var n int
+	for n < len(ms) && c.pos < c.n {
+		m := &c.msgs[c.pos]
+		data := m.Buffers[0][c.off:m.N]
+		oob := m.OOB[:m.NN]
+		size := sockopt.UDPGROSize(oob)
+		if size <= 0 || size > len(data) {
+			size = len(data)
+		}
+		out := &ms[n]
+		out.N = copy(out.Buffers[0], data[:size])
+		out.NN = copy(out.OOB, oob)
+		out.Addr = m.Addr
+		out.Flags = m.Flags
+		n++
+		c.off += size
+		if c.off >= m.N {
+			c.pos++
+			c.off = 0
+		}
+	}
+	return n, nil
+}
+
+func (c *offloadConn) WriteBatch(ms []Message, flags int) (int, error) {
+	if !c.gso.Load() {
+		return c.conn.WriteBatch(ms, flags)
+	}
+	b := getWriteBatch()
+	defer putWriteBatch(b)
+	b.group(ms)
+	sent, err := c.conn.WriteBatch(b.msgs, flags)
+	n := 0
+	for _, count := range b.counts[:sent] {
+		n += count
+	}
+	if err != nil && errors.Is(err, syscall.EIO) {
+		// The NIC can't do it after all, send them one by one from now on
+		c.gso.Store(false)
+		sent, err = c.conn.WriteBatch(ms[n:], flags)
+		n += sent
+	}
+	return n, err
+}
+
+// writeBatch is the messages of a segmented send and the space they take.
+type writeBatch struct {
+	msgs   []Message
+	counts []int // of the packets in every message
+	bufs   [][]byte
+	oob    []byte
+}
+
+var writeBatchPool = sync.Pool{
+	New: func() interface{} { return new(writeBatch) },
+}
+
+func getWriteBatch() *writeBatch {
+	return writeBatchPool.Get().(*writeBatch)
+}
+
+func putWriteBatch(b *writeBatch) {
+	for i := range b.msgs {
+		b.msgs[i] = Message{}
+	}
+	for i := range b.bufs {
+		b.bufs[i] = nil
+	}
+	b.msgs, b.counts, b.bufs, b.oob = b.msgs[:0], b.counts[:0], b.bufs[:0], b.oob[:0]
+	writeBatchPool.Put(b)
+}
+
+// group turns runs of packets to the same address with the same control messages, all of the size of
+// the first but the last, which may be shorter, into single segmented messages.
+func (b *writeBatch) group(ms []Message) {
+	if cap(b.bufs) < len(ms) {
+		b.bufs = make([][]byte, 0, len(ms))
+	}
+	for i := 0; i < len(ms); {
+		first := &ms[i]
+		j := i + 1
+		if len(first.Buffers) == 1 && len(first.Buffers[0]) > 0 {
+			size := len(first.Buffers[0])
+			total := size
+			for j < len(ms) && j-i < maxGSOSegments {
+				next := &ms[j]
+				if len(next.Buffers) != 1 || len(next.Buffers[0]) > size || total+len(next.Buffers[0]) > maxGSOSize ||
+					!sameAddr(first.Addr, next.Addr) || string(first.OOB) != string(next.OOB) {
+					break
+				}
+				total += len(next.Buffers[0])
+				j++
+				if len(next.Buffers[0]) < size {
+					// A shorter one ends the run
+					break
+				}
+			}
+		}
+		if j-i == 1 {
+			b.msgs = append(b.msgs, Message{Buffers: first.Buffers, OOB: first.OOB, Addr: first.Addr})
+			b.counts = append(b.counts, 1)
+			i++
+			continue
+		}
+		start := len(b.bufs)
+		for k := i; k < j; k++ {
+			b.bufs = append(b.bufs, ms[k].Buffers[0])
+		}
+		oobStart := len(b.oob)
+		b.oob = append(b.oob, first.OOB...)
+		b.oob = sockopt.AppendUDPSegment(b.oob, uint16(len(first.Buffers[0])))
+		b.msgs = append(b.msgs, Message{Buffers: b.bufs[start:len(b.bufs):len(b.bufs)], OOB: b.oob[oobStart:], Addr: first.Addr})
+		b.counts = append(b.counts, j-i)
+		i = j
+	}
+}
+
+func sameAddr(a, b net.Addr) bool {
+	if a == b {
+		return true
+	}
+	ua, ok1 := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	return ok1 && ok2 && ua.Port == ub.Port && ua.IP.Equal(ub.IP) && ua.Zone == ub.Zone
+}
@@ -0,0 +1,169 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUIC takes the UDP conn for a *net.UDPConn and reads and writes it a batch at a time
+var (
+	_ quic.OOBCapablePacketConn = (*UDPConn)(nil)
+	_ batchPacketConn           = (*UDPConn)(nil)
+)
+
+func newTestUDPConn(t *testing.T) *UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewUDPConn(conn)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestWriteBatchGroup(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	b := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}
+	msg := func(addr net.Addr, size int) Message {
+		return Message{Buffers: [][]byte{make([]byte, size)}, Addr: addr}
+	}
+	ms := []Message{
+		msg(a, 1200), msg(a, 1200), msg(a, 500), // a shorter one ends a run
+		msg(a, 1200), msg(a, 1300), // a longer one doesn't join
+		msg(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}, 1300), // the same address
+		msg(b, 1300),
+	}
+	wb := getWriteBatch()
+	defer putWriteBatch(wb)
+	wb.group(ms)
+	want := []int{3, 1, 2, 1}
+	if len(wb.counts) != len(want) {
+		t.Fatalf("got counts %v, want %v", wb.counts, want)
+	}
+	for i, count := range want {
+		if wb.counts[i] != count || len(wb.msgs[i].Buffers) != count {
+			t.Errorf("message %d: got %d packets, want %d", i, len(wb.msgs[i].Buffers), count)
+		}
+		// The segment size goes along as a control message
+		if segmented := len(wb.msgs[i].OOB) > 0; runtime.GOOS == "linux" && segmented != (count > 1) {
+			t.Errorf("message %d: segmented %v with %d packets", i, segmented, count)
+		}
+	}
+}
+
+func TestUDPConnOffload(t *testing.T) {
+	server, client := newTestUDPConn(t), newTestUDPConn(t)
+	t.Logf("offloads: %+v", server.Offload())
+
+	const packets = 20
+	ms := make([]Message, packets)
+	for i := range ms {
+		size := 1200
+		if i == packets-1 {
+			size = 300
+		}
+		ms[i] = Message{Buffers: [][]byte{bytes.Repeat([]byte{byte(i)}, size)}, Addr: server.LocalAddr()}
+	}
+	if n, err := client.WriteBatch(ms, 0); err != nil || n != packets {
+		t.Fatalf("wrote %d packets: %v", n, err)
+	}
+
+	// However the packets were sent and received, they come out one by one as they were
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	in := make([]Message, 4)
+	for i := range in {
+		in[i] = Message{Buffers: [][]byte{make([]byte, 1500)}, OOB: make([]byte, oobBufferSize)}
+	}
+	var got int
+	for got < packets {
+		n, err := server.ReadBatch(in, 0)
+		if err != nil {
+			t.Fatalf("got %d packets: %v", got, err)
+		}
+		for _, m := range in[:n] {
+			if !bytes.Equal(m.Buffers[0][:m.N], ms[got].Buffers[0]) {
+				t.Fatalf("packet %d: got %d bytes of %d", got, m.N, m.Buffers[0][0])
+			}
+			got++
+		}
+	}
+}
+
+func TestUDPConnQUIC(t *testing.T) {
+	server, client := newTestUDPConn(t), newTestUDPConn(t)
+	listener, err := quic.Listen(server, testTLSConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(stream, stream)
+		_ = stream.Close()
+	}()
+
+	conn, err := quic.Dial(client, server.LocalAddr(), "localhost",
+		&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"test"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4<<20)
+	_, _ = rand.Read(data)
+	go func() {
+		_, _ = stream.Write(data)
+		_ = stream.Close()
+	}()
+	echoed, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Errorf("echoed %d bytes, not what was sent", len(echoed))
+	}
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"test"},
+	}
+}
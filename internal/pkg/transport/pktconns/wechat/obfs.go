@@ -5,53 +5,44 @@ import (
 	"math/rand"
 	"net"
 	"os"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/xflash-panda/server-hysteria/internal/pkg/transport/pktconns/obfs"
 )
 
-const udpBufferSize = 4096
-
 // ObfsWeChatUDPPacketConn is still a UDP packet conn, but it adds WeChat video call header to each packet.
 // Obfs in this case can be nil
 type ObfsWeChatUDPPacketConn struct {
 	orig *net.UDPConn
 	obfs obfs.Obfuscator
 
-	readBuf    []byte
-	readMutex  sync.Mutex
-	writeBuf   []byte
-	writeMutex sync.Mutex
-	sn         uint32
+	sn uint32
 }
 
 func NewObfsWeChatUDPConn(orig *net.UDPConn, obfs obfs.Obfuscator) *ObfsWeChatUDPPacketConn {
 	return &ObfsWeChatUDPPacketConn{
-		orig:     orig,
-		obfs:     obfs,
-		readBuf:  make([]byte, udpBufferSize),
-		writeBuf: make([]byte, udpBufferSize),
-		sn:       rand.Uint32() & 0xFFFF,
+		orig: orig,
+		obfs: obfs,
+		sn:   rand.Uint32() & 0xFFFF,
 	}
 }
 
 func (c *ObfsWeChatUDPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := obfs.GetBuffer()
+	defer obfs.PutBuffer(buf)
 	for {
-		c.readMutex.Lock()
-		n, addr, err := c.orig.ReadFrom(c.readBuf)
+		n, addr, err := c.orig.ReadFrom(*buf)
 		if n <= 13 {
-			c.readMutex.Unlock()
 			return 0, addr, err
 		}
 		var newN int
 		if c.obfs != nil {
-			newN = c.obfs.Deobfuscate(c.readBuf[13:n], p)
+			newN = c.obfs.Deobfuscate((*buf)[13:n], p)
 		} else {
-			newN = copy(p, c.readBuf[13:n])
+			newN = copy(p, (*buf)[13:n])
 		}
-		c.readMutex.Unlock()
 		if newN > 0 {
 			// Valid packet
 			return newN, addr, err
@@ -63,26 +54,30 @@ func (c *ObfsWeChatUDPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 }
 
 func (c *ObfsWeChatUDPPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	c.writeMutex.Lock()
-	c.writeBuf[0] = 0xa1
-	c.writeBuf[1] = 0x08
-	binary.BigEndian.PutUint32(c.writeBuf[2:], c.sn)
-	c.sn++
-	c.writeBuf[6] = 0x00
-	c.writeBuf[7] = 0x10
-	c.writeBuf[8] = 0x11
-	c.writeBuf[9] = 0x18
-	c.writeBuf[10] = 0x30
-	c.writeBuf[11] = 0x22
-	c.writeBuf[12] = 0x30
+	buf := obfs.GetBuffer()
+	defer obfs.PutBuffer(buf)
+	b := *buf
+	b[0] = 0xa1
+	b[1] = 0x08
+	binary.BigEndian.PutUint32(b[2:], atomic.AddUint32(&c.sn, 1)-1)
+	b[6] = 0x00
+	b[7] = 0x10
+	b[8] = 0x11
+	b[9] = 0x18
+	b[10] = 0x30
+	b[11] = 0x22
+	b[12] = 0x30
 	var bn int
 	if c.obfs != nil {
-		bn = c.obfs.Obfuscate(p, c.writeBuf[13:])
+		bn = c.obfs.Obfuscate(p, b[13:])
+	} else {
+		bn = copy(b[13:], p)
+	}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		_, err = c.orig.WriteToUDPAddrPort(b[:13+bn], udpAddr.AddrPort())
 	} else {
-		bn = copy(c.writeBuf[13:], p)
+		_, err = c.orig.WriteTo(b[:13+bn], addr)
 	}
-	_, err = c.orig.WriteTo(c.writeBuf[:13+bn], addr)
-	c.writeMutex.Unlock()
 	if err != nil {
 		return 0, err
 	} else {
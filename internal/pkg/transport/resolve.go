@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net"
 	"time"
+
+	"github.com/xflash-panda/server-hysteria/internal/pkg/metrics"
 )
 
 type ResolvePreference int
@@ -26,60 +28,70 @@ var (
 	errNoAddr     = errors.New("no address")
 )
 
-func resolveIPAddrWithPreference(host string, pref ResolvePreference) (*net.IPAddr, error) {
-	if pref == ResolvePreferenceDefault {
-		return net.ResolveIPAddr("ip", host)
+// Resolver looks up all the addresses of a host, net.DefaultResolver is one.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func resolveIPAddrWithPreference(resolver Resolver, host string, pref ResolvePreference) (*net.IPAddr, error) {
+	ips, err := resolveIPAddrsWithPreference(resolver, host, pref)
+	if err != nil {
+		return nil, err
+	}
+	return &ips[0], nil
+}
+
+// resolveIPAddrsWithPreference returns the addresses of the host in the order they should be tried.
+// IPv4 only and IPv6 only leave out the other family, the others interleave both families starting
+// with the preferred one, as RFC 8305 suggests. The default prefers IPv4, like net.ResolveIPAddr.
+func resolveIPAddrsWithPreference(resolver Resolver, host string, pref ResolvePreference) ([]net.IPAddr, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), ResolveTimeout)
-	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	start := time.Now()
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	metrics.DNSDuration.Observe(time.Since(start).Seconds())
 	cancel()
 	if err != nil {
 		return nil, err
 	}
-	var ip4, ip6 *net.IPAddr
-	for i := range ips {
-		ip := &ips[i]
-		is4 := ip.IP.To4() != nil
-		if ip4 == nil && is4 {
-			ip4 = ip
-		} else if ip6 == nil && !is4 {
-			ip6 = ip
-		}
-		if ip4 != nil && ip6 != nil {
-			break
+	var ip4s, ip6s []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			ip4s = append(ip4s, ip)
+		} else {
+			ip6s = append(ip6s, ip)
 		}
 	}
 	switch pref {
 	case ResolvePreferenceIPv4:
-		if ip4 == nil {
+		if len(ip4s) == 0 {
 			return nil, errNoIPv4Addr
 		}
-		return ip4, nil
+		return ip4s, nil
 	case ResolvePreferenceIPv6:
-		if ip6 == nil {
+		if len(ip6s) == 0 {
 			return nil, errNoIPv6Addr
 		}
-		return ip6, nil
-	case ResolvePreferenceIPv4OrIPv6:
-		if ip4 == nil {
-			if ip6 == nil {
-				return nil, errNoAddr
-			} else {
-				return ip6, nil
-			}
-		}
-		return ip4, nil
+		return ip6s, nil
 	case ResolvePreferenceIPv6OrIPv4:
-		if ip6 == nil {
-			if ip4 == nil {
-				return nil, errNoAddr
-			} else {
-				return ip4, nil
-			}
+		ip4s, ip6s = ip6s, ip4s
+	}
+	if len(ip4s)+len(ip6s) == 0 {
+		return nil, errNoAddr
+	}
+	// Interleave, preferred family first
+	sorted := make([]net.IPAddr, 0, len(ip4s)+len(ip6s))
+	for i := 0; i < len(ip4s) || i < len(ip6s); i++ {
+		if i < len(ip4s) {
+			sorted = append(sorted, ip4s[i])
+		}
+		if i < len(ip6s) {
+			sorted = append(sorted, ip6s[i])
 		}
-		return ip6, nil
 	}
-	return nil, errNoAddr
+	return sorted, nil
 }
 
 func ResolvePreferenceFromString(preference string) (ResolvePreference, error) {
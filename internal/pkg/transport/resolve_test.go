@@ -0,0 +1,48 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type staticResolver []string
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	for _, s := range r {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(s)})
+	}
+	return addrs, nil
+}
+
+func TestResolveIPAddrsWithPreference(t *testing.T) {
+	r := staticResolver{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+	tests := []struct {
+		pref ResolvePreference
+		want []string
+	}{
+		{ResolvePreferenceDefault, []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "192.0.2.3"}},
+		{ResolvePreferenceIPv4OrIPv6, []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "192.0.2.3"}},
+		{ResolvePreferenceIPv6OrIPv4, []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}},
+		{ResolvePreferenceIPv4, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		{ResolvePreferenceIPv6, []string{"2001:db8::1", "2001:db8::2"}},
+	}
+	for _, tt := range tests {
+		addrs, err := resolveIPAddrsWithPreference(r, "example.com", tt.pref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, a := range addrs {
+			got = append(got, a.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("preference %d: got %v, want %v", tt.pref, got, tt.want)
+		}
+	}
+	if _, err := resolveIPAddrsWithPreference(staticResolver{"192.0.2.1"}, "example.com", ResolvePreferenceIPv6); err != errNoIPv6Addr {
+		t.Errorf("got %v, want %v", err, errNoIPv6Addr)
+	}
+}
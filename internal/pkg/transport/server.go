@@ -1,20 +1,22 @@
 package transport
 
 import (
+	"fmt"
 	"github.com/xflash-panda/server-hysteria/internal/pkg/utils"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"time"
-
-	"github.com/xflash-panda/server-hysteria/internal/pkg/sockopt"
 )
 
 type ServerTransport struct {
-	Dialer            *net.Dialer
-	SOCKS5Client      *SOCKS5Client
-	ResolvePreference ResolvePreference
-	LocalUDPAddr      *net.UDPAddr
-	LocalUDPIntf      *net.Interface
+	Resolver Resolver // nil means net.DefaultResolver
+	Guard    *Guard
+	// Outbounds by name, requests not routed to a specific one go through DefaultOutbound.
+	Outbounds       map[string]Outbound
+	DefaultOutbound string
+
+	resolvePreference atomic.Int32
 }
 
 // AddrEx is like net.TCPAddr or net.UDPAddr, but with additional domain information for SOCKS5.
@@ -23,6 +25,13 @@ type AddrEx struct {
 	Domain string
 	IPAddr *net.IPAddr
 	Port   int
+	// IPAddrs are the addresses of the domain in the order to try them, IPAddr is the first.
+	// Direct outbounds race them (Happy Eyeballs). If they are set along with the domain, the domain
+	// isn't resolved again, so that only the addresses the ACL matched are dialed.
+	IPAddrs []net.IPAddr
+	// Hijacked is set when an ACL hijack rule rewrote the address. The operator picked it, so it isn't
+	// checked against the guard, it may well be a local resolver.
+	Hijacked bool
 }
 
 func (a *AddrEx) String() string {
@@ -42,31 +51,37 @@ type STPacketConn interface {
 	Close() error
 }
 
-type udpSTPacketConn struct {
-	Conn *net.UDPConn
-}
-
-func (c *udpSTPacketConn) ReadFrom(bytes []byte) (int, *net.UDPAddr, error) {
-	return c.Conn.ReadFromUDP(bytes)
-}
-
-func (c *udpSTPacketConn) WriteTo(bytes []byte, ex *AddrEx) (int, error) {
-	return c.Conn.WriteToUDP(bytes, &net.UDPAddr{
-		IP:   ex.IPAddr.IP,
-		Port: ex.Port,
-		Zone: ex.IPAddr.Zone,
-	})
+var DefaultServerTransport = &ServerTransport{
+	Guard: mustNewGuard(nil, nil),
+	Outbounds: map[string]Outbound{
+		OutboundDirect: &DirectOutbound{
+			Dialer: &net.Dialer{
+				Timeout: 8 * time.Second,
+			},
+		},
+	},
+	DefaultOutbound: OutboundDirect,
 }
 
-func (c *udpSTPacketConn) Close() error {
-	return c.Conn.Close()
+// Fork returns a transport that shares the resolver, guard and outbounds of st, but has a resolve preference
+// of its own, so that each node of the process can have the one its panel asks for.
+func (st *ServerTransport) Fork() *ServerTransport {
+	f := &ServerTransport{
+		Resolver:        st.Resolver,
+		Guard:           st.Guard,
+		Outbounds:       st.Outbounds,
+		DefaultOutbound: st.DefaultOutbound,
+	}
+	f.SetResolvePreference(st.ResolvePreference())
+	return f
 }
 
-var DefaultServerTransport = &ServerTransport{
-	Dialer: &net.Dialer{
-		Timeout: 8 * time.Second,
-	},
-	ResolvePreference: ResolvePreferenceDefault,
+func mustNewGuard(blockCIDRs, allowCIDRs []string) *Guard {
+	g, err := NewGuard(blockCIDRs, allowCIDRs)
+	if err != nil {
+		panic(err)
+	}
+	return g
 }
 
 func (st *ServerTransport) ParseIPAddr(address string) (*net.IPAddr, bool) {
@@ -77,48 +92,120 @@ func (st *ServerTransport) ParseIPAddr(address string) (*net.IPAddr, bool) {
 	return nil, true
 }
 
-func (st *ServerTransport) ResolveIPAddr(address string) (*net.IPAddr, bool, error) {
+// ResolveIPAddrs returns the addresses of a domain in the order to try them, or the IP itself.
+func (st *ServerTransport) ResolveIPAddrs(address string) ([]net.IPAddr, bool, error) {
 	ip, isDomain := st.ParseIPAddr(address)
 	if !isDomain {
-		return ip, false, nil
+		return []net.IPAddr{*ip}, false, nil
 	}
-	ipAddr, err := resolveIPAddrWithPreference(address, st.ResolvePreference)
-	return ipAddr, true, err
+	ipAddrs, err := resolveIPAddrsWithPreference(st.Resolver, address, st.ResolvePreference())
+	return ipAddrs, true, err
 }
 
-func (st *ServerTransport) DialTCP(raddr *AddrEx) (*net.TCPConn, error) {
-	if st.SOCKS5Client != nil {
-		return st.SOCKS5Client.DialTCP(raddr)
-	} else {
-		conn, err := st.Dialer.Dial("tcp", raddr.String())
-		if err != nil {
-			return nil, err
-		}
-		return conn.(*net.TCPConn), nil
-	}
+func (st *ServerTransport) ResolvePreference() ResolvePreference {
+	return ResolvePreference(st.resolvePreference.Load())
 }
 
-func (st *ServerTransport) ListenUDP() (STPacketConn, error) {
-	if st.SOCKS5Client != nil {
-		return st.SOCKS5Client.ListenUDP()
-	} else {
-		conn, err := net.ListenUDP("udp", st.LocalUDPAddr)
-		if err != nil {
-			return nil, err
+// SetResolvePreference changes which addresses requests go to, it's safe to call while serving.
+func (st *ServerTransport) SetResolvePreference(pref ResolvePreference) {
+	st.resolvePreference.Store(int32(pref))
+}
+
+// prepareAddrEx gets the address ready for the outbound. Domains are resolved to all their addresses,
+// unless they come with them, and checked against the guard. For a direct outbound those the guard refuses are left out, and the domain
+// is dropped so that the dial can't end up anywhere else. A proxy resolves the domain on its own, so
+// it only gets it if none of the addresses is refused, nor can a domain that doesn't resolve here go
+// through it. IPs are checked against the guard either way, unless the outbound skips the guard
+// or the address is hijacked.
+func (st *ServerTransport) prepareAddrEx(addr *AddrEx, ob Outbound) (*AddrEx, error) {
+	guard, proxy := st.Guard, ob.ProxyEnabled()
+	if skipsGuard(ob) || addr.Hijacked {
+		guard = nil
+	}
+	if addr.Domain != "" {
+		if proxy && guard == nil {
+			return addr, nil
 		}
-		if st.LocalUDPIntf != nil {
-			err = sockopt.BindUDPConn("udp", conn, st.LocalUDPIntf)
+		ipAddrs := addr.IPAddrs
+		if len(ipAddrs) == 0 || proxy {
+			// The proxy resolves the domain on its own, all of its addresses have to pass
+			var err error
+			ipAddrs, err = resolveIPAddrsWithPreference(st.Resolver, addr.Domain, st.ResolvePreference())
 			if err != nil {
-				_ = conn.Close()
 				return nil, err
 			}
 		}
-		return &udpSTPacketConn{
-			Conn: conn,
-		}, nil
+		allowed := ipAddrs[:0:0]
+		var guardErr error
+		for _, ipAddr := range ipAddrs {
+			if guard != nil {
+				if err := guard.Check(ipAddr.IP); err != nil {
+					guardErr = err
+					continue
+				}
+			}
+			allowed = append(allowed, ipAddr)
+		}
+		if len(allowed) == 0 || (proxy && guardErr != nil) {
+			return nil, guardErr
+		}
+		if proxy {
+			return addr, nil
+		}
+		return &AddrEx{IPAddr: &allowed[0], IPAddrs: allowed, Port: addr.Port}, nil
+	}
+	if guard != nil {
+		if err := guard.Check(addr.IPAddr.IP); err != nil {
+			return nil, err
+		}
+	}
+	return addr, nil
+}
+
+// Outbound returns the outbound with the name, or the default one if the name is empty.
+func (st *ServerTransport) Outbound(name string) (Outbound, error) {
+	if name == "" {
+		name = st.DefaultOutbound
+	}
+	ob, ok := st.Outbounds[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown outbound %s", name)
+	}
+	return ob, nil
+}
+
+// HasOutbound reports whether there is an outbound with the name.
+func (st *ServerTransport) HasOutbound(name string) bool {
+	_, ok := st.Outbounds[name]
+	return ok
+}
+
+func (st *ServerTransport) DialTCP(outbound string, raddr *AddrEx) (*net.TCPConn, error) {
+	ob, err := st.Outbound(outbound)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err = st.prepareAddrEx(raddr, ob)
+	if err != nil {
+		return nil, err
+	}
+	return ob.DialTCP(raddr)
+}
+
+func (st *ServerTransport) ListenUDP(outbound string) (STPacketConn, error) {
+	ob, err := st.Outbound(outbound)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ob.ListenUDP()
+	if err != nil || st.Guard == nil {
+		return conn, err
 	}
+	return &guardedSTPacketConn{STPacketConn: conn, transport: st, outbound: ob}, nil
 }
 
-func (st *ServerTransport) ProxyEnabled() bool {
-	return st.SOCKS5Client != nil
+// ProxyEnabled reports whether the outbound resolves domains on its own.
+func (st *ServerTransport) ProxyEnabled(outbound string) bool {
+	ob, err := st.Outbound(outbound)
+	return err == nil && ob.ProxyEnabled()
 }
@@ -75,7 +75,7 @@ func (c *SOCKS5Client) request(conn *net.TCPConn, r *socks5.Request) (*socks5.Re
 }
 
 func (c *SOCKS5Client) DialTCP(raddr *AddrEx) (*net.TCPConn, error) {
-	conn, err := net.DialTCP("tcp", nil, c.ServerTCPAddr)
+	conn, err := dialProxy(c.ServerTCPAddr, c.NegTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -112,7 +112,7 @@ func (c *SOCKS5Client) DialTCP(raddr *AddrEx) (*net.TCPConn, error) {
 }
 
 func (c *SOCKS5Client) ListenUDP() (STPacketConn, error) {
-	conn, err := net.DialTCP("tcp", nil, c.ServerTCPAddr)
+	conn, err := dialProxy(c.ServerTCPAddr, c.NegTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -158,6 +158,10 @@ func (c *SOCKS5Client) ListenUDP() (STPacketConn, error) {
 	return sc, nil
 }
 
+func (c *SOCKS5Client) ProxyEnabled() bool {
+	return true
+}
+
 type socks5UDPConn struct {
 	tcpConn *net.TCPConn
 	udpConn *net.UDPConn
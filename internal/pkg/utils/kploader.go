@@ -2,29 +2,55 @@ package utils
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 )
 
+// keypairLoader holds the certificates of a server, picked by SNI. The default keypair, or the first one
+// of the dir if there is none, is for the names no certificate covers. The files are reloaded on change
+// and keypairs added to the dir go live right away.
 type keypairLoader struct {
 	certMu   sync.RWMutex
 	cert     *tls.Certificate
 	certPath string
 	keyPath  string
+	// dir holds more keypairs, <name>.crt or <name>.pem each with <name>.key.
+	dir      string
+	dirCerts map[string]*tls.Certificate // by cert path
+	names    map[string]*tls.Certificate // by lowercase DNS name, wildcards included
 }
 
-func NewKeypairLoader(certPath, keyPath string) (*keypairLoader, error) {
+// NewKeypairLoader loads the default keypair and the keypairs of certDir, either can be left out.
+func NewKeypairLoader(certPath, keyPath, certDir string) (*keypairLoader, error) {
+	if (len(certPath) == 0 || len(keyPath) == 0) && len(certDir) == 0 {
+		return nil, errors.New("no cert and key files")
+	}
 	loader := &keypairLoader{
 		certPath: certPath,
 		keyPath:  keyPath,
+		dir:      certDir,
 	}
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-	if err != nil {
-		return nil, err
+	if len(certPath) > 0 && len(keyPath) > 0 {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		loader.cert = &cert
+	}
+	if len(certDir) > 0 {
+		loader.loadDir()
+		if len(loader.dirCerts) == 0 && loader.cert == nil {
+			return nil, errors.New("no keypair in " + certDir)
+		}
 	}
-	loader.cert = &cert
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
@@ -36,6 +62,13 @@ func NewKeypairLoader(certPath, keyPath string) (*keypairLoader, error) {
 				if !ok {
 					return
 				}
+				if len(certDir) > 0 && event.Name != certPath && event.Name != keyPath &&
+					filepath.Dir(event.Name) == filepath.Clean(certDir) {
+					if isKeypairFile(event.Name) {
+						loader.loadDir()
+					}
+					continue
+				}
 				switch event.Op {
 				case fsnotify.Create, fsnotify.Write, fsnotify.Rename, fsnotify.Chmod:
 					logrus.WithFields(logrus.Fields{
@@ -62,15 +95,14 @@ func NewKeypairLoader(certPath, keyPath string) (*keypairLoader, error) {
 			}
 		}
 	}()
-	err = watcher.Add(certPath)
-	if err != nil {
-		_ = watcher.Close()
-		return nil, err
-	}
-	err = watcher.Add(keyPath)
-	if err != nil {
-		_ = watcher.Close()
-		return nil, err
+	for _, path := range []string{certPath, keyPath, certDir} {
+		if len(path) == 0 {
+			continue
+		}
+		if err := watcher.Add(path); err != nil {
+			_ = watcher.Close()
+			return nil, err
+		}
 	}
 	return loader, nil
 }
@@ -86,10 +118,120 @@ func (kpr *keypairLoader) load() error {
 	return nil
 }
 
+func isKeypairFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".crt", ".pem", ".key":
+		return true
+	}
+	return false
+}
+
+// loadDir loads the keypairs of the dir again. A keypair that fails to load, like one being written,
+// keeps its old certificate if it had one.
+func (kpr *keypairLoader) loadDir() {
+	entries, err := os.ReadDir(kpr.dir)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"dir":   kpr.dir,
+		}).Error("Failed to read the keypair dir")
+		return
+	}
+	kpr.certMu.RLock()
+	old := kpr.dirCerts
+	kpr.certMu.RUnlock()
+	dirCerts := make(map[string]*tls.Certificate)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
+		}
+		certPath := filepath.Join(kpr.dir, entry.Name())
+		keyPath := strings.TrimSuffix(certPath, ext) + ".key"
+		if certPath == kpr.certPath {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if err != nil {
+			if oldCert, ok := old[certPath]; ok {
+				dirCerts[certPath] = oldCert
+			}
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"cert":  certPath,
+				"key":   keyPath,
+			}).Error("Failed to load keypair")
+			continue
+		}
+		if _, ok := old[certPath]; !ok {
+			logrus.WithFields(logrus.Fields{
+				"cert":  certPath,
+				"names": cert.Leaf.DNSNames,
+			}).Info("Keypair added")
+		}
+		dirCerts[certPath] = &cert
+	}
+	for certPath := range old {
+		if _, ok := dirCerts[certPath]; !ok {
+			logrus.WithField("cert", certPath).Info("Keypair removed")
+		}
+	}
+
+	// Later files win names, in name order
+	paths := make([]string, 0, len(dirCerts))
+	for certPath := range dirCerts {
+		paths = append(paths, certPath)
+	}
+	sort.Strings(paths)
+	names := make(map[string]*tls.Certificate)
+	for _, certPath := range paths {
+		cert := dirCerts[certPath]
+		for _, name := range cert.Leaf.DNSNames {
+			names[strings.ToLower(name)] = cert
+		}
+	}
+	kpr.certMu.Lock()
+	kpr.dirCerts = dirCerts
+	kpr.names = names
+	kpr.certMu.Unlock()
+}
+
+// getCertificate returns the certificate of the name, exact names go before wildcards.
+func (kpr *keypairLoader) getCertificate(serverName string) *tls.Certificate {
+	kpr.certMu.RLock()
+	defer kpr.certMu.RUnlock()
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if len(name) > 0 {
+		if cert, ok := kpr.names[name]; ok {
+			return cert
+		}
+		if _, parent, ok := strings.Cut(name, "."); ok {
+			if cert, ok := kpr.names["*."+parent]; ok {
+				return cert
+			}
+		}
+	}
+	if kpr.cert != nil {
+		return kpr.cert
+	}
+	// The first of the dir stands in for the default
+	var first string
+	for certPath := range kpr.dirCerts {
+		if len(first) == 0 || certPath < first {
+			first = certPath
+		}
+	}
+	return kpr.dirCerts[first]
+}
+
 func (kpr *keypairLoader) GetCertificateFunc() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-		kpr.certMu.RLock()
-		defer kpr.certMu.RUnlock()
-		return kpr.cert, nil
+		if cert := kpr.getCertificate(clientHello.ServerName); cert != nil {
+			return cert, nil
+		}
+		return nil, errors.New("no certificate")
 	}
 }
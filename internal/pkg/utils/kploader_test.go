@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeKeypair(t *testing.T, certPath, keyPath string, names ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	// Key first, like a certificate tool renewing in place
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName returns the first name of the certificate served to the SNI.
+func servedName(t *testing.T, f func(*tls.ClientHelloInfo) (*tls.Certificate, error), sni string) string {
+	cert, err := f(&tls.ClientHelloInfo{ServerName: sni})
+	if err != nil {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.DNSNames[0]
+}
+
+func TestKeypairLoaderSNI(t *testing.T) {
+	dir := t.TempDir()
+	certDir := filepath.Join(dir, "certs")
+	_ = os.Mkdir(certDir, 0o755)
+	writeKeypair(t, filepath.Join(dir, "default.crt"), filepath.Join(dir, "default.key"), "default.test")
+	writeKeypair(t, filepath.Join(certDir, "a.crt"), filepath.Join(certDir, "a.key"), "a.test", "www.a.test")
+	writeKeypair(t, filepath.Join(certDir, "b.pem"), filepath.Join(certDir, "b.key"), "*.b.test")
+	_ = os.WriteFile(filepath.Join(certDir, "broken.crt"), []byte("nope"), 0o644)
+
+	kpl, err := NewKeypairLoader(filepath.Join(dir, "default.crt"), filepath.Join(dir, "default.key"), certDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := kpl.GetCertificateFunc()
+	for sni, want := range map[string]string{
+		"a.test":       "a.test",
+		"WWW.A.test.":  "a.test",
+		"x.b.test":     "*.b.test",
+		"b.test":       "default.test",
+		"y.x.b.test":   "default.test",
+		"unknown.test": "default.test",
+		"":             "default.test",
+	} {
+		if got := servedName(t, f, sni); got != want {
+			t.Errorf("%q got %s, want %s", sni, got, want)
+		}
+	}
+
+	// Added keypairs go live, removed ones go away
+	writeKeypair(t, filepath.Join(certDir, "c.crt"), filepath.Join(certDir, "c.key"), "c.test")
+	_ = os.Remove(filepath.Join(certDir, "a.crt"))
+	deadline := time.Now().Add(5 * time.Second)
+	for servedName(t, f, "c.test") != "c.test" || servedName(t, f, "a.test") != "default.test" {
+		if time.Now().After(deadline) {
+			t.Fatalf("dir changes not picked up, c.test got %s, a.test got %s",
+				servedName(t, f, "c.test"), servedName(t, f, "a.test"))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestKeypairLoaderDirOnly(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewKeypairLoader("", "", dir); err == nil {
+		t.Error("empty dir accepted")
+	}
+	writeKeypair(t, filepath.Join(dir, "b.crt"), filepath.Join(dir, "b.key"), "b.test")
+	writeKeypair(t, filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"), "a.test")
+	kpl, err := NewKeypairLoader("", "", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first keypair of the dir is the default
+	if got := servedName(t, kpl.GetCertificateFunc(), "unknown.test"); got != "a.test" {
+		t.Errorf("got %s, want a.test", got)
+	}
+}